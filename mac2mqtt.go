@@ -4,22 +4,34 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/rand"
+	"encoding/binary"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/shirou/gopsutil/v3/disk"
 	"github.com/shirou/gopsutil/v3/mem" // Using v3 for current versions
+	psnet "github.com/shirou/gopsutil/v3/net"
+	"github.com/shirou/gopsutil/v3/process"
 	"gopkg.in/yaml.v2"
 
 	sigar "github.com/cloudfoundry/gosigar"
@@ -38,11 +50,110 @@ const (
 	DefaultDiscoveryPrefix = "homeassistant"
 	DefaultTopicPrefix     = "mac2mqtt"
 	UpdateInterval         = 60 * time.Second
+	SensorCheckInterval    = 5 * time.Second // how often the main loop checks which sensors are due for an update
 	MaxVolume              = 100
 	MinVolume              = 0
 	MaxBrightness          = 100
 	MinBrightness          = 0
 	MaxRetryAttempts       = 1
+	DefaultProfileName     = "default" // the active profile when no profile matches
+	PayloadUnknown         = "None"    // Home Assistant sets a sensor to unknown on this payload
+	BrokerCheckTimeout     = 5 * time.Second
+	AirPortInfoInterval    = 60 * time.Second // how often the slow Wi-Fi signal and link rate lookup runs
+	AirPortInfoWaitTimeout = 15 * time.Second // how long startup waits for the SSID when profiles match on it
+
+	DefaultSwitchAudioSourcePath = "/opt/homebrew/bin/switchaudiosource"
+	DefaultAudioControlURL       = "http://localhost:55777"
+	AudioControlTimeout          = 3 * time.Second
+	VolumeFadeInterval           = 500 * time.Millisecond // time between volume changes of a fade
+	VolumeUpdateInterval         = 10 * time.Second       // volume and audio devices, a new output device gets its volume back this quickly
+	MaxVolumeFadeDuration        = 2 * time.Hour
+	DefaultInputVolume           = 50 // input volume set by unmuting an input at 0 when the volume before muting is unknown
+
+	BatteryConditionInterval = time.Hour       // how often the battery condition is read from system_profiler
+	DefaultDiskFullThreshold = 90              // used disk percentage at which a disk is almost full
+	DefaultTopProcesses      = 5               // number of processes in the top processes sensor
+	AppCommandRefreshDelay   = 2 * time.Second // time for an app to launch or quit before the running apps are published
+	BluetoothRefreshDelay    = 5 * time.Second // time for a Bluetooth device to connect or disconnect before it is published
+)
+
+// Media stream supervision settings
+const (
+	MediaStreamInitialBackoff = 2 * time.Second
+	MediaStreamMaxBackoff     = 5 * time.Minute
+	MediaStreamStableRun      = 2 * time.Minute  // a run this long resets the backoff
+	MediaStreamMaxFailures    = 5                // consecutive failures before falling back to polling
+	MediaStreamCheckInterval  = 60 * time.Second // how often to check for a stalled stream
+	MediaPollInterval         = 15 * time.Second // getMediaInfo interval while polling
+	MediaProgressInterval     = 60 * time.Second // progress and time remaining republish interval while playing
+	TrackPlayedCheckInterval  = 5 * time.Second  // how often the listened time is checked against scrobble_threshold
+	MediaPauseCheckInterval   = 60 * time.Second // how often to check if a paused stream can be resumed
+	MediaAppStateTimeout      = 2 * time.Minute  // an app that reported nothing since is no longer considered playing
+	DefaultScrobbleThreshold  = 30               // seconds listened before a track counts as played
+)
+
+// User activity monitoring settings
+const (
+	ActivityPollInterval    = 1 * time.Second // idle time poll interval while the user is inactive
+	IdleErrorRetryInterval  = 5 * time.Second
+	DefaultIdleTimeInterval = 60  // seconds between idle_time_seconds updates
+	DefaultIdleActivityTime = 10  // seconds without input before the user is idle
+	DefaultIdleAwayTime     = 300 // seconds without input before the user is away
+	ScreenLockCheckInterval = 5 * time.Second
+	FrontmostCheckInterval  = 5 * time.Second
+	MaxStateLength          = 255 // Home Assistant rejects longer states
+)
+
+// Public IP lookup settings
+const (
+	DefaultPublicIPTTL     = 300 // seconds a public IP is cached
+	PublicIPLookupTimeout  = 10 * time.Second
+	PublicIPDialTimeout    = 5 * time.Second
+	DefaultDNSServer       = "ns1.google.com:53"
+	DefaultDNSName         = "o-o.myaddr.l.google.com"
+	DefaultHTTPSURL        = "https://api64.ipify.org"
+	DefaultSTUNServer      = "stun.l.google.com:19302"
+	stunMagicCookie        = 0x2112A442
+	ssdpAddress            = "239.255.255.250:1900"
+	upnpGatewayDeviceType  = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+	maxPublicIPResponseLen = 64 * 1024
+)
+
+// Probe settings
+const (
+	DefaultProbeInterval = 60 // seconds between probes
+	DefaultProbeTimeout  = 5  // seconds to wait for each attempt
+	DefaultProbeCount    = 3  // attempts, or ping packets, per probe
+)
+
+// Power policies
+const (
+	PowerPolicyNormal   = "normal"
+	PowerPolicyBattery  = "battery"
+	PowerPolicyLowPower = "low_power"
+
+	PowerPolicyCheckInterval  = 30 * time.Second
+	DefaultBatteryMultiplier  = 2
+	DefaultLowPowerMultiplier = 4
+)
+
+// Power event monitoring settings
+const (
+	PowerEventCheckInterval = 10 * time.Second
+	SleepDetectionSlack     = 20 * time.Second // extra wall clock time between checks that indicates a sleep
+	WakeReconnectTimeout    = 60 * time.Second // how long to wait for MQTT to reconnect after a wake
+	PowerLogTailLines       = 500              // pmset log lines to read for the last wake at startup
+	PowerEventRestartDelay  = 30 * time.Second // time before the power event stream is started again after it failed
+	WakeRefreshDebounce     = 30 * time.Second // a wake seen in the log stream and from the clock is refreshed once
+)
+
+// Presence states, from most to least present
+const (
+	PresenceActive = "active"
+	PresenceIdle   = "idle"
+	PresenceAway   = "away"
+	PresenceLocked = "locked"
+	PresenceAsleep = "asleep"
 )
 
 // BetterDisplayCLIError represents an error when BetterDisplay CLI is not available
@@ -85,6 +196,37 @@ type MediaInfo struct {
 	State       string `json:"state"`    // "playing", "paused", "stopped"
 	Duration    int    `json:"duration"` // in seconds
 	Position    int    `json:"position"` // in seconds
+
+	PositionUpdatedAt time.Time `json:"position_updated_at"` // when Position was last reported
+}
+
+// livePosition returns the position interpolated from the last reported position
+// and the wall-clock time since, capped at the duration when it is known
+func (m MediaInfo) livePosition(now time.Time) int {
+	position := m.Position
+	if m.State == "playing" && !m.PositionUpdatedAt.IsZero() {
+		position += int(now.Sub(m.PositionUpdatedAt).Seconds())
+	}
+	if m.Duration > 0 && position > m.Duration {
+		position = m.Duration
+	}
+	return position
+}
+
+// progressPercent returns how much of the media has been played, from 0 to 100
+func (m MediaInfo) progressPercent(now time.Time) float64 {
+	if m.Duration <= 0 {
+		return 0
+	}
+	return float64(m.livePosition(now)) / float64(m.Duration) * 100
+}
+
+// timeRemaining returns the seconds left until the media ends
+func (m MediaInfo) timeRemaining(now time.Time) int {
+	if m.Duration <= 0 {
+		return 0
+	}
+	return m.Duration - m.livePosition(now)
 }
 
 // Display represents the the display information
@@ -107,17 +249,88 @@ type Display struct {
 
 // Application holds the main application state
 type Application struct {
-	config            *config
-	displays          []Display
-	hostname          string
-	topic             string
-	client            mqtt.Client
-	currentMediaState MediaInfo // persistent media state for streaming
-	userActivityState string    // "active" or "inactive"
-	activityMutex     sync.RWMutex
-	activityTimer     *time.Timer
-	lastCPU           sigar.Cpu // for CPU percentage calculation
-	cpuMutex          sync.RWMutex
+	config             *config // the broker, topic, sensors, commands and public_ip fields change with the profile, read them under profileMutex
+	displays           []Display
+	hostname           string
+	topic              string
+	client             mqtt.Client
+	currentMediaState  MediaInfo                // media state shown on the now playing sensor
+	streamMediaState   MediaInfo                // raw media state as reported by media-control
+	mediaAppStates     map[string]mediaAppState // last known media state per lowercased bundle ID
+	mediaMutex         sync.RWMutex
+	mediaStreamOnce    sync.Once
+	mediaStreamHealth  string        // "running", "restarting", "stalled", "polling", "paused" or "stopped"
+	mediaStreamCmd     *exec.Cmd     // the running media-control stream process
+	lastMediaEvent     time.Time     // last line received from the media stream
+	trackSession       *trackSession // listening session of the current track
+	userActivityState  string        // "active" or "inactive"
+	activityMutex      sync.RWMutex
+	presenceState      string        // one of the Presence* states
+	presenceChangedAt  time.Time     // when presenceState last changed
+	previousPresence   string        // presence state before the last transition
+	lastIdleTime       time.Duration // last idle time read by the activity monitor
+	screenLocked       bool
+	systemAsleep       bool
+	lastWake           time.Time // when the system last woke up
+	activityOnce       sync.Once
+	idleProvider       IdleTimeProvider
+	screenLockOnce     sync.Once
+	screenLockProvider ScreenLockProvider
+	frontmostApp       FrontmostApp // the focused application, guarded by activityMutex
+	frontmostOnce      sync.Once
+	frontmostProvider  FrontmostAppProvider
+	powerEventOnce     sync.Once
+	powerEventProvider PowerEventProvider
+	powerMutex         sync.RWMutex
+	powerPolicy        string // one of the PowerPolicy* policies
+	powerPolicyOnce    sync.Once
+	networkMutex       sync.RWMutex
+	networkInfo        *NetworkInfo  // last network state, nil until the first update
+	airPortInfo        AirPortInfo   // last Wi-Fi details from system_profiler, guarded by networkMutex
+	airPortDone        chan struct{} // closed when the running system_profiler lookup finishes, nil when none runs
+	diskMutex          sync.RWMutex
+	volumes            map[string]string // monitored mount points by topic key
+	removedVolumes     []string          // keys of ejected volumes whose discovery entries must be removed
+	lastCPU            sigar.Cpu         // for CPU percentage calculation
+	lastCPUList        []sigar.Cpu       // for per-core percentage calculation
+	ioMutex            sync.Mutex
+	lastNetIO          map[string]psnet.IOCountersStat // for network throughput calculation
+	lastNetIOTime      time.Time
+	lastDiskIO         map[string]disk.IOCountersStat // for disk throughput calculation
+	lastDiskIOTime     time.Time
+	processMutex       sync.Mutex
+	lastProcessTimes   map[int32]float64 // CPU seconds per PID, for process CPU percentage calculation
+	lastProcessTime    time.Time
+	watchedProcesses   map[string]bool // whether each watchlist process was running at the last update
+	audioControl       *AudioControlClient
+	audioMutex         sync.Mutex
+	audioDevices       map[string][]string // device names by type (input or output), the options of the device selects
+	inputVolumeMuted   int                 // input volume before the input was muted
+	outputDevice       string              // output device at the last update
+	deviceVolumes      map[string]int      // last volume by output device, restored when switching back to it
+	volumeFadeCancel   context.CancelFunc  // stops the running volume fade
+	bluetoothMutex     sync.RWMutex
+	bluetoothDevices   map[string]BluetoothDevice // published Bluetooth devices by topic key
+	removedBluetooth   []string                   // keys of unpaired devices whose discovery entries must be removed
+	bluetoothUpdating  bool                       // a system_profiler lookup of the Bluetooth devices is running
+
+	batteryMutex              sync.Mutex
+	batteryPresent            bool      // whether the last pmset update found a battery
+	batteryCondition          string    // condition from system_profiler, empty until the first lookup
+	batteryConditionUpdatedAt time.Time // time of the last condition lookup
+	batteryConditionUpdating  bool      // a system_profiler lookup of the condition is running
+	profileMutex              sync.RWMutex
+	baseConfig                config              // the configuration before the active profile's overrides
+	profile                   string              // name of the active profile
+	profileReconnect          bool                // a profile switch changed the broker and the new client isn't connected yet
+	profileSelecting          bool                // a background profile selection is running, guarded by profileMutex
+	profileSelection          chan *profileConfig // profiles selected in the background, applied by the main loop
+	publicIPMutex             sync.Mutex
+	publicIPCache             map[string]publicIPEntry // last public IP by address family
+	probeOnce                 sync.Once
+	probeMutex                sync.RWMutex
+	probeResults              map[string]ProbeResult // last result by probe name
+	cpuMutex                  sync.RWMutex
 }
 
 type config struct {
@@ -129,7 +342,97 @@ type config struct {
 	Hostname         string `yaml:"hostname"`
 	Topic            string `yaml:"mqtt_topic"`
 	DiscoveryPrefix  string `yaml:"discovery_prefix"`
-	IdleActivityTime int    `yaml:"idle_activity_time"` // in seconds
+	IdleActivityTime int    `yaml:"idle_activity_time"` // in seconds, active -> idle
+	IdleAwayTime     int    `yaml:"idle_away_time"`     // in seconds, idle -> away
+	IdleTimeInterval int    `yaml:"idle_time_interval"` // in seconds, how often idle_time_seconds is published
+
+	FrontmostWindowTitle bool `yaml:"frontmost_window_title"` // also publish the title of the focused window
+
+	SwitchAudioSourcePath string `yaml:"switchaudiosource_path"` // used to list and switch audio devices
+	AudioControlURL       string `yaml:"audio_control_url"`      // audio control API for devices without a system volume
+
+	MediaIgnoreApps []string `yaml:"media_ignore_apps"` // bundle IDs whose media is ignored
+	MediaPreferApps []string `yaml:"media_prefer_apps"` // bundle IDs that take priority, most preferred first
+	MediaAppSensors []string `yaml:"media_app_sensors"` // bundle IDs that get their own now playing sensor
+
+	ScrobbleThreshold *int   `yaml:"scrobble_threshold"` // seconds a track must be listened to before it counts as played, 0 counts every track
+	ScrobbleLogFile   string `yaml:"scrobble_log_file"`  // optional JSONL file to append played tracks to
+
+	PowerPolicy powerPolicyConfig `yaml:"power_policy"`
+
+	DiskVolumes       []string `yaml:"disk_volumes"`        // extra mount points to monitor
+	DiskAutoDiscover  bool     `yaml:"disk_auto_discover"`  // monitor every volume mounted under /Volumes
+	DiskFullThreshold int      `yaml:"disk_full_threshold"` // used percentage at which a disk is almost full
+
+	NetworkInterfaces []string `yaml:"network_interfaces"` // interfaces to publish throughput for, en* by default
+	DiskIODevices     []string `yaml:"disk_io_devices"`    // disks to publish throughput for, all by default
+
+	TopProcesses     int      `yaml:"top_processes"`     // number of processes in the top processes sensor
+	ProcessWatchlist []string `yaml:"process_watchlist"` // process names with their own sensors and started/stopped events
+
+	AppAllowlist []string `yaml:"app_allowlist"` // app names or bundle IDs that command/app may control
+	AppSwitches  []string `yaml:"app_switches"`  // app names or bundle IDs with a running switch in Home Assistant
+
+	BluetoothDevices []string `yaml:"bluetooth_devices"` // names or addresses of paired devices to publish, all by default
+
+	PublicIP publicIPConfig `yaml:"public_ip"`
+	Probes   []probeConfig  `yaml:"probes"` // latency and connectivity probes
+
+	Sensors  []string        `yaml:"sensors"`  // sensor groups to publish, all when empty
+	Commands []string        `yaml:"commands"` // commands to accept, all when empty
+	Profiles []profileConfig `yaml:"profiles"` // network location profiles, the first matching one is active
+}
+
+// publicIPConfig configures how the public IP is looked up
+type publicIPConfig struct {
+	Resolvers []publicIPResolverConfig `yaml:"resolvers"` // tried in order, dns, https and stun by default
+	TTL       int                      `yaml:"ttl"`       // seconds a public IP is cached
+	IPv6      bool                     `yaml:"ipv6"`      // also look up the public IPv6 address
+}
+
+// publicIPResolverConfig configures one public IP resolver
+type publicIPResolverConfig struct {
+	Type   string `yaml:"type"`   // dns, https, stun or upnp
+	Server string `yaml:"server"` // DNS or STUN server as host:port, HTTPS URL, or UPnP device description URL
+	Name   string `yaml:"name"`   // TXT record name for dns
+}
+
+// probeConfig configures a latency and connectivity probe
+type probeConfig struct {
+	Name     string `yaml:"name"`
+	Type     string `yaml:"type"`     // ping, tcp or http
+	Target   string `yaml:"target"`   // host for ping, host:port for tcp, URL for http
+	Interval int    `yaml:"interval"` // seconds between probes
+	Timeout  int    `yaml:"timeout"`  // seconds to wait for each attempt
+	Count    int    `yaml:"count"`    // attempts, or ping packets, per probe
+}
+
+// profileConfig overrides the broker, topic, sensors and commands on a network location.
+// A profile without SSIDs, gateway MACs and broker_reachable always matches.
+type profileConfig struct {
+	Name            string   `yaml:"name"`
+	SSIDs           []string `yaml:"ssids"`            // match on one of these Wi-Fi networks
+	GatewayMACs     []string `yaml:"gateway_macs"`     // match when the default gateway has one of these MAC addresses
+	BrokerReachable bool     `yaml:"broker_reachable"` // match when the profile's broker accepts connections
+
+	IP       string   `yaml:"mqtt_ip"`
+	Port     string   `yaml:"mqtt_port"`
+	User     string   `yaml:"mqtt_user"`
+	Password string   `yaml:"mqtt_password"`
+	SSL      *bool    `yaml:"mqtt_ssl"`
+	Topic    string   `yaml:"mqtt_topic"`
+	Sensors  []string `yaml:"sensors"`
+	Commands []string `yaml:"commands"`
+
+	PublicIP *publicIPConfig `yaml:"public_ip"`
+}
+
+// powerPolicyConfig configures how much sensor intervals are stretched on battery and in Low Power Mode
+type powerPolicyConfig struct {
+	BatteryMultiplier  float64            `yaml:"battery_multiplier"`   // interval multiplier on battery
+	LowPowerMultiplier float64            `yaml:"low_power_multiplier"` // interval multiplier in Low Power Mode
+	PauseMediaStream   bool               `yaml:"pause_media_stream"`   // stop the media-control stream unless on AC
+	Sensors            map[string]float64 `yaml:"sensors"`              // per sensor multiplier overrides
 }
 
 func (c *config) getConfig() *config {
@@ -156,8 +459,16 @@ func (c *config) getConfig() *config {
 	}
 
 	if c.IdleActivityTime == 0 {
-		log.Println("No idle_activity_time specified in config, using default 10 seconds")
+		log.Printf("No idle_activity_time specified in config, using default %d seconds", DefaultIdleActivityTime)
+		c.IdleActivityTime = DefaultIdleActivityTime
+	}
 
+	if c.IdleAwayTime == 0 {
+		c.IdleAwayTime = DefaultIdleAwayTime
+	}
+	if c.IdleAwayTime < c.IdleActivityTime {
+		log.Printf("idle_away_time (%d) is shorter than idle_activity_time (%d), using %d seconds", c.IdleAwayTime, c.IdleActivityTime, c.IdleActivityTime)
+		c.IdleAwayTime = c.IdleActivityTime
 	}
 
 	if c.Port == "" {
@@ -170,6 +481,31 @@ func (c *config) getConfig() *config {
 	if c.DiscoveryPrefix == "" {
 		c.DiscoveryPrefix = "homeassistant"
 	}
+	if c.IdleTimeInterval == 0 {
+		c.IdleTimeInterval = DefaultIdleTimeInterval
+	}
+	if c.ScrobbleThreshold == nil {
+		threshold := DefaultScrobbleThreshold
+		c.ScrobbleThreshold = &threshold
+	}
+	if c.DiskFullThreshold == 0 {
+		c.DiskFullThreshold = DefaultDiskFullThreshold
+	}
+	if c.TopProcesses == 0 {
+		c.TopProcesses = DefaultTopProcesses
+	}
+	if c.SwitchAudioSourcePath == "" {
+		c.SwitchAudioSourcePath = DefaultSwitchAudioSourcePath
+	}
+	if c.AudioControlURL == "" {
+		c.AudioControlURL = DefaultAudioControlURL
+	}
+	if c.PowerPolicy.BatteryMultiplier == 0 {
+		c.PowerPolicy.BatteryMultiplier = DefaultBatteryMultiplier
+	}
+	if c.PowerPolicy.LowPowerMultiplier == 0 {
+		c.PowerPolicy.LowPowerMultiplier = DefaultLowPowerMultiplier
+	}
 	return c
 }
 
@@ -188,13 +524,15 @@ func NewApplication() (*Application, error) {
 		app.hostname = app.config.Hostname
 	}
 
-	// Set topic - append hostname to allow multiple instances
-	if app.config.Topic == "" {
-		app.topic = DefaultTopicPrefix + "/" + app.hostname
-	} else {
-		// Append hostname to the configured topic
-		app.topic = app.config.Topic + "/" + app.hostname
+	// Select the profile of the current network location, this also sets the topic
+	app.baseConfig = *app.config
+	app.profileSelection = make(chan *profileConfig, 1)
+	if len(app.config.Profiles) > 0 {
+		app.updateNetworkInfo(nil)
+		// Profiles can match on the SSID, which may only be known from system_profiler
+		app.waitForAirPortInfo(AirPortInfoWaitTimeout)
 	}
+	app.applyProfile(app.selectProfile(app.getNetworkInfoSnapshot()))
 
 	// Validate configuration
 	if err := app.validateConfig(); err != nil {
@@ -205,24 +543,57 @@ func NewApplication() (*Application, error) {
 	app.displays = getDisplays()
 
 	// Initialize currentMediaState
+	app.mediaAppStates = make(map[string]mediaAppState)
 	if isMediaControlAvailable() {
 		mediaInfo, err := getMediaInfo()
 		if err == nil && mediaInfo != nil {
-			app.currentMediaState = *mediaInfo
+			app.streamMediaState = *mediaInfo
+			app.currentMediaState = MediaInfo{State: "idle"}
+			app.applyMediaFilter(*mediaInfo, time.Now())
 		} else {
+			app.streamMediaState = MediaInfo{State: "idle"}
 			app.currentMediaState = MediaInfo{State: "idle"}
 		}
 	} else {
+		app.streamMediaState = MediaInfo{State: "idle"}
 		app.currentMediaState = MediaInfo{State: "idle"}
 	}
 
 	// Initialize user activity state
 	app.userActivityState = "inactive"
+	app.idleProvider = newIdleTimeProvider()
+	app.screenLockProvider = &ioregScreenLockProvider{}
+	app.frontmostProvider = &lsappinfoFrontmostAppProvider{windowTitle: app.config.FrontmostWindowTitle}
+	app.powerEventProvider = &pmsetPowerEventProvider{}
+	app.powerPolicy = PowerPolicyNormal
+	app.audioControl = NewAudioControlClient(app.config.AudioControlURL, AudioControlTimeout)
+
+	// Initialize the monitored volumes
+	app.volumes = make(map[string]string)
+	app.updateVolumes()
 
 	// Initialize CPU stats for percentage calculation
 	if err := app.lastCPU.Get(); err != nil {
 		log.Printf("Warning: Failed to initialize CPU stats: %v", err)
 	}
+	cores := sigar.CpuList{}
+	if err := cores.Get(); err != nil {
+		log.Printf("Warning: Failed to initialize per-core CPU stats: %v", err)
+	}
+	app.lastCPUList = cores.List
+
+	// Initialize network and disk counters for throughput calculation
+	if _, err := app.getNetworkRates(); err != nil {
+		log.Printf("Warning: Failed to initialize network counters: %v", err)
+	}
+	if _, err := app.getDiskRates(); err != nil {
+		log.Printf("Warning: Failed to initialize disk counters: %v", err)
+	}
+
+	// Initialize process CPU times for percentage calculation
+	if _, err := app.getProcesses(); err != nil {
+		log.Printf("Warning: Failed to initialize process stats: %v", err)
+	}
 
 	return app, nil
 }
@@ -238,11 +609,55 @@ func (app *Application) validateConfig() error {
 	if app.config.DiscoveryPrefix == "" {
 		app.config.DiscoveryPrefix = DefaultDiscoveryPrefix
 	}
+	if err := validateSensorGroups(app.baseConfig.Sensors); err != nil {
+		return err
+	}
+	if _, err := newPublicIPResolvers(app.baseConfig.PublicIP); err != nil {
+		return err
+	}
+	if err := validateProbes(app.config.Probes); err != nil {
+		return err
+	}
+	if app.config.ScrobbleThreshold != nil && *app.config.ScrobbleThreshold < 0 {
+		return fmt.Errorf("scrobble_threshold must not be negative, got %d", *app.config.ScrobbleThreshold)
+	}
+	for _, profile := range app.baseConfig.Profiles {
+		if profile.Name == "" {
+			return fmt.Errorf("every profile needs a name")
+		}
+		if err := validateSensorGroups(profile.Sensors); err != nil {
+			return fmt.Errorf("profile %s: %w", profile.Name, err)
+		}
+		if profile.PublicIP != nil {
+			if _, err := newPublicIPResolvers(*profile.PublicIP); err != nil {
+				return fmt.Errorf("profile %s: %w", profile.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validateSensorGroups checks that every name in a sensors list is a known sensor group
+func validateSensorGroups(names []string) error {
+	for _, name := range names {
+		known := false
+		for _, group := range sensorGroups {
+			if group.name == name {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown sensor group %q", name)
+		}
+	}
 	return nil
 }
 
 // getTopicPrefix returns the topic prefix for this application
 func (app *Application) getTopicPrefix() string {
+	app.profileMutex.RLock()
+	defer app.profileMutex.RUnlock()
 	return app.topic
 }
 
@@ -335,7 +750,7 @@ func getCaffeinateStatus() bool {
 	return stdoutStr != ""
 }
 
-func getMuteStatus() bool {
+func (app *Application) getMuteStatus() bool {
 	log.Println("Getting mute status")
 	output := getCommandOutput("/usr/bin/osascript", "-e", "output muted of (get volume settings)")
 	b, err := strconv.ParseBool(output)
@@ -344,70 +759,37 @@ func getMuteStatus() bool {
 		// Continue to fallback method
 	}
 	if output == "missing value" {
-		currentsource := getCommandOutput("/opt/homebrew/bin/switchaudiosource", "-c")
-		var resp *http.Response
-		var err error
-
-		// URL encode the current source name to handle spaces and special characters
-		encodedSource := strings.ReplaceAll(currentsource, " ", "%20")
-		url := fmt.Sprintf("http://localhost:55777/get?name=%s&mute", encodedSource)
-		resp, err = http.Get(url)
+		currentsource, err := app.getCurrentAudioDevice("output")
 		if err != nil {
-			log.Printf("Error getting mute status for %s: %v", currentsource, err)
+			log.Printf("Error getting current output device: %v", err)
 			return false
 		}
-		if resp != nil {
-			defer resp.Body.Close()
-			output, err := io.ReadAll(resp.Body)
-			if err != nil {
-				log.Printf("Error getting mute status body for %s: %v", currentsource, err)
-				return false
-			}
-			output = []byte(strings.TrimSuffix(string(output), "\n"))
-			mute := string(output)
-			log.Println("Mute Output: " + mute)
-			b = mute == "on"
+		b, err = app.audioControl.GetMute(currentsource)
+		if err != nil {
+			log.Printf("Error getting mute status for %s: %v", currentsource, err)
+			return false
 		}
 	}
 	return b
 }
 
-func getCurrentVolume() int {
+func (app *Application) getCurrentVolume() (int, error) {
 	log.Println("Getting volume status")
 	output := getCommandOutput("/usr/bin/osascript", "-e", "output volume of (get volume settings)")
 	output = strings.TrimSuffix(output, "\n")
 	i, err := strconv.Atoi(output)
 	if err != nil {
-		currentsource := getCommandOutput("/opt/homebrew/bin/switchaudiosource", "-c")
-		var resp *http.Response
-		var err error
-		// URL encode the current source name to handle spaces and special characters
-		encodedSource := strings.ReplaceAll(currentsource, " ", "%20")
-		url := fmt.Sprintf("http://localhost:55777/get?name=%s&volume", encodedSource)
-		resp, err = http.Get(url)
+		currentsource, err := app.getCurrentAudioDevice("output")
 		if err != nil {
-			log.Printf("Error getting volume status for %s: %v", currentsource, err)
-			return 0
+			return 0, fmt.Errorf("error getting current output device: %w", err)
 		}
-		if resp != nil {
-			defer resp.Body.Close()
-			output, err := io.ReadAll(resp.Body)
-			if err != nil {
-				log.Printf("Error getting volume status body for %s: %v", currentsource, err)
-				return 0
-			}
-			output = []byte(strings.TrimSuffix(string(output), "\n"))
-			outputStr := string(output)
-			log.Println("Vol Output: " + outputStr)
-			f, err := strconv.ParseFloat(outputStr, 64)
-			if err != nil {
-				log.Printf("Error parsing volume value for %s: %v", currentsource, err)
-				return 0
-			}
-			i = int(f * 100)
+		f, err := app.audioControl.GetVolume(currentsource)
+		if err != nil {
+			return 0, fmt.Errorf("error getting volume status for %s: %w", currentsource, err)
 		}
+		i = int(math.Round(f * 100))
 	}
-	return i
+	return i, nil
 }
 
 func runCommand(name string, arg ...string) {
@@ -420,20 +802,18 @@ func runCommand(name string, arg ...string) {
 }
 
 // from 0 to 100
-func setVolume(i int) {
+func (app *Application) setVolume(i int) {
 	//Test first if we can control the mute if not use betterdisplaycli
 	test := getCommandOutput("/usr/bin/osascript", "-e", "output volume of (get volume settings)")
 	if test == "missing value" {
 		volumef := float64(i) / 100
-		currentsource := getCommandOutput("/opt/homebrew/bin/switchaudiosource", "-c")
-		// URL encode the current source name to handle spaces and special characters
-		encodedSource := strings.ReplaceAll(currentsource, " ", "%20")
-		url := fmt.Sprintf("http://localhost:55777/set?name=%s&volume=%f", encodedSource, volumef)
-		resp, err := http.Get(url)
+		currentsource, err := app.getCurrentAudioDevice("output")
 		if err != nil {
+			log.Printf("Error getting current output device: %v", err)
+			return
+		}
+		if err := app.audioControl.SetVolume(currentsource, volumef); err != nil {
 			log.Printf("Error setting volume for %s: %v", currentsource, err)
-		} else if resp != nil {
-			resp.Body.Close()
 		}
 	} else {
 		runCommand("/usr/bin/osascript", "-e", "set volume output volume "+strconv.Itoa(i))
@@ -442,23 +822,17 @@ func setVolume(i int) {
 
 // true - turn mute on
 // false - turn mute off
-func setMute(b bool) {
+func (app *Application) setMute(b bool) {
 	//Test first if we can control the mute if not use betterdisplaycli
 	test := getCommandOutput("/usr/bin/osascript", "-e", "output volume of (get volume settings)")
 	if test == "missing value" {
-		state := "off"
-		if b {
-			state = "on"
-		}
-		currentsource := getCommandOutput("/opt/homebrew/bin/switchaudiosource", "-c")
-		// URL encode the current source name to handle spaces and special characters
-		encodedSource := strings.ReplaceAll(currentsource, " ", "%20")
-		url := fmt.Sprintf("http://localhost:55777/set?name=%s&mute=%s", encodedSource, state)
-		resp, err := http.Get(url)
+		currentsource, err := app.getCurrentAudioDevice("output")
 		if err != nil {
+			log.Printf("Error getting current output device: %v", err)
+			return
+		}
+		if err := app.audioControl.SetMute(currentsource, b); err != nil {
 			log.Printf("Error setting mute for %s: %v", currentsource, err)
-		} else if resp != nil {
-			resp.Body.Close()
 		}
 	} else {
 		runCommand("/usr/bin/osascript", "-e", "set volume output muted "+strconv.FormatBool(b))
@@ -466,6 +840,194 @@ func setMute(b bool) {
 
 }
 
+// AudioControlClient is a client for the audio control HTTP API, which controls the volume
+// of output devices that macOS can't control, like HDMI and USB audio devices
+type AudioControlClient struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewAudioControlClient creates a client for the audio control API at baseURL, e.g. http://localhost:55777
+func NewAudioControlClient(baseURL string, timeout time.Duration) *AudioControlClient {
+	return &AudioControlClient{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: &http.Client{Timeout: timeout},
+	}
+}
+
+// GetVolume returns the volume of the device from 0 to 1
+func (c *AudioControlClient) GetVolume(device string) (float64, error) {
+	body, err := c.request("get", device, "volume")
+	if err != nil {
+		return 0, err
+	}
+	volume, err := strconv.ParseFloat(body, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid volume %q: %w", body, err)
+	}
+	return volume, nil
+}
+
+// SetVolume sets the volume of the device from 0 to 1
+func (c *AudioControlClient) SetVolume(device string, volume float64) error {
+	_, err := c.request("set", device, "volume="+strconv.FormatFloat(volume, 'f', 6, 64))
+	return err
+}
+
+// GetMute reports whether the device is muted
+func (c *AudioControlClient) GetMute(device string) (bool, error) {
+	body, err := c.request("get", device, "mute")
+	if err != nil {
+		return false, err
+	}
+	switch body {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid mute state %q", body)
+	}
+}
+
+// SetMute mutes or unmutes the device
+func (c *AudioControlClient) SetMute(device string, mute bool) error {
+	state := "off"
+	if mute {
+		state = "on"
+	}
+	_, err := c.request("set", device, "mute="+state)
+	return err
+}
+
+// request calls an endpoint (get or set) for a device and returns the trimmed response body.
+// The API expects spaces in device names as %20, and a bare parameter name to get a value.
+func (c *AudioControlClient) request(endpoint, device, parameter string) (string, error) {
+	name := strings.ReplaceAll(url.QueryEscape(device), "+", "%20")
+	target := c.baseURL + "/" + endpoint + "?name=" + name + "&" + parameter
+
+	resp, err := c.httpClient.Get(target)
+	if err != nil {
+		return "", fmt.Errorf("audio control request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return "", fmt.Errorf("error reading audio control response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("audio control API returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// AudioDevice is an audio input or output device as listed by switchaudiosource
+type AudioDevice struct {
+	Name string `json:"name"`
+	Type string `json:"type"` // input or output
+	ID   string `json:"id"`
+	UID  string `json:"uid"`
+}
+
+// getCurrentAudioDevice returns the name of the current input or output device
+func (app *Application) getCurrentAudioDevice(deviceType string) (string, error) {
+	output, err := exec.Command(app.config.SwitchAudioSourcePath, "-c", "-t", deviceType).Output()
+	if err != nil {
+		return "", fmt.Errorf("error running %s: %w", app.config.SwitchAudioSourcePath, err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// getAudioDevices returns the input or output devices
+func (app *Application) getAudioDevices(deviceType string) ([]AudioDevice, error) {
+	output, err := exec.Command(app.config.SwitchAudioSourcePath, "-a", "-t", deviceType, "-f", "json").Output()
+	if err != nil {
+		return nil, fmt.Errorf("error running %s: %w", app.config.SwitchAudioSourcePath, err)
+	}
+	return parseAudioDevices(string(output), deviceType), nil
+}
+
+// parseAudioDevices parses the devices listed by switchaudiosource -a -f json, one JSON object per line.
+// Versions without JSON output list one device per line as "NAME (TYPE)".
+func parseAudioDevices(output, deviceType string) []AudioDevice {
+	var devices []AudioDevice
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		var device AudioDevice
+		if err := json.Unmarshal([]byte(line), &device); err != nil {
+			device = AudioDevice{Name: strings.TrimSuffix(line, " ("+deviceType+")"), Type: deviceType}
+		}
+		if device.Name != "" && device.Type == deviceType {
+			devices = append(devices, device)
+		}
+	}
+	return devices
+}
+
+// setAudioDevice switches the current input or output device
+func (app *Application) setAudioDevice(deviceType, name string) error {
+	output, err := exec.Command(app.config.SwitchAudioSourcePath, "-t", deviceType, "-s", name).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error switching %s device to %s: %w: %s", deviceType, name, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// getInputVolume returns the input volume from 0 to 100
+func getInputVolume() (int, error) {
+	output, err := exec.Command("/usr/bin/osascript", "-e", "input volume of (get volume settings)").Output()
+	if err != nil {
+		return 0, fmt.Errorf("error getting input volume: %w", err)
+	}
+	volume, err := strconv.Atoi(strings.TrimSpace(string(output)))
+	if err != nil {
+		return 0, fmt.Errorf("input device has no volume: %s", strings.TrimSpace(string(output)))
+	}
+	return volume, nil
+}
+
+// setInputVolume sets the input volume from 0 to 100
+func setInputVolume(volume int) error {
+	return exec.Command("/usr/bin/osascript", "-e", "set volume input volume "+strconv.Itoa(volume)).Run()
+}
+
+// setInputMute mutes the input by setting its volume to 0, unmuting restores the volume from before.
+// An input that was not muted by mac2mqtt keeps its volume unless it is at 0.
+func (app *Application) setInputMute(mute bool) error {
+	app.audioMutex.Lock()
+	defer app.audioMutex.Unlock()
+
+	if !mute {
+		volume := app.inputVolumeMuted
+		app.inputVolumeMuted = 0
+		if volume == 0 {
+			current, err := getInputVolume()
+			if err != nil {
+				return err
+			}
+			if current > 0 {
+				return nil
+			}
+			volume = DefaultInputVolume
+		}
+		return setInputVolume(volume)
+	}
+
+	volume, err := getInputVolume()
+	if err != nil {
+		return err
+	}
+	if volume > 0 {
+		app.inputVolumeMuted = volume
+	}
+	return setInputVolume(0)
+}
+
 func commandSleep() {
 	runCommand("pmset", "sleepnow")
 }
@@ -514,82 +1076,336 @@ func commandScreensaver() {
 	runCommand("open", "-a", "ScreenSaverEngine")
 }
 
-func commandPlayPause() {
-	runCommand("media-control", "toggle-play-pause")
+// commandLockScreen locks the screen with the Control-Command-Q shortcut.
+// System Events needs the Accessibility permission to send the keystroke.
+func commandLockScreen() {
+	script := "tell application \"System Events\" to keystroke \"q\" using {control down, command down}"
+	if err := exec.Command("/usr/bin/osascript", "-e", script).Run(); err != nil {
+		log.Printf("Error locking screen: %v", err)
+		log.Println("Make sure mac2mqtt is allowed to control System Events in Privacy & Security > Accessibility")
+	}
 }
 
-// getDisplays retrieves all available displays using BetterDisplay CLI
-func getDisplays() []Display {
+// AppTarget identifies an application by name or by bundle ID
+type AppTarget struct {
+	Name     string `json:"app"`
+	BundleID string `json:"bundle_id"`
+}
 
-	// Check if BetterDisplay CLI is available
-	if !isBetterDisplayCLIAvailable() {
-		log.Println("BetterDisplay CLI is not installed or not accessible")
-		log.Println("To install BetterDisplay CLI:")
-		log.Println("  1. Install BetterDisplay from https://github.com/waydabber/BetterDisplay")
-		log.Println("  2. Enable CLI access in BetterDisplay preferences")
-		log.Println("  3. Restart the application")
-		log.Println("Display brightness controls will be disabled until BetterDisplay CLI is available")
-		return nil
+// AppCommand is the payload of command/app
+type AppCommand struct {
+	Action string `json:"action"` // open, quit, force_quit or activate
+	AppTarget
+}
+
+// RunningApp is an application with a user interface that is currently running
+type RunningApp struct {
+	Name     string `json:"name"`
+	BundleID string `json:"bundle_id"`
+	PID      int    `json:"pid"`
+}
+
+// bundleIDPattern matches bundle IDs, names with at least three dot separated parts
+var bundleIDPattern = regexp.MustCompile(`^[A-Za-z0-9-]+(\.[A-Za-z0-9-]+){2,}$`)
+
+// parseAppTarget treats an entry with at least three dot separated parts (com.apple.Safari) as a bundle ID
+// and anything else (Safari, zoom.us) as an app name
+func parseAppTarget(entry string) AppTarget {
+	if bundleIDPattern.MatchString(entry) {
+		return AppTarget{BundleID: entry}
 	}
+	return AppTarget{Name: entry}
+}
 
-	log.Println("Executing: betterdisplaycli get -identifiers")
-	out, err := exec.Command("betterdisplaycli", "get", "-identifiers").Output()
-	if err != nil {
-		log.Printf("Error getting displays: %v", err)
-		log.Println("BetterDisplay CLI is installed but failed to execute")
-		log.Println("Make sure BetterDisplay is running and CLI access is enabled")
-		return nil
+func (t AppTarget) String() string {
+	if t.BundleID != "" {
+		return t.BundleID
 	}
+	return t.Name
+}
 
-	log.Printf("BetterDisplay CLI output: %s", string(out))
+// script returns the AppleScript reference to the application
+func (t AppTarget) script() string {
+	if t.BundleID != "" {
+		return fmt.Sprintf("application id %q", t.BundleID)
+	}
+	return fmt.Sprintf("application %q", t.Name)
+}
 
-	// BetterDisplay CLI returns comma-separated JSON objects, not an array
-	// We need to wrap it in brackets to make it a valid JSON array
-	jsonStr := "[" + string(out) + "]"
+// matches reports whether a running app is the target, ignoring case
+func (t AppTarget) matches(app RunningApp) bool {
+	if t.BundleID != "" {
+		return strings.EqualFold(t.BundleID, app.BundleID)
+	}
+	return strings.EqualFold(t.Name, app.Name)
+}
 
-	var displays []Display
-	err = json.Unmarshal([]byte(jsonStr), &displays)
+// getRunningApps returns the running applications that have a user interface
+func getRunningApps() ([]RunningApp, error) {
+	script := `const procs = Application("System Events").processes.whose({backgroundOnly: false});
+JSON.stringify({names: procs.name(), bundle_ids: procs.bundleIdentifier(), pids: procs.unixId()})`
+	output, err := exec.Command("/usr/bin/osascript", "-l", "JavaScript", "-e", script).Output()
 	if err != nil {
-		log.Printf("Error parsing display JSON: %v", err)
-		log.Println("BetterDisplay CLI returned invalid JSON format")
-		return nil
+		return nil, fmt.Errorf("error listing running apps: %w", err)
 	}
-
-	return displays
+	return parseRunningApps(output)
 }
 
-// isDisplayAvailable checks if a display is currently available
-func isDisplayAvailable(displayID string) bool {
-	// Get current display list to check if display is available
-	displays := getDisplays()
-	if displays == nil {
-		return false
+// parseRunningApps parses the name, bundle ID and PID lists returned by System Events
+func parseRunningApps(output []byte) ([]RunningApp, error) {
+	var result struct {
+		Names     []string  `json:"names"`
+		BundleIDs []*string `json:"bundle_ids"` // null for apps without a bundle
+		PIDs      []int     `json:"pids"`
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return nil, fmt.Errorf("error parsing running apps: %w", err)
+	}
+	if len(result.BundleIDs) != len(result.Names) || len(result.PIDs) != len(result.Names) {
+		return nil, fmt.Errorf("running apps lists have different lengths")
 	}
 
-	for _, display := range displays {
-		if display.DisplayID == displayID {
-			return true
+	apps := make([]RunningApp, 0, len(result.Names))
+	for i, name := range result.Names {
+		app := RunningApp{Name: name, PID: result.PIDs[i]}
+		if result.BundleIDs[i] != nil {
+			app.BundleID = *result.BundleIDs[i]
 		}
+		apps = append(apps, app)
 	}
-	return false
+	sort.Slice(apps, func(i, j int) bool {
+		return strings.ToLower(apps[i].Name) < strings.ToLower(apps[j].Name)
+	})
+	return apps, nil
 }
 
-// getDisplayBrightness gets the current brightness for a specific display
-func getDisplayBrightness(displayID string) (int, error) {
-	// First check if display is available to avoid unnecessary errors
-	if !isDisplayAvailable(displayID) {
-		return 0, fmt.Errorf("display %s is not currently available", displayID)
+func commandOpenApp(target AppTarget) error {
+	if target.BundleID != "" {
+		return exec.Command("/usr/bin/open", "-b", target.BundleID).Run()
 	}
+	return exec.Command("/usr/bin/open", "-a", target.Name).Run()
+}
 
-	out, err := exec.Command("betterdisplaycli", "get", "-displayID="+displayID, "-brightness", "-value").Output()
+// commandQuitApp asks the app to quit, it may still ask to save open documents
+func commandQuitApp(target AppTarget) error {
+	// Telling an app that isn't running to quit would launch it first
+	script := fmt.Sprintf("if %s is running then tell %s to quit", target.script(), target.script())
+	return exec.Command("/usr/bin/osascript", "-e", script).Run()
+}
+
+func commandActivateApp(target AppTarget) error {
+	script := fmt.Sprintf("tell %s to activate", target.script())
+	return exec.Command("/usr/bin/osascript", "-e", script).Run()
+}
+
+// commandForceQuitApp kills every running instance of the app
+func commandForceQuitApp(target AppTarget) error {
+	apps, err := getRunningApps()
 	if err != nil {
-		return 0, fmt.Errorf("error getting brightness for display %s: %v", displayID, err)
+		return err
 	}
 
-	// Parse the brightness value (0.0-1.0) and convert to percentage
-	brightnessStr := strings.TrimSpace(string(out))
-	brightness, err := strconv.ParseFloat(brightnessStr, 64)
-	if err != nil {
+	killed := 0
+	for _, app := range apps {
+		if !target.matches(app) {
+			continue
+		}
+		proc, err := os.FindProcess(app.PID)
+		if err != nil {
+			return fmt.Errorf("error finding process %d: %w", app.PID, err)
+		}
+		if err := proc.Kill(); err != nil {
+			return fmt.Errorf("error killing process %d: %w", app.PID, err)
+		}
+		killed++
+	}
+	if killed == 0 {
+		return fmt.Errorf("%s is not running", target)
+	}
+	return nil
+}
+
+// BluetoothDevice is a paired Bluetooth device
+type BluetoothDevice struct {
+	Name      string         `json:"name"`
+	Address   string         `json:"address"`
+	Type      string         `json:"type,omitempty"` // e.g. Headphones, Keyboard or Mouse
+	Connected bool           `json:"connected"`
+	Batteries map[string]int `json:"batteries,omitempty"` // battery percentage by part: main, left, right or case
+}
+
+// key returns the topic key of the device, which is based on its address so renaming it keeps the entities
+func (d BluetoothDevice) key() string {
+	return getTopicKey(d.Address)
+}
+
+// bluetoothBatteryParts maps system_profiler battery properties to battery parts
+var bluetoothBatteryParts = map[string]string{
+	"device_batteryLevel":      "main",
+	"device_batteryLevelMain":  "main",
+	"device_batteryLevelLeft":  "left",
+	"device_batteryLevelRight": "right",
+	"device_batteryLevelCase":  "case",
+}
+
+// getBluetoothDevices returns the paired Bluetooth devices
+func getBluetoothDevices() ([]BluetoothDevice, error) {
+	output, err := exec.Command("/usr/sbin/system_profiler", "SPBluetoothDataType", "-json").Output()
+	if err != nil {
+		return nil, fmt.Errorf("error running system_profiler: %w", err)
+	}
+	return parseBluetoothDevices(output)
+}
+
+// parseBluetoothDevices parses the connected and not connected devices from system_profiler SPBluetoothDataType -json,
+// where each device is an object with its name as the only key
+func parseBluetoothDevices(output []byte) ([]BluetoothDevice, error) {
+	var report struct {
+		Bluetooth []struct {
+			Connected    []map[string]map[string]interface{} `json:"device_connected"`
+			NotConnected []map[string]map[string]interface{} `json:"device_not_connected"`
+		} `json:"SPBluetoothDataType"`
+	}
+	if err := json.Unmarshal(output, &report); err != nil {
+		return nil, fmt.Errorf("error parsing system_profiler output: %w", err)
+	}
+
+	var devices []BluetoothDevice
+	add := func(entries []map[string]map[string]interface{}, connected bool) {
+		for _, entry := range entries {
+			for name, properties := range entry {
+				device := BluetoothDevice{Name: name, Connected: connected}
+				device.Address, _ = properties["device_address"].(string)
+				device.Type, _ = properties["device_minorType"].(string)
+				for property, part := range bluetoothBatteryParts {
+					level, _ := properties[property].(string)
+					percent, err := strconv.Atoi(strings.TrimSpace(strings.TrimSuffix(level, "%")))
+					if err != nil {
+						continue
+					}
+					if device.Batteries == nil {
+						device.Batteries = make(map[string]int)
+					}
+					device.Batteries[part] = percent
+				}
+				if device.Address != "" {
+					devices = append(devices, device)
+				}
+			}
+		}
+	}
+	for _, controller := range report.Bluetooth {
+		add(controller.Connected, true)
+		add(controller.NotConnected, false)
+	}
+
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Name < devices[j].Name
+	})
+	return devices, nil
+}
+
+// getBlueutilPath returns the path of blueutil, empty when it isn't installed
+func getBlueutilPath() string {
+	path, err := exec.LookPath("blueutil")
+	if err != nil {
+		return ""
+	}
+	return path
+}
+
+// commandBluetoothConnection connects or disconnects a paired device with blueutil
+func commandBluetoothConnection(address string, connect bool) error {
+	blueutil := getBlueutilPath()
+	if blueutil == "" {
+		return fmt.Errorf("blueutil is not installed")
+	}
+	action := "--disconnect"
+	if connect {
+		action = "--connect"
+	}
+	if output, err := exec.Command(blueutil, action, address).CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func commandPlayPause() {
+	runCommand("media-control", "toggle-play-pause")
+}
+
+// getDisplays retrieves all available displays using BetterDisplay CLI
+func getDisplays() []Display {
+
+	// Check if BetterDisplay CLI is available
+	if !isBetterDisplayCLIAvailable() {
+		log.Println("BetterDisplay CLI is not installed or not accessible")
+		log.Println("To install BetterDisplay CLI:")
+		log.Println("  1. Install BetterDisplay from https://github.com/waydabber/BetterDisplay")
+		log.Println("  2. Enable CLI access in BetterDisplay preferences")
+		log.Println("  3. Restart the application")
+		log.Println("Display brightness controls will be disabled until BetterDisplay CLI is available")
+		return nil
+	}
+
+	log.Println("Executing: betterdisplaycli get -identifiers")
+	out, err := exec.Command("betterdisplaycli", "get", "-identifiers").Output()
+	if err != nil {
+		log.Printf("Error getting displays: %v", err)
+		log.Println("BetterDisplay CLI is installed but failed to execute")
+		log.Println("Make sure BetterDisplay is running and CLI access is enabled")
+		return nil
+	}
+
+	log.Printf("BetterDisplay CLI output: %s", string(out))
+
+	// BetterDisplay CLI returns comma-separated JSON objects, not an array
+	// We need to wrap it in brackets to make it a valid JSON array
+	jsonStr := "[" + string(out) + "]"
+
+	var displays []Display
+	err = json.Unmarshal([]byte(jsonStr), &displays)
+	if err != nil {
+		log.Printf("Error parsing display JSON: %v", err)
+		log.Println("BetterDisplay CLI returned invalid JSON format")
+		return nil
+	}
+
+	return displays
+}
+
+// isDisplayAvailable checks if a display is currently available
+func isDisplayAvailable(displayID string) bool {
+	// Get current display list to check if display is available
+	displays := getDisplays()
+	if displays == nil {
+		return false
+	}
+
+	for _, display := range displays {
+		if display.DisplayID == displayID {
+			return true
+		}
+	}
+	return false
+}
+
+// getDisplayBrightness gets the current brightness for a specific display
+func getDisplayBrightness(displayID string) (int, error) {
+	// First check if display is available to avoid unnecessary errors
+	if !isDisplayAvailable(displayID) {
+		return 0, fmt.Errorf("display %s is not currently available", displayID)
+	}
+
+	out, err := exec.Command("betterdisplaycli", "get", "-displayID="+displayID, "-brightness", "-value").Output()
+	if err != nil {
+		return 0, fmt.Errorf("error getting brightness for display %s: %v", displayID, err)
+	}
+
+	// Parse the brightness value (0.0-1.0) and convert to percentage
+	brightnessStr := strings.TrimSpace(string(out))
+	brightness, err := strconv.ParseFloat(brightnessStr, 64)
+	if err != nil {
 		return 0, fmt.Errorf("error parsing brightness value: %v", err)
 	}
 
@@ -654,6 +1470,11 @@ func getMediaInfo() (*MediaInfo, error) {
 		mediaInfo.AppName = appName
 	}
 
+	// Get app bundle identifier
+	if bundleID, ok := mediaData["bundleIdentifier"].(string); ok && bundleID != "" {
+		mediaInfo.AppBundleID = bundleID
+	}
+
 	// Get duration (in seconds)
 	duration := 0
 	if d, ok := mediaData["duration"].(float64); ok {
@@ -677,6 +1498,7 @@ func getMediaInfo() (*MediaInfo, error) {
 		position = int(p / 1000000)
 	}
 	mediaInfo.Position = position
+	mediaInfo.PositionUpdatedAt = time.Now()
 
 	// Set state based on playing status
 	mediaInfo.State = "playing"
@@ -739,19 +1561,15 @@ func (app *Application) updateNowPlaying(client mqtt.Client) {
 
 	// If no media is playing, publish idle state
 	if mediaInfo == nil {
-		state := "idle"
-		client.Publish(app.getTopicPrefix()+"/status/now_playing", 0, false, state)
-		attr := map[string]interface{}{
-			"state":    state,
-			"title":    "",
-			"artist":   "",
-			"album":    "",
-			"app_name": "",
-			"duration": 0,
-			"position": 0,
+		app.mediaMutex.Lock()
+		app.streamMediaState = MediaInfo{State: "idle"}
+		app.currentMediaState = MediaInfo{State: "idle"}
+		events := app.recordTrackPlay(app.streamMediaState, time.Now())
+		app.mediaMutex.Unlock()
+		for _, event := range events {
+			app.publishTrackPlayed(client, event)
 		}
-		attrJSON, _ := json.Marshal(attr)
-		client.Publish(app.getTopicPrefix()+"/status/now_playing_attr", 0, false, string(attrJSON))
+		app.publishNowPlaying(client, MediaInfo{State: "idle"})
 		return
 	}
 
@@ -765,516 +1583,2351 @@ func (app *Application) updateNowPlaying(client mqtt.Client) {
 	case "stopped":
 		state = "idle"
 	}
+	mediaInfo.State = state
+
+	app.mediaMutex.Lock()
+	app.streamMediaState = *mediaInfo
+	current, selected := app.applyMediaFilter(*mediaInfo, time.Now())
+	events := app.recordTrackPlay(*mediaInfo, time.Now())
+	app.mediaMutex.Unlock()
+
+	for _, event := range events {
+		app.publishTrackPlayed(client, event)
+	}
+	app.publishAppNowPlaying(client, *mediaInfo)
+	if !selected {
+		return
+	}
 
 	// Publish state and attributes
-	client.Publish(app.getTopicPrefix()+"/status/now_playing", 0, false, state)
+	app.publishNowPlaying(client, current)
+	log.Printf("Updated now playing sensor: %s - %s (%s)", current.Artist, current.Title, current.State)
+}
+
+// publishNowPlaying publishes the now playing state, attributes and progress sensors.
+// The position is interpolated to the time of publishing.
+func (app *Application) publishNowPlaying(client mqtt.Client, mediaInfo MediaInfo) {
+	now := time.Now()
+
+	client.Publish(app.getTopicPrefix()+"/status/now_playing", 0, false, mediaInfo.State)
 	attr := map[string]interface{}{
-		"state":    state,
-		"title":    mediaInfo.Title,
-		"artist":   mediaInfo.Artist,
-		"album":    mediaInfo.Album,
-		"app_name": mediaInfo.AppName,
-		"duration": mediaInfo.Duration,
-		"position": mediaInfo.Position,
+		"state":                     mediaInfo.State,
+		"title":                     mediaInfo.Title,
+		"artist":                    mediaInfo.Artist,
+		"album":                     mediaInfo.Album,
+		"app_name":                  mediaInfo.AppName,
+		"app_bundle_id":             mediaInfo.AppBundleID,
+		"duration":                  mediaInfo.Duration,
+		"position":                  mediaInfo.livePosition(now),
+		"media_position_updated_at": now.Format(time.RFC3339),
 	}
 	attrJSON, _ := json.Marshal(attr)
 	client.Publish(app.getTopicPrefix()+"/status/now_playing_attr", 0, false, string(attrJSON))
-	log.Printf("Updated now playing sensor: %s - %s (%s)", mediaInfo.Artist, mediaInfo.Title, state)
+
+	app.publishMediaProgress(client, mediaInfo, now)
 }
 
-// startMediaStream starts the media-control stream for real-time updates
-func (app *Application) startMediaStream(client mqtt.Client) {
-	if !isMediaControlAvailable() {
-		log.Println("Media Control not available - skipping media stream")
-		return
-	}
+// publishMediaProgress publishes the progress and time remaining sensors
+func (app *Application) publishMediaProgress(client mqtt.Client, mediaInfo MediaInfo, now time.Time) {
+	client.Publish(app.getTopicPrefix()+"/status/media_progress", 0, false, fmt.Sprintf("%.1f", mediaInfo.progressPercent(now)))
+	client.Publish(app.getTopicPrefix()+"/status/media_time_remaining", 0, false, strconv.Itoa(mediaInfo.timeRemaining(now)))
+}
 
-	log.Println("Starting media-control stream for real-time updates...")
+// isActive reports whether the media is still playing, based on its last known state
+func (m MediaInfo) isActive(now time.Time) bool {
+	return m.State == "playing" && (m.Duration == 0 || m.livePosition(now) < m.Duration)
+}
 
-	cmd := exec.Command("media-control", "stream")
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Printf("Error creating stdout pipe for media stream: %v", err)
-		return
+// isMediaAppIgnored reports whether media from the given bundle ID should be ignored
+func (c *config) isMediaAppIgnored(bundleID string) bool {
+	for _, ignored := range c.MediaIgnoreApps {
+		if strings.EqualFold(ignored, bundleID) {
+			return true
+		}
 	}
+	return false
+}
 
-	if err := cmd.Start(); err != nil {
-		log.Printf("Error starting media-control stream: %v", err)
-		return
+// mediaAppPriority returns the priority of a bundle ID, lower values are preferred.
+// Apps that are not listed in media_prefer_apps share the lowest priority.
+func (c *config) mediaAppPriority(bundleID string) int {
+	for i, preferred := range c.MediaPreferApps {
+		if strings.EqualFold(preferred, bundleID) {
+			return i
+		}
 	}
+	return len(c.MediaPreferApps)
+}
 
-	// Read the stream in a goroutine with error recovery
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				log.Printf("Media stream goroutine recovered from panic: %v", r)
-			}
-			cmd.Wait()
-			stdout.Close()
-		}()
+// mediaStatePriority returns the priority of a media state, lower values are preferred.
+// States that are no longer playing rank below every playing app.
+func (c *config) mediaStatePriority(mediaInfo MediaInfo, now time.Time) int {
+	if !mediaInfo.isActive(now) {
+		return len(c.MediaPreferApps) + 1
+	}
+	return c.mediaAppPriority(mediaInfo.AppBundleID)
+}
 
-		scanner := bufio.NewScanner(stdout)
-		// Increase buffer size to handle long JSON lines from media-control stream
-		buf := make([]byte, 0, 64*1024) // 64KB buffer
-		scanner.Buffer(buf, 1024*1024)  // Allow up to 1MB tokens
+// mediaAppState is the last media state reported by an app
+type mediaAppState struct {
+	info      MediaInfo
+	updatedAt time.Time // when the app last reported its state
+}
 
-		for scanner.Scan() {
-			line := scanner.Text()
-			if line == "" {
-				continue
-			}
+// applyMediaFilter records the media state for its app and selects the current media state from the
+// known states of all apps: the most preferred playing app, where the update wins between equally
+// preferred apps. When nothing is playing the update itself is selected. Updates from ignored apps are dropped.
+// media-control only reports the app that is now playing, so apps that reported nothing within
+// MediaAppStateTimeout no longer count as playing; a closed app would otherwise be shown forever.
+// It returns the current media state and whether it has to be published. The caller must hold mediaMutex.
+func (app *Application) applyMediaFilter(mediaInfo MediaInfo, now time.Time) (MediaInfo, bool) {
+	if mediaInfo.AppBundleID != "" {
+		if app.config.isMediaAppIgnored(mediaInfo.AppBundleID) {
+			return app.currentMediaState, false
+		}
+		app.mediaAppStates[strings.ToLower(mediaInfo.AppBundleID)] = mediaAppState{info: mediaInfo, updatedAt: now}
+	}
 
-			// Parse the JSON line from the stream
-			var mediaData map[string]interface{}
-			if err := json.Unmarshal([]byte(line), &mediaData); err != nil {
-				log.Printf("Error parsing media stream JSON: %v", err)
-				continue
-			}
+	bundleIDs := make([]string, 0, len(app.mediaAppStates))
+	for bundleID := range app.mediaAppStates {
+		bundleIDs = append(bundleIDs, bundleID)
+	}
+	sort.Strings(bundleIDs)
 
-			// Process the media update only if MQTT client is connected
-			if client.IsConnected() {
-				app.processMediaStreamUpdate(client, mediaData)
-			}
+	selected, selectedPriority := mediaInfo, app.config.mediaStatePriority(mediaInfo, now)
+	for _, bundleID := range bundleIDs {
+		state := app.mediaAppStates[bundleID]
+		if now.Sub(state.updatedAt) > MediaAppStateTimeout {
+			continue
 		}
-
-		if err := scanner.Err(); err != nil {
-			log.Printf("Error reading media stream: %v", err)
-			log.Println("Media stream will restart on next application restart")
+		if priority := app.config.mediaStatePriority(state.info, now); priority < selectedPriority {
+			selected, selectedPriority = state.info, priority
 		}
-	}()
+	}
 
-	log.Println("Media stream started successfully")
+	previous := app.currentMediaState
+	app.currentMediaState = selected
+	return selected, strings.EqualFold(selected.AppBundleID, mediaInfo.AppBundleID) ||
+		!strings.EqualFold(selected.AppBundleID, previous.AppBundleID)
 }
 
-// processMediaStreamUpdate processes a single media update from the stream
-func (app *Application) processMediaStreamUpdate(client mqtt.Client, mediaData map[string]interface{}) {
-	// The stream sends {"type":"data","diff":true,"payload":{...}}
-	// Only update fields present in payload
-	payload, ok := mediaData["payload"].(map[string]interface{})
-	if !ok {
-		log.Printf("Media stream: No payload in event, skipping")
-		return
-	}
+// topicKeyInvalidChars matches the characters that are replaced in topic keys
+var topicKeyInvalidChars = regexp.MustCompile("[^a-zA-Z0-9_]+")
 
-	// Merge payload into currentMediaState
-	for k, v := range payload {
-		switch k {
-		case "title":
-			if s, ok := v.(string); ok {
-				app.currentMediaState.Title = s
-			}
-		case "artist":
-			if s, ok := v.(string); ok {
-				app.currentMediaState.Artist = s
-			}
-		case "album":
-			if s, ok := v.(string); ok {
-				app.currentMediaState.Album = s
-			}
-		case "appName":
-			if s, ok := v.(string); ok {
-				app.currentMediaState.AppName = s
-			}
-		case "bundleIdentifier":
-			if s, ok := v.(string); ok {
-				app.currentMediaState.AppName = s
-			}
-		case "playing":
-			if b, ok := v.(bool); ok {
-				if b {
-					app.currentMediaState.State = "playing"
-				} else {
-					app.currentMediaState.State = "paused"
-				}
-			}
-		case "duration":
-			if f, ok := v.(float64); ok {
-				app.currentMediaState.Duration = int(f)
-			}
-		case "durationMicros":
-			if f, ok := v.(float64); ok {
-				app.currentMediaState.Duration = int(f / 1000000)
-			}
-		case "totalTime":
-			if f, ok := v.(float64); ok {
-				app.currentMediaState.Duration = int(f)
-			}
-		case "totalDuration":
-			if f, ok := v.(float64); ok {
-				app.currentMediaState.Duration = int(f)
-			}
-		case "elapsedTime":
-			if f, ok := v.(float64); ok {
-				app.currentMediaState.Position = int(f)
-			}
-		case "position":
-			if f, ok := v.(float64); ok {
-				app.currentMediaState.Position = int(f)
-			}
-		case "positionMicros":
-			if f, ok := v.(float64); ok {
-				app.currentMediaState.Position = int(f / 1000000)
-			}
+// getTopicKey converts a name such as a bundle ID or mount point into a topic and unique_id friendly key
+func getTopicKey(name string) string {
+	return strings.Trim(strings.ToLower(topicKeyInvalidChars.ReplaceAllString(name, "_")), "_")
+}
+
+// isMediaAppSensor reports whether a separate now playing sensor is configured for the bundle ID
+func (c *config) isMediaAppSensor(bundleID string) bool {
+	for _, sensor := range c.MediaAppSensors {
+		if strings.EqualFold(sensor, bundleID) {
+			return true
 		}
 	}
+	return false
+}
 
-	// If playing is false and no other info, treat as idle
-	if state, ok := payload["playing"]; ok {
-		if b, ok := state.(bool); ok && !b {
-			app.currentMediaState.State = "idle"
-		}
+// publishAppNowPlaying publishes the per-app now playing sensor if one is configured for the app
+func (app *Application) publishAppNowPlaying(client mqtt.Client, mediaInfo MediaInfo) {
+	if mediaInfo.AppBundleID == "" || !app.config.isMediaAppSensor(mediaInfo.AppBundleID) {
+		return
 	}
 
-	// Publish state and attributes
-	client.Publish(app.getTopicPrefix()+"/status/now_playing", 0, false, app.currentMediaState.State)
+	now := time.Now()
+	topic := app.getTopicPrefix() + "/status/now_playing_" + getTopicKey(mediaInfo.AppBundleID)
+	client.Publish(topic, 0, false, mediaInfo.State)
 	attr := map[string]interface{}{
-		"state":    app.currentMediaState.State,
-		"title":    app.currentMediaState.Title,
-		"artist":   app.currentMediaState.Artist,
-		"album":    app.currentMediaState.Album,
-		"app_name": app.currentMediaState.AppName,
-		"duration": app.currentMediaState.Duration,
-		"position": app.currentMediaState.Position,
+		"state":                     mediaInfo.State,
+		"title":                     mediaInfo.Title,
+		"artist":                    mediaInfo.Artist,
+		"album":                     mediaInfo.Album,
+		"app_name":                  mediaInfo.AppName,
+		"app_bundle_id":             mediaInfo.AppBundleID,
+		"duration":                  mediaInfo.Duration,
+		"position":                  mediaInfo.livePosition(now),
+		"media_position_updated_at": now.Format(time.RFC3339),
 	}
 	attrJSON, _ := json.Marshal(attr)
-	client.Publish(app.getTopicPrefix()+"/status/now_playing_attr", 0, false, string(attrJSON))
-	log.Printf("Media stream update: %s - %s (%s)", app.currentMediaState.Artist, app.currentMediaState.Title, app.currentMediaState.State)
-}
-
-// getUserActivityState gets the current user activity state
-func (app *Application) getUserActivityState() string {
-	app.activityMutex.RLock()
-	defer app.activityMutex.RUnlock()
-	return app.userActivityState
+	client.Publish(topic+"_attr", 0, false, string(attrJSON))
 }
 
-// setUserActivityState sets the user activity state and publishes to MQTT
-func (app *Application) setUserActivityState(client mqtt.Client, state string) {
-	app.activityMutex.Lock()
-	defer app.activityMutex.Unlock()
-
-	if app.userActivityState != state {
-		app.userActivityState = state
-		if client != nil && client.IsConnected() {
-			client.Publish(app.getTopicPrefix()+"/status/user_activity", 0, false, state)
-			log.Printf("User activity state changed to: %s", state)
+// publishMediaAppStates publishes the last known state of every per-app now playing sensor
+func (app *Application) publishMediaAppStates(client mqtt.Client) {
+	app.mediaMutex.RLock()
+	states := make([]MediaInfo, 0, len(app.config.MediaAppSensors))
+	for _, bundleID := range app.config.MediaAppSensors {
+		state, ok := app.mediaAppStates[strings.ToLower(bundleID)]
+		mediaInfo := state.info
+		if !ok {
+			mediaInfo = MediaInfo{State: "idle", AppBundleID: bundleID}
 		}
+		states = append(states, mediaInfo)
+	}
+	app.mediaMutex.RUnlock()
+
+	for _, mediaInfo := range states {
+		app.publishAppNowPlaying(client, mediaInfo)
 	}
 }
 
-// resetActivityTimer resets the inactivity timer
-func (app *Application) resetActivityTimer(client mqtt.Client) {
-	app.activityMutex.Lock()
-	defer app.activityMutex.Unlock()
+// updateMediaProgress checks the listened time of the current track, and republishes the progress and time
+// remaining at most every MediaProgressInterval while media is playing. The now playing sensors are only
+// published on changes, Home Assistant interpolates the position from media_position_updated_at.
+func (app *Application) updateMediaProgress(client mqtt.Client) {
+	var lastProgress time.Time
+	for {
+		time.Sleep(TrackPlayedCheckInterval)
+
+		now := time.Now()
+		app.mediaMutex.Lock()
+		mediaState := app.currentMediaState
+		played := app.checkTrackPlayed(now)
+		app.mediaMutex.Unlock()
 
-	// Set to active immediately
-	if app.userActivityState != "active" {
-		app.userActivityState = "active"
-		if client != nil && client.IsConnected() {
-			client.Publish(app.getTopicPrefix()+"/status/user_activity", 0, false, "active")
-			log.Printf("User activity detected - state: active")
+		if played != nil {
+			app.publishTrackPlayed(client, *played)
+		}
+		if mediaState.State == "playing" && client.IsConnected() &&
+			now.Sub(lastProgress) >= app.getInterval("media_progress", MediaProgressInterval) {
+			app.publishMediaProgress(client, mediaState, now)
+			lastProgress = now
 		}
 	}
+}
 
-	// Reset or create the timer
-	if app.activityTimer != nil {
-		app.activityTimer.Stop()
+// startMediaStream starts the supervised media-control stream for real-time updates.
+func (app *Application) startMediaStream(client mqtt.Client) {
+	if !isMediaControlAvailable() {
+		log.Println("Media Control not available - skipping media stream")
+		return
 	}
 
-	app.activityTimer = time.AfterFunc(time.Duration(app.config.IdleActivityTime)*time.Second, func() {
-		app.setUserActivityState(client, "inactive")
+	app.mediaStreamOnce.Do(func() {
+		log.Println("Starting media-control stream supervisor...")
+		go app.superviseMediaStream(client)
+		go app.updateMediaProgress(client)
 	})
+
+	app.publishMediaStreamHealth(client)
+	app.publishMediaAppStates(client)
 }
 
-// getSystemIdleTime gets the system idle time in seconds
-func getSystemIdleTime() (int, error) {
-	cmd := exec.Command("ioreg", "-c", "IOHIDSystem")
-	output, err := cmd.Output()
-	if err != nil {
-		return 0, fmt.Errorf("error running ioreg: %w", err)
-	}
+// superviseMediaStream keeps the media-control stream running, restarting it with
+// exponential backoff and falling back to polling when it keeps failing
+func (app *Application) superviseMediaStream(client mqtt.Client) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Media stream supervisor recovered from panic: %v", r)
+			app.setMediaStreamHealth(client, "stopped")
+		}
+	}()
 
-	// Parse the HIDIdleTime from the output
-	re := regexp.MustCompile(`"HIDIdleTime" = (\d+)`)
-	matches := re.FindStringSubmatch(string(output))
-	if len(matches) < 2 {
-		return 0, fmt.Errorf("HIDIdleTime not found in ioreg output")
+	restarts := newMediaStreamRestarts()
+
+	for {
+		if app.isMediaStreamPaused() {
+			app.setMediaStreamHealth(client, "paused")
+			app.pollMediaInfo(client, MediaPauseCheckInterval)
+			restarts.reset()
+			continue
+		}
+
+		if restarts.shouldPoll() {
+			log.Printf("Media stream failed %d times in a row - polling media info every %v for %v", MediaStreamMaxFailures, MediaPollInterval, MediaStreamMaxBackoff)
+			app.setMediaStreamHealth(client, "polling")
+			app.pollMediaInfo(client, MediaStreamMaxBackoff)
+			continue
+		}
+
+		started := time.Now()
+		err := app.runMediaStream(client)
+		if app.isMediaStreamPaused() {
+			log.Println("Media stream paused by the power policy")
+			continue
+		}
+		delay := restarts.exited(time.Since(started))
+
+		if err != nil {
+			log.Printf("Media stream exited: %v", err)
+		} else {
+			log.Println("Media stream exited")
+		}
+		log.Printf("Restarting media stream in %v (attempt %d)", delay, restarts.failures)
+		app.setMediaStreamHealth(client, "restarting")
+		time.Sleep(delay)
 	}
+}
 
-	idleTimeNanos, err := strconv.ParseInt(matches[1], 10, 64)
-	if err != nil {
-		return 0, fmt.Errorf("error parsing idle time: %w", err)
+// mediaStreamRestarts tracks the consecutive failures of the media stream and the backoff before restarting it
+type mediaStreamRestarts struct {
+	backoff  time.Duration
+	failures int
+}
+
+func newMediaStreamRestarts() *mediaStreamRestarts {
+	return &mediaStreamRestarts{backoff: MediaStreamInitialBackoff}
+}
+
+// reset forgets the failures, the stream is started without delay again
+func (r *mediaStreamRestarts) reset() {
+	r.backoff = MediaStreamInitialBackoff
+	r.failures = 0
+}
+
+// shouldPoll reports whether the stream failed too often in a row and media info should be polled for a while.
+// The stream gets one more chance after each polling period.
+func (r *mediaStreamRestarts) shouldPoll() bool {
+	if r.failures < MediaStreamMaxFailures {
+		return false
 	}
+	r.failures = MediaStreamMaxFailures - 1
+	return true
+}
 
-	// Convert nanoseconds to seconds
-	idleTimeSeconds := int(idleTimeNanos / 1000000000)
-	return idleTimeSeconds, nil
+// exited records that the stream exited after running for ranFor and returns how long to wait before
+// restarting it. The backoff doubles with every failure, a run of MediaStreamStableRun resets it.
+func (r *mediaStreamRestarts) exited(ranFor time.Duration) time.Duration {
+	if ranFor >= MediaStreamStableRun {
+		r.reset()
+	}
+	r.failures++
+	delay := r.backoff
+	r.backoff = min(r.backoff*2, MediaStreamMaxBackoff)
+	return delay
 }
 
-// startUserActivityMonitoring starts monitoring user activity using system idle time
-func (app *Application) startUserActivityMonitoring(client mqtt.Client) {
-	log.Println("Starting user activity monitoring...")
+// runMediaStream runs a single media-control stream process until it exits or stalls
+func (app *Application) runMediaStream(client mqtt.Client) error {
+	cmd := exec.Command("media-control", "stream")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("error creating stdout pipe for media stream: %w", err)
+	}
 
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				log.Printf("Activity monitor goroutine recovered from panic: %v", r)
-			}
-		}()
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("error starting media-control stream: %w", err)
+	}
 
-		var lastIdleTime int = -1
+	app.mediaMutex.Lock()
+	app.mediaStreamCmd = cmd
+	app.mediaMutex.Unlock()
+	defer func() {
+		app.mediaMutex.Lock()
+		app.mediaStreamCmd = nil
+		app.mediaMutex.Unlock()
+	}()
 
-		for {
-			// Check if client is still connected
-			if client == nil || !client.IsConnected() {
-				time.Sleep(5 * time.Second)
-				continue
-			}
+	app.mediaMutex.Lock()
+	app.lastMediaEvent = time.Now()
+	app.mediaMutex.Unlock()
 
-			idleTime, err := getSystemIdleTime()
-			if err != nil {
-				log.Printf("Error getting system idle time: %v", err)
-				time.Sleep(2 * time.Second)
-				continue
-			}
+	app.setMediaStreamHealth(client, "running")
+	log.Println("Media stream started successfully")
 
-			// If idle time decreased or is very small, user is active
-			if idleTime < lastIdleTime || idleTime < 2 {
-				app.resetActivityTimer(client)
-			}
+	done := make(chan struct{})
+	defer close(done)
+	go app.watchMediaStream(client, cmd, done)
+
+	scanner := bufio.NewScanner(stdout)
+	// Increase buffer size to handle long JSON lines from media-control stream
+	buf := make([]byte, 0, 64*1024) // 64KB buffer
+	scanner.Buffer(buf, 1024*1024)  // Allow up to 1MB tokens
 
-			lastIdleTime = idleTime
-			client.Publish(app.getTopicPrefix()+"/status/idle_time_seconds", 0, false, fmt.Sprintf("%d", idleTime))
-			// Check every 500ms for responsive detection
-			time.Sleep(500 * time.Millisecond)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
 		}
-	}()
 
-	log.Println("User activity monitoring started successfully")
-}
+		app.mediaMutex.Lock()
+		app.lastMediaEvent = time.Now()
+		app.mediaMutex.Unlock()
 
-// publishMediaState publishes the current media state to MQTT
-func (app *Application) publishMediaState(client mqtt.Client, state, title, artist, album, appName string, duration, position int) {
-	// Publish individual attributes
-	client.Publish(app.getTopicPrefix()+"/status/media_state", 0, false, state)
-	client.Publish(app.getTopicPrefix()+"/status/media_title", 0, false, title)
-	client.Publish(app.getTopicPrefix()+"/status/media_artist", 0, false, artist)
-	client.Publish(app.getTopicPrefix()+"/status/media_album", 0, false, album)
-	client.Publish(app.getTopicPrefix()+"/status/media_app", 0, false, appName)
-	client.Publish(app.getTopicPrefix()+"/status/media_duration", 0, false, strconv.Itoa(duration))
-	client.Publish(app.getTopicPrefix()+"/status/media_position", 0, false, strconv.Itoa(position))
+		// Parse the JSON line from the stream
+		var mediaData map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &mediaData); err != nil {
+			log.Printf("Error parsing media stream JSON: %v", err)
+			continue
+		}
 
-	// Publish combined JSON state for media_player entity
-	mediaState := map[string]interface{}{
-		"state":        state,
-		"title":        title,
-		"artist":       artist,
-		"album":        album,
-		"app_name":     appName,
-		"duration":     duration,
-		"position":     position,
-		"media_title":  title,
-		"media_artist": artist,
-		"media_album":  album,
+		// Keep the media state and the listening session current while MQTT is disconnected,
+		// only the publishing needs the connection
+		app.processMediaStreamUpdate(client, mediaData)
 	}
 
-	stateJSON, _ := json.Marshal(mediaState)
-	mediaPlayerTopic := app.getTopicPrefix() + "/status/media_player"
-	client.Publish(mediaPlayerTopic, 0, false, string(stateJSON))
-	log.Printf("Published media state to %s: %s", mediaPlayerTopic, string(stateJSON))
+	if err := scanner.Err(); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("error reading media stream: %w", err)
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("media-control stream failed: %w", err)
+	}
+	return nil
 }
 
-// updateDisplayBrightness updates the MQTT topics with current display brightness values
-func (app *Application) updateDisplayBrightness(client mqtt.Client) {
-	// Skip if no displays are available
-	if len(app.displays) == 0 {
-		return
-	}
+// watchMediaStream kills the stream process when it has gone quiet while
+// getMediaInfo reports a different state than the one the stream last delivered
+func (app *Application) watchMediaStream(client mqtt.Client, cmd *exec.Cmd, done <-chan struct{}) {
+	ticker := time.NewTicker(MediaStreamCheckInterval)
+	defer ticker.Stop()
 
-	// Refresh display list to handle dynamic display changes (laptop open/close)
-	currentDisplays := getDisplays()
-	if currentDisplays != nil {
-		app.displays = currentDisplays
-	}
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			app.mediaMutex.RLock()
+			quiet := time.Since(app.lastMediaEvent)
+			current := app.streamMediaState
+			app.mediaMutex.RUnlock()
 
-	for _, display := range app.displays {
-		brightness, err := getDisplayBrightness(display.DisplayID)
-		if err != nil {
-			// Only log error once per minute to avoid spam for unavailable displays (e.g., closed laptop)
-			if display.Name == "Built-in Display" || strings.Contains(display.Name, "Built-in") {
-				// Silently skip built-in display when unavailable (laptop closed)
+			if quiet < MediaStreamCheckInterval {
 				continue
 			}
-			log.Printf("Error getting brightness for display %s: %v", display.Name, err)
-			// Check if it's a BetterDisplay CLI error
-			if !isBetterDisplayCLIAvailable() {
-				log.Printf("BetterDisplay CLI is not available for display %s", display.Name)
+
+			mediaInfo, err := getMediaInfo()
+			if err != nil {
+				continue
 			}
-			continue
-		}
 
-		statusTopic := app.getTopicPrefix() + "/status/display_" + display.DisplayID + "_brightness"
-		client.Publish(statusTopic, 0, true, strconv.Itoa(brightness))
+			if isMediaInfoChanged(current, mediaInfo) {
+				log.Printf("Media stream stalled - no events for %v but media state changed", quiet.Round(time.Second))
+				app.setMediaStreamHealth(client, "stalled")
+				if cmd.Process != nil {
+					cmd.Process.Kill()
+				}
+				return
+			}
+		}
 	}
 }
 
-func (app *Application) messagePubHandler(client mqtt.Client, msg mqtt.Message) {
-	log.Printf("Received message: %s from topic: %s\n", msg.Payload(), msg.Topic())
-	app.listen(client, msg)
+// isMediaInfoChanged reports whether polled media info differs from the streamed state
+func isMediaInfoChanged(current MediaInfo, polled *MediaInfo) bool {
+	if polled == nil {
+		return current.State == "playing"
+	}
+	return current.State != polled.State || current.Title != polled.Title || current.Artist != polled.Artist
 }
 
-func (app *Application) connectHandler(client mqtt.Client) {
-	log.Println("Connected to MQTT")
+// pollMediaInfo updates the now playing sensor from getMediaInfo for the given period
+func (app *Application) pollMediaInfo(client mqtt.Client, period time.Duration) {
+	deadline := time.After(period)
+	for {
+		if client.IsConnected() {
+			app.updateNowPlaying(client)
+		}
 
-	// Set up device configuration (in case this is a reconnection)
-	app.setDevice(client)
+		select {
+		case <-deadline:
+			return
+		case <-time.After(app.getInterval("media_poll", MediaPollInterval)):
+		}
+	}
+}
 
-	token := client.Publish(app.getTopicPrefix()+"/status/alive", 0, true, "online")
-	token.Wait()
+// isMediaStreamPaused reports whether the power policy pauses the media stream
+func (app *Application) isMediaStreamPaused() bool {
+	return app.config.PowerPolicy.PauseMediaStream && app.getPowerPolicy() != PowerPolicyNormal
+}
 
-	log.Println("Sending 'online' to topic: " + app.getTopicPrefix() + "/status/alive")
-	app.sub(client, app.getTopicPrefix()+"/command/#")
+// stopMediaStream kills the running media-control stream process, if any
+func (app *Application) stopMediaStream() {
+	app.mediaMutex.RLock()
+	cmd := app.mediaStreamCmd
+	app.mediaMutex.RUnlock()
 
-	// Start media stream if not already running (for reconnections)
-	if isMediaControlAvailable() {
-		go app.startMediaStream(client)
+	if cmd != nil && cmd.Process != nil {
+		cmd.Process.Kill()
 	}
+}
 
-	// Start user activity monitoring
-	go app.startUserActivityMonitoring(client)
+// setMediaStreamHealth records the media stream health and publishes it on change
+func (app *Application) setMediaStreamHealth(client mqtt.Client, health string) {
+	app.mediaMutex.Lock()
+	changed := app.mediaStreamHealth != health
+	app.mediaStreamHealth = health
+	app.mediaMutex.Unlock()
 
-	// Send initial state updates
-	app.updateVolume(client)
-	app.updateMute(client)
-	app.updateCaffeinateStatus(client)
-	app.updateDisplayBrightness(client)
-	app.updateNowPlaying(client)
-	app.setUserActivityState(client, "inactive") // Initial state
+	if changed {
+		log.Printf("Media stream health: %s", health)
+		app.publishMediaStreamHealth(client)
+	}
 }
 
-func (app *Application) connectLostHandler(_ mqtt.Client, err error) {
-	log.Printf("Disconnected from MQTT: %v", err)
+// publishMediaStreamHealth publishes the current media stream health
+func (app *Application) publishMediaStreamHealth(client mqtt.Client) {
+	app.mediaMutex.RLock()
+	health := app.mediaStreamHealth
+	app.mediaMutex.RUnlock()
 
-	// Check if it's a network issue
-	if !app.isNetworkReachable() {
-		log.Println("MQTT broker is not reachable - likely on a different network")
-		log.Println("Will retry connection when network becomes available")
-	} else {
-		log.Println("MQTT client will attempt to reconnect automatically...")
+	if health == "" || client == nil || !client.IsConnected() {
+		return
 	}
+	client.Publish(app.getTopicPrefix()+"/status/media_stream", 0, true, health)
 }
 
-func (app *Application) getMQTTClient() error {
-	return app.getMQTTClientWithRetry(0)
+// TrackPlayed is a listening history entry published when a track has been listened to
+type TrackPlayed struct {
+	EventType       string    `json:"event_type"`
+	Track           string    `json:"track"`
+	Artist          string    `json:"artist"`
+	Album           string    `json:"album"`
+	App             string    `json:"app"`
+	AppBundleID     string    `json:"app_bundle_id"`
+	StartedAt       time.Time `json:"started_at"`
+	ListenedSeconds int       `json:"listened_seconds"`
 }
 
-// isNetworkReachable checks if the MQTT broker is reachable before attempting connection
-func (app *Application) isNetworkReachable() bool {
-	// Try to connect to the broker with a short timeout
-	timeout := 5 * time.Second
-	conn, err := net.DialTimeout("tcp", net.JoinHostPort(app.config.IP, app.config.Port), timeout)
-	if err != nil {
-		log.Printf("Network check failed: MQTT broker %s:%s is not reachable (%v)", app.config.IP, app.config.Port, err)
-		return false
-	}
-	conn.Close()
-	return true
+// trackSession tracks how long the current track has been listened to
+type trackSession struct {
+	key          string
+	played       TrackPlayed
+	listened     time.Duration
+	playingSince time.Time // zero while not playing
+	published    bool      // the track_played event was returned for this session
 }
 
-func (app *Application) getMQTTClientWithRetry(retryCount int) error {
-	// Prevent infinite recursion
-	if retryCount > MaxRetryAttempts {
-		return fmt.Errorf("failed to connect to MQTT broker after multiple attempts")
-	}
-
-	// Check network reachability first to avoid long timeouts
-	if !app.isNetworkReachable() {
-		log.Printf("MQTT broker is not reachable on current network, will retry later")
-		return fmt.Errorf("MQTT broker not reachable")
+// getListened returns the time the track of the session has been played until now
+func (session *trackSession) getListened(now time.Time) time.Duration {
+	listened := session.listened
+	if !session.playingSince.IsZero() {
+		listened += now.Sub(session.playingSince)
 	}
+	return listened
+}
 
-	opts := mqtt.NewClientOptions()
+// getTrackKey identifies a track for listening history purposes
+func getTrackKey(mediaInfo MediaInfo) string {
+	return mediaInfo.AppBundleID + "|" + mediaInfo.Artist + "|" + mediaInfo.Title
+}
 
-	// Determine protocol and broker URL
-	protocol := "tcp"
-	if app.config.SSL {
-		protocol = "ssl"
+// recordTrackPlay updates the listening session from the latest media state and returns the track events:
+// track_played once the track has been listened to for at least scrobble_threshold seconds, and
+// track_finished with the whole listened time when the session of a played track ends.
+// A pause keeps the session of the track open, it ends when the track changes or playback stops.
+// The caller must hold mediaMutex.
+func (app *Application) recordTrackPlay(mediaInfo MediaInfo, now time.Time) []TrackPlayed {
+	key := getTrackKey(mediaInfo)
+	ignored := mediaInfo.AppBundleID != "" && app.config.isMediaAppIgnored(mediaInfo.AppBundleID)
+	stopped := mediaInfo.Title == "" || ignored
+
+	session := app.trackSession
+	var events []TrackPlayed
+
+	// End the current session when the track changes or playback stops
+	if session != nil && (stopped || session.key != key) {
+		// The time played since the last check may have reached the threshold
+		if played := app.checkTrackPlayed(now); played != nil {
+			events = append(events, *played)
+		}
+		if session.published {
+			finished := session.played
+			finished.EventType = "track_finished"
+			finished.ListenedSeconds = int(session.getListened(now).Seconds())
+			events = append(events, finished)
+		}
+		app.trackSession = nil
+		session = nil
+	}
+
+	if stopped {
+		return events
+	}
+
+	if session == nil {
+		session = &trackSession{
+			key: key,
+			played: TrackPlayed{
+				EventType:   "track_played",
+				Track:       mediaInfo.Title,
+				Artist:      mediaInfo.Artist,
+				Album:       mediaInfo.Album,
+				App:         mediaInfo.AppName,
+				AppBundleID: mediaInfo.AppBundleID,
+				StartedAt:   now,
+			},
+		}
+		app.trackSession = session
 	}
-	brokerURL := fmt.Sprintf("%s://%s:%s", protocol, app.config.IP, app.config.Port)
-	log.Printf("Connecting to MQTT broker: %s", brokerURL)
 
-	opts.AddBroker(brokerURL)
-	if app.config.User != "" {
-		opts.SetUsername(app.config.User)
-	}
-	if app.config.Password != "" {
-		opts.SetPassword(app.config.Password)
+	// Only count time spent playing
+	if mediaInfo.State == "playing" && session.playingSince.IsZero() {
+		session.playingSince = now
+	} else if mediaInfo.State != "playing" && !session.playingSince.IsZero() {
+		session.listened += now.Sub(session.playingSince)
+		session.playingSince = time.Time{}
 	}
 
-	// Set up handlers with application context
-	opts.OnConnect = app.connectHandler
-	opts.OnConnectionLost = app.connectLostHandler
-	opts.SetDefaultPublishHandler(app.messagePubHandler)
-
-	// Set client ID to ensure unique identification with timestamp to avoid conflicts
-	clientID := fmt.Sprintf("%s_mac2mqtt_%d", app.hostname, time.Now().Unix())
-	opts.SetClientID(clientID)
-
-	// Network-aware connection reliability settings
-	opts.SetClientID(app.hostname + "_mac2mqtt")
-	opts.SetKeepAlive(60 * time.Second)      // Send ping every 60 seconds
-	opts.SetPingTimeout(10 * time.Second)    // Shorter ping timeout for faster network change detection
-	opts.SetConnectTimeout(15 * time.Second) // Shorter connect timeout for network switching
-	opts.SetAutoReconnect(true)              // Enable auto-reconnect
-	opts.SetConnectRetry(true)
-	opts.SetConnectRetryInterval(15 * time.Second) // Wait 15 seconds between retries (good for network switches)
-	opts.SetMaxReconnectInterval(2 * time.Minute)  // Max 2 minutes between reconnect attempts (faster recovery)
-	opts.SetCleanSession(false)                    // Resume session to avoid losing subscriptions
-	opts.SetOrderMatters(false)                    // Allow out-of-order delivery for better performance
-	opts.SetWriteTimeout(10 * time.Second)         // Shorter write timeout for network issues
-	opts.SetResumeSubs(true)                       // Resume subscriptions on reconnect
+	if played := app.checkTrackPlayed(now); played != nil {
+		events = append(events, *played)
+	}
+	return events
+}
 
-	// Set will message
-	opts.SetWill(app.getTopicPrefix()+"/status/alive", "offline", 0, true)
+// checkTrackPlayed returns the track of the listening session when it has been listened to for at least
+// scrobble_threshold seconds. It is returned only once per session. The caller must hold mediaMutex.
+func (app *Application) checkTrackPlayed(now time.Time) *TrackPlayed {
+	session := app.trackSession
+	if session == nil || session.published {
+		return nil
+	}
 
-	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		// If SSL connection fails, try falling back to non-SSL
-		if app.config.SSL {
-			log.Printf("SSL connection failed: %v. Trying non-SSL connection...", token.Error())
-			app.config.SSL = false
-			return app.getMQTTClientWithRetry(retryCount + 1)
-		}
-		return fmt.Errorf("failed to connect to MQTT broker: %w", token.Error())
+	listened := session.getListened(now)
+	if listened < time.Duration(*app.config.ScrobbleThreshold)*time.Second {
+		return nil
 	}
 
-	app.client = client
-	return nil
+	session.published = true
+	played := session.played
+	played.ListenedSeconds = int(listened.Seconds())
+	return &played
 }
 
-func (app *Application) sub(client mqtt.Client, topic string) {
-	token := client.Subscribe(topic, 0, nil)
-	token.Wait()
-	log.Printf("Subscribed to topic: %s\n", topic)
-}
+// publishTrackPlayed publishes a track event and appends it to the scrobble log file
+func (app *Application) publishTrackPlayed(client mqtt.Client, played TrackPlayed) {
+	playedJSON, _ := json.Marshal(played)
+	log.Printf("Track event %s: %s - %s (%ds)", played.EventType, played.Artist, played.Track, played.ListenedSeconds)
 
-func (app *Application) listen(client mqtt.Client, msg mqtt.Message) {
-	topic := msg.Topic()
-	payload := string(msg.Payload())
+	if client != nil && client.IsConnected() {
+		client.Publish(app.getTopicPrefix()+"/events/track_played", 0, false, string(playedJSON))
+	}
 
-	// Handle volume commands
-	if app.handleVolumeCommand(client, topic, payload) {
+	if app.config.ScrobbleLogFile == "" {
 		return
 	}
 
-	// Handle mute commands
-	if app.handleMuteCommand(client, topic, payload) {
+	f, err := os.OpenFile(app.config.ScrobbleLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Error opening scrobble log file %s: %v", app.config.ScrobbleLogFile, err)
 		return
 	}
+	defer f.Close()
 
-	// Handle system commands
-	if app.handleSystemCommand(topic, payload) {
-		return
+	if _, err := f.Write(append(playedJSON, '\n')); err != nil {
+		log.Printf("Error writing scrobble log file %s: %v", app.config.ScrobbleLogFile, err)
+	}
+}
+
+// processMediaStreamUpdate processes a single media update from the stream
+func (app *Application) processMediaStreamUpdate(client mqtt.Client, mediaData map[string]interface{}) {
+	// The stream sends {"type":"data","diff":true,"payload":{...}}
+	// Only update fields present in payload
+	payload, ok := mediaData["payload"].(map[string]interface{})
+	if !ok {
+		log.Printf("Media stream: No payload in event, skipping")
+		return
+	}
+
+	app.mediaMutex.Lock()
+
+	now := time.Now()
+
+	// Freeze the interpolated position when playback starts or stops so that
+	// paused time is not counted
+	if _, ok := payload["playing"]; ok {
+		app.streamMediaState.Position = app.streamMediaState.livePosition(now)
+		app.streamMediaState.PositionUpdatedAt = now
+	}
+
+	// Merge payload into streamMediaState
+	for k, v := range payload {
+		switch k {
+		case "title":
+			if s, ok := v.(string); ok {
+				app.streamMediaState.Title = s
+			}
+		case "artist":
+			if s, ok := v.(string); ok {
+				app.streamMediaState.Artist = s
+			}
+		case "album":
+			if s, ok := v.(string); ok {
+				app.streamMediaState.Album = s
+			}
+		case "appName":
+			if s, ok := v.(string); ok {
+				app.streamMediaState.AppName = s
+			}
+		case "bundleIdentifier":
+			if s, ok := v.(string); ok {
+				app.streamMediaState.AppBundleID = s
+			}
+		case "playing":
+			if b, ok := v.(bool); ok {
+				if b {
+					app.streamMediaState.State = "playing"
+				} else {
+					app.streamMediaState.State = "paused"
+				}
+			}
+		case "duration":
+			if f, ok := v.(float64); ok {
+				app.streamMediaState.Duration = int(f)
+			}
+		case "durationMicros":
+			if f, ok := v.(float64); ok {
+				app.streamMediaState.Duration = int(f / 1000000)
+			}
+		case "totalTime":
+			if f, ok := v.(float64); ok {
+				app.streamMediaState.Duration = int(f)
+			}
+		case "totalDuration":
+			if f, ok := v.(float64); ok {
+				app.streamMediaState.Duration = int(f)
+			}
+		case "elapsedTime":
+			if f, ok := v.(float64); ok {
+				app.streamMediaState.Position = int(f)
+				app.streamMediaState.PositionUpdatedAt = now
+			}
+		case "position":
+			if f, ok := v.(float64); ok {
+				app.streamMediaState.Position = int(f)
+				app.streamMediaState.PositionUpdatedAt = now
+			}
+		case "positionMicros":
+			if f, ok := v.(float64); ok {
+				app.streamMediaState.Position = int(f / 1000000)
+				app.streamMediaState.PositionUpdatedAt = now
+			}
+		}
+	}
+
+	// The stream usually only reports the bundle ID, keep using it as the app name in that case
+	if _, ok := payload["appName"]; !ok {
+		if _, ok := payload["bundleIdentifier"]; ok {
+			app.streamMediaState.AppName = app.streamMediaState.AppBundleID
+		}
+	}
+
+	// If playing is false and no other info, treat as idle
+	if state, ok := payload["playing"]; ok {
+		if b, ok := state.(bool); ok && !b {
+			app.streamMediaState.State = "idle"
+		}
+	}
+
+	mediaState := app.streamMediaState
+	current, selected := app.applyMediaFilter(mediaState, now)
+	events := app.recordTrackPlay(mediaState, now)
+	app.mediaMutex.Unlock()
+
+	for _, event := range events {
+		app.publishTrackPlayed(client, event)
+	}
+	if !client.IsConnected() {
+		return
+	}
+	app.publishAppNowPlaying(client, mediaState)
+	if !selected {
+		log.Printf("Media stream update from %s not shown: %s - %s (%s)", mediaState.AppBundleID, mediaState.Artist, mediaState.Title, mediaState.State)
+		return
+	}
+
+	// Publish state and attributes
+	app.publishNowPlaying(client, current)
+	log.Printf("Media stream update: %s - %s (%s)", current.Artist, current.Title, current.State)
+}
+
+// getUserActivityState gets the current user activity state
+func (app *Application) getUserActivityState() string {
+	app.activityMutex.RLock()
+	defer app.activityMutex.RUnlock()
+	return app.userActivityState
+}
+
+// setUserActivityState sets the user activity state and publishes to MQTT.
+// It reports whether the state changed.
+func (app *Application) setUserActivityState(client mqtt.Client, state string) bool {
+	app.activityMutex.Lock()
+	defer app.activityMutex.Unlock()
+
+	if app.userActivityState == state {
+		return false
+	}
+
+	app.userActivityState = state
+	if client != nil && client.IsConnected() {
+		client.Publish(app.getTopicPrefix()+"/status/user_activity", 0, false, state)
+		log.Printf("User activity state changed to: %s", state)
+	}
+	return true
+}
+
+// getPresenceState derives the presence state. Sleeping and a locked screen take
+// precedence over the idle time thresholds.
+func getPresenceState(idleTime, idleThreshold, awayThreshold time.Duration, locked, asleep bool) string {
+	switch {
+	case asleep:
+		return PresenceAsleep
+	case locked:
+		return PresenceLocked
+	case idleTime >= awayThreshold:
+		return PresenceAway
+	case idleTime >= idleThreshold:
+		return PresenceIdle
+	default:
+		return PresenceActive
+	}
+}
+
+// setIdleTime records the latest idle time and updates the presence state
+func (app *Application) setIdleTime(client mqtt.Client, idleTime time.Duration) {
+	app.activityMutex.Lock()
+	app.lastIdleTime = idleTime
+	app.activityMutex.Unlock()
+
+	app.updatePresence(client)
+}
+
+// setScreenLocked records whether the screen is locked and updates the presence state
+func (app *Application) setScreenLocked(client mqtt.Client, locked bool) {
+	app.activityMutex.Lock()
+	app.screenLocked = locked
+	app.activityMutex.Unlock()
+
+	app.updatePresence(client)
+}
+
+// setSystemAsleep records whether the system is (about to go) asleep and updates the presence state
+func (app *Application) setSystemAsleep(client mqtt.Client, asleep bool) {
+	app.activityMutex.Lock()
+	app.systemAsleep = asleep
+	app.activityMutex.Unlock()
+
+	app.updatePresence(client)
+}
+
+// updatePresence recomputes the presence state and publishes it on transitions
+func (app *Application) updatePresence(client mqtt.Client) {
+	app.activityMutex.Lock()
+	state := getPresenceState(
+		app.lastIdleTime,
+		time.Duration(app.config.IdleActivityTime)*time.Second,
+		time.Duration(app.config.IdleAwayTime)*time.Second,
+		app.screenLocked,
+		app.systemAsleep,
+	)
+	if state == app.presenceState {
+		app.activityMutex.Unlock()
+		return
+	}
+	app.previousPresence = app.presenceState
+	app.presenceState = state
+	app.presenceChangedAt = time.Now()
+	app.activityMutex.Unlock()
+
+	log.Printf("Presence state changed to: %s", state)
+	app.publishPresence(client)
+}
+
+// publishPresence publishes the presence state, its attributes and the transition timestamp
+func (app *Application) publishPresence(client mqtt.Client) {
+	app.activityMutex.RLock()
+	state := app.presenceState
+	previous := app.previousPresence
+	changedAt := app.presenceChangedAt
+	idleTime := app.lastIdleTime
+	app.activityMutex.RUnlock()
+
+	if state == "" || client == nil || !client.IsConnected() {
+		return
+	}
+
+	client.Publish(app.getTopicPrefix()+"/status/presence", 0, false, state)
+	client.Publish(app.getTopicPrefix()+"/status/presence_changed_at", 0, false, changedAt.Format(time.RFC3339))
+	attr := map[string]interface{}{
+		"state":          state,
+		"previous_state": previous,
+		"changed_at":     changedAt.Format(time.RFC3339),
+		"idle_seconds":   int(idleTime.Seconds()),
+	}
+	attrJSON, _ := json.Marshal(attr)
+	client.Publish(app.getTopicPrefix()+"/status/presence_attr", 0, false, string(attrJSON))
+}
+
+// ScreenLockProvider reports whether the screen is locked
+type ScreenLockProvider interface {
+	IsScreenLocked() (bool, error)
+}
+
+// ioregScreenLockProvider reads the console session of the IORegistry root on macOS
+type ioregScreenLockProvider struct{}
+
+// IsScreenLocked reports whether the console session screen is locked
+func (p *ioregScreenLockProvider) IsScreenLocked() (bool, error) {
+	output, err := exec.Command("ioreg", "-n", "Root", "-d1").Output()
+	if err != nil {
+		return false, fmt.Errorf("error running ioreg: %w", err)
+	}
+	return parseScreenLocked(string(output))
+}
+
+// parseScreenLocked parses the CGSSessionScreenIsLocked flag of the IOConsoleUsers
+// session on the console from ioreg output. The flag is only present while the screen is locked.
+// With fast user switching the other sessions are left out; while no session is on the
+// console the login window is shown, which counts as locked.
+func parseScreenLocked(output string) (bool, error) {
+	usersRe := regexp.MustCompile(`"IOConsoleUsers" = \((.*)\)`)
+	users := usersRe.FindStringSubmatch(output)
+	if users == nil {
+		return false, fmt.Errorf("IOConsoleUsers not found in ioreg output")
+	}
+
+	onConsoleRe := regexp.MustCompile(`"kCGSSessionOnConsoleKey"\s*=\s*Yes`)
+	lockedRe := regexp.MustCompile(`"CGSSessionScreenIsLocked"\s*=\s*Yes`)
+	for _, session := range strings.Split(users[1], "},{") {
+		if onConsoleRe.MatchString(session) {
+			return lockedRe.MatchString(session), nil
+		}
+	}
+	return true, nil
+}
+
+// startScreenLockMonitoring starts polling the screen lock state.
+func (app *Application) startScreenLockMonitoring(client mqtt.Client) {
+	app.screenLockOnce.Do(func() {
+		log.Println("Starting screen lock monitoring...")
+		go app.monitorScreenLock(client)
+	})
+	app.publishScreenLocked(client)
+}
+
+// monitorScreenLock publishes the screen lock state when it changes
+func (app *Application) monitorScreenLock(client mqtt.Client) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Screen lock monitor goroutine recovered from panic: %v", r)
+		}
+	}()
+
+	for {
+		locked, err := app.screenLockProvider.IsScreenLocked()
+		if err != nil {
+			log.Printf("Error getting screen lock state: %v", err)
+		} else {
+			app.activityMutex.RLock()
+			changed := locked != app.screenLocked
+			app.activityMutex.RUnlock()
+
+			if changed {
+				log.Printf("Screen locked: %v", locked)
+				app.setScreenLocked(client, locked)
+				app.publishScreenLocked(client)
+			}
+		}
+
+		time.Sleep(app.getInterval("screen_lock", ScreenLockCheckInterval))
+	}
+}
+
+// publishScreenLocked publishes the current screen lock state
+func (app *Application) publishScreenLocked(client mqtt.Client) {
+	if client == nil || !client.IsConnected() {
+		return
+	}
+
+	app.activityMutex.RLock()
+	locked := app.screenLocked
+	app.activityMutex.RUnlock()
+
+	state := "OFF"
+	if locked {
+		state = "ON"
+	}
+	client.Publish(app.getTopicPrefix()+"/status/screen_locked", 0, false, state)
+}
+
+// FrontmostApp is the application that has the keyboard focus
+type FrontmostApp struct {
+	Name        string `json:"name"`
+	BundleID    string `json:"bundle_id"`
+	PID         int    `json:"pid"`
+	WindowTitle string `json:"window_title,omitempty"`
+}
+
+// FrontmostAppProvider reports the focused application
+type FrontmostAppProvider interface {
+	FrontmostApp() (*FrontmostApp, error)
+}
+
+// lsappinfoFrontmostAppProvider asks Launch Services for the front application on macOS.
+// The window title comes from System Events, which needs the Accessibility permission.
+// Without the permission the title is no longer requested.
+type lsappinfoFrontmostAppProvider struct {
+	windowTitle bool
+	frontASN    string       // ASN of the last front application
+	front       FrontmostApp // the last front application, looked up again when the ASN changes
+}
+
+// FrontmostApp returns the front application and, when enabled, the title of its front window
+func (p *lsappinfoFrontmostAppProvider) FrontmostApp() (*FrontmostApp, error) {
+	output, err := exec.Command("/usr/bin/lsappinfo", "front").Output()
+	if err != nil {
+		return nil, fmt.Errorf("error running lsappinfo: %w", err)
+	}
+	// The front application is an ASN like ASN:0x0-0x1d01d:, empty while no application is in front
+	asn := strings.TrimSpace(string(output))
+	if asn == "" {
+		return nil, fmt.Errorf("no front application")
+	}
+	// Only look up the application when another one came to the front
+	if asn != p.frontASN {
+		output, err = exec.Command("/usr/bin/lsappinfo", "info", "-only", "name", "-only", "bundleid", "-only", "pid", asn).Output()
+		if err != nil {
+			return nil, fmt.Errorf("error running lsappinfo: %w", err)
+		}
+		front, err := parseLsappinfo(string(output))
+		if err != nil {
+			return nil, err
+		}
+		p.frontASN = asn
+		p.front = *front
+	}
+	frontmost := &FrontmostApp{Name: p.front.Name, BundleID: p.front.BundleID, PID: p.front.PID}
+
+	if p.windowTitle {
+		script := "tell application \"System Events\" to get name of front window of (first application process whose frontmost is true)"
+		output, err := exec.Command("/usr/bin/osascript", "-e", script).Output()
+		exitErr, _ := err.(*exec.ExitError)
+		switch {
+		case err == nil:
+			frontmost.WindowTitle = parseWindowTitle(string(output))
+		case exitErr != nil && isAccessDenied(string(exitErr.Stderr)):
+			log.Printf("Window titles are not available, allow mac2mqtt in System Settings > Privacy & Security > "+
+				"Accessibility and restart it: %s", strings.TrimSpace(string(exitErr.Stderr)))
+			p.windowTitle = false
+		case exitErr != nil:
+			// Apps without windows (e.g. Finder on the desktop) fail here, keep the app without a title
+		default:
+			log.Printf("Error getting front window title: %v", err)
+		}
+	}
+	return frontmost, nil
+}
+
+// isAccessDenied reports whether osascript failed because macOS denied the Accessibility
+// or Automation permission for System Events
+func isAccessDenied(stderr string) bool {
+	return strings.Contains(stderr, "not allowed assistive access") ||
+		strings.Contains(stderr, "(-25211)") ||
+		strings.Contains(stderr, "(-1743)")
+}
+
+// parseLsappinfo parses lsappinfo info output:
+//
+//	"LSDisplayName"="Safari"
+//	"CFBundleIdentifier"="com.apple.Safari"
+//	"pid"=1234
+func parseLsappinfo(output string) (*FrontmostApp, error) {
+	re := regexp.MustCompile(`(?m)^\s*"([^"]+)"\s*=\s*(?:"(.*)"|(\S+))\s*$`)
+	frontmost := &FrontmostApp{}
+	for _, match := range re.FindAllStringSubmatch(output, -1) {
+		value := match[2]
+		if value == "" {
+			value = match[3]
+		}
+		switch match[1] {
+		case "LSDisplayName":
+			frontmost.Name = value
+		case "CFBundleIdentifier":
+			// Apps without a bundle report [ NULL ]
+			if value != "[ NULL ]" {
+				frontmost.BundleID = value
+			}
+		case "pid":
+			frontmost.PID, _ = strconv.Atoi(value)
+		}
+	}
+	if frontmost.Name == "" {
+		return nil, fmt.Errorf("no front application in lsappinfo output")
+	}
+	return frontmost, nil
+}
+
+// parseWindowTitle trims the osascript output and shortens it to a valid Home Assistant state
+func parseWindowTitle(output string) string {
+	title := strings.TrimSpace(output)
+	if title == "missing value" {
+		return ""
+	}
+	if runes := []rune(title); len(runes) > MaxStateLength {
+		title = string(runes[:MaxStateLength])
+	}
+	return title
+}
+
+// startFrontmostAppMonitoring starts polling the focused application.
+func (app *Application) startFrontmostAppMonitoring(client mqtt.Client) {
+	app.frontmostOnce.Do(func() {
+		log.Println("Starting frontmost app monitoring...")
+		go app.monitorFrontmostApp(client)
+	})
+	app.publishFrontmostApp(client)
+}
+
+// monitorFrontmostApp publishes the focused application when it or its window title changes
+func (app *Application) monitorFrontmostApp(client mqtt.Client) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Frontmost app monitor goroutine recovered from panic: %v", r)
+		}
+	}()
+
+	for {
+		frontmost, err := app.frontmostProvider.FrontmostApp()
+		if err != nil {
+			log.Printf("Error getting frontmost app: %v", err)
+		} else {
+			app.activityMutex.Lock()
+			changed := *frontmost != app.frontmostApp
+			app.frontmostApp = *frontmost
+			app.activityMutex.Unlock()
+
+			if changed {
+				log.Printf("Frontmost app: %s (%s)", frontmost.Name, frontmost.BundleID)
+				app.publishFrontmostApp(client)
+			}
+		}
+
+		time.Sleep(app.getInterval("frontmost_app", FrontmostCheckInterval))
+	}
+}
+
+// publishFrontmostApp publishes the focused application
+func (app *Application) publishFrontmostApp(client mqtt.Client) {
+	if client == nil || !client.IsConnected() {
+		return
+	}
+
+	app.activityMutex.RLock()
+	frontmost := app.frontmostApp
+	app.activityMutex.RUnlock()
+
+	// Nothing to publish until the monitor has read the front application
+	if frontmost.Name == "" {
+		return
+	}
+
+	frontmostJSON, _ := json.Marshal(frontmost)
+	client.Publish(app.getTopicPrefix()+"/status/frontmost_app", 0, false, frontmost.Name)
+	client.Publish(app.getTopicPrefix()+"/status/frontmost_app_attr", 0, false, string(frontmostJSON))
+	if app.config.FrontmostWindowTitle {
+		client.Publish(app.getTopicPrefix()+"/status/frontmost_window_title", 0, false, frontmost.WindowTitle)
+	}
+}
+
+// PowerEvent is a sleep, wake or display power event
+type PowerEvent struct {
+	Type    string    // "will_sleep", "did_wake", "display_off" or "display_on"
+	Time    time.Time // when the event happened
+	Details string    // the reason as reported by the system
+}
+
+// PowerEventProvider reports power events
+type PowerEventProvider interface {
+	// PowerEvents returns the recent power events, oldest first
+	PowerEvents() ([]PowerEvent, error)
+	// WatchPowerEvents sends power events as they happen until the watch fails
+	WatchPowerEvents(events chan<- PowerEvent) error
+}
+
+// pmsetPowerEventProvider reads the power event history from the pmset log and follows
+// new events in the unified log of powerd on macOS
+type pmsetPowerEventProvider struct{}
+
+// PowerEvents returns the power events from the most recent pmset log entries
+func (p *pmsetPowerEventProvider) PowerEvents() ([]PowerEvent, error) {
+	output, err := exec.Command("/usr/bin/pmset", "-g", "log").Output()
+	if err != nil {
+		return nil, fmt.Errorf("error running pmset: %w", err)
+	}
+	lines := strings.Split(string(output), "\n")
+	if len(lines) > PowerLogTailLines {
+		lines = lines[len(lines)-PowerLogTailLines:]
+	}
+	return parsePmsetLog(strings.Join(lines, "\n")), nil
+}
+
+// WatchPowerEvents streams the sleep, wake and display messages of powerd, the same ones pmset -g log shows
+func (p *pmsetPowerEventProvider) WatchPowerEvents(events chan<- PowerEvent) error {
+	predicate := `process == "powerd" AND (eventMessage BEGINSWITH "Entering Sleep" OR ` +
+		`eventMessage BEGINSWITH "Wake from" OR eventMessage CONTAINS "to FullWake" OR ` +
+		`eventMessage BEGINSWITH "Display is turned")`
+	cmd := exec.Command("/usr/bin/log", "stream", "--style", "ndjson", "--predicate", predicate)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("error creating stdout pipe for log stream: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("error starting log stream: %w", err)
+	}
+	defer cmd.Wait()
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		if event, ok := parseLogStreamPowerEvent(scanner.Text()); ok {
+			events <- event
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading log stream: %w", err)
+	}
+	return fmt.Errorf("log stream exited")
+}
+
+// parseLogStreamPowerEvent parses a power event from a log stream --style ndjson line.
+// The first line is a "Filtering the log data" header, which is not JSON.
+func parseLogStreamPowerEvent(line string) (PowerEvent, bool) {
+	var entry struct {
+		Timestamp    string `json:"timestamp"`
+		EventMessage string `json:"eventMessage"`
+	}
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		return PowerEvent{}, false
+	}
+	eventTime, err := time.Parse("2006-01-02 15:04:05.000000-0700", entry.Timestamp)
+	if err != nil {
+		return PowerEvent{}, false
+	}
+
+	message := strings.TrimSpace(entry.EventMessage)
+	eventType := ""
+	switch {
+	case strings.HasPrefix(message, "Entering Sleep"):
+		eventType = "will_sleep"
+	case strings.HasPrefix(message, "Wake from") || strings.Contains(message, "to FullWake"):
+		eventType = "did_wake"
+	case strings.HasPrefix(message, "Display is turned off"):
+		eventType = "display_off"
+	case strings.HasPrefix(message, "Display is turned on"):
+		eventType = "display_on"
+	default:
+		return PowerEvent{}, false
+	}
+	return PowerEvent{Type: eventType, Time: eventTime, Details: message}, true
+}
+
+// parsePmsetLog parses sleep, wake and display events from pmset -g log output:
+//
+//	2024-05-01 08:12:33 +0200 Sleep               	Entering Sleep state due to 'Clamshell Sleep'
+//	2024-05-01 08:40:02 +0200 Wake                	DarkWake to FullWake from Deep Idle [CDNVA] : due to UserActivity Assertion
+//	2024-05-01 08:40:03 +0200 Notification        	Display is turned on
+func parsePmsetLog(output string) []PowerEvent {
+	const timeLayout = "2006-01-02 15:04:05 -0700"
+
+	var events []PowerEvent
+	for _, line := range strings.Split(output, "\n") {
+		if len(line) <= len(timeLayout) {
+			continue
+		}
+		eventTime, err := time.Parse(timeLayout, line[:len(timeLayout)])
+		if err != nil {
+			continue
+		}
+
+		// The event type column is padded with spaces and followed by a tab
+		rest := strings.TrimLeft(line[len(timeLayout):], " ")
+		kind, details, ok := strings.Cut(rest, "\t")
+		if !ok {
+			kind, details, _ = strings.Cut(rest, " ")
+		}
+		kind = strings.TrimSpace(kind)
+		details = strings.TrimSpace(details)
+
+		eventType := ""
+		switch {
+		case kind == "Sleep":
+			eventType = "will_sleep"
+		case kind == "Wake":
+			eventType = "did_wake"
+		case kind == "Notification" && strings.HasPrefix(details, "Display is turned off"):
+			eventType = "display_off"
+		case kind == "Notification" && strings.HasPrefix(details, "Display is turned on"):
+			eventType = "display_on"
+		default:
+			continue
+		}
+
+		events = append(events, PowerEvent{Type: eventType, Time: eventTime, Details: details})
+	}
+	return events
+}
+
+// startPowerEventMonitoring starts watching for sleep, wake and display events.
+func (app *Application) startPowerEventMonitoring(client mqtt.Client) {
+	app.powerEventOnce.Do(func() {
+		log.Println("Starting power event monitoring...")
+		go app.monitorPowerEvents(client)
+	})
+	app.publishLastWake(client)
+}
+
+// monitorPowerEvents publishes power events as they happen and refreshes all state after a wake.
+// A wake is detected from the power event stream or from a gap in the wall clock between checks,
+// because the monotonic clock does not advance while the Mac is asleep.
+func (app *Application) monitorPowerEvents(client mqtt.Client) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Power event monitor goroutine recovered from panic: %v", r)
+		}
+	}()
+
+	// Don't replay the log history, only remember the last wake
+	var wokeAt time.Time
+	if events, err := app.powerEventProvider.PowerEvents(); err != nil {
+		log.Printf("Error getting power events: %v", err)
+	} else {
+		for _, event := range events {
+			if event.Type == "did_wake" {
+				app.setLastWake(event.Time)
+				wokeAt = event.Time
+			}
+		}
+	}
+
+	events := make(chan PowerEvent, 16)
+	go app.watchPowerEvents(events)
+
+	var lastRefresh time.Time
+	lastCheck := time.Now().Round(0)
+	interval := app.getInterval("power_events", PowerEventCheckInterval)
+	timer := time.NewTimer(interval)
+	for {
+		woke := false
+		select {
+		case event := <-events:
+			woke = app.handlePowerEvent(client, event, wokeAt)
+			if woke && event.Time.After(wokeAt) {
+				wokeAt = event.Time
+			}
+
+		case <-timer.C:
+			// Round(0) strips the monotonic clock reading so that time spent asleep is included
+			now := time.Now().Round(0)
+			woke = now.Sub(lastCheck) > interval+SleepDetectionSlack
+			lastCheck = now
+			interval = app.getInterval("power_events", PowerEventCheckInterval)
+			timer.Reset(interval)
+			if woke {
+				log.Printf("System woke up from sleep")
+				wokeAt = now
+			}
+		}
+
+		if woke {
+			// We are running, so the system is awake regardless of the event order
+			app.setSystemAsleep(client, false)
+			if time.Since(lastRefresh) >= WakeRefreshDebounce {
+				lastRefresh = time.Now()
+				app.waitForConnection(client, WakeReconnectTimeout)
+				app.publishLastWake(client)
+				log.Println("Refreshing all state after wake")
+				app.refreshState(client)
+			} else {
+				app.publishLastWake(client)
+			}
+		}
+	}
+}
+
+// handlePowerEvent publishes a power event and applies it to the sleep state, it reports whether the event is a wake.
+// log stream often delivers will_sleep only after the process thaws, when the wake may already have been detected
+// from the clock, so a will_sleep that is not after wokeAt is stale and doesn't mark the system asleep.
+func (app *Application) handlePowerEvent(client mqtt.Client, event PowerEvent, wokeAt time.Time) bool {
+	app.publishPowerEvent(client, event)
+	switch event.Type {
+	case "will_sleep":
+		if !event.Time.After(wokeAt) {
+			log.Printf("Ignoring sleep at %s, the system woke up after it", event.Time.Format(time.RFC3339))
+			return false
+		}
+		app.setSystemAsleep(client, true)
+	case "did_wake":
+		app.setLastWake(event.Time)
+		return true
+	}
+	return false
+}
+
+// watchPowerEvents keeps the power event stream running. Without it a wake is still detected from the clock.
+func (app *Application) watchPowerEvents(events chan<- PowerEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Power event stream goroutine recovered from panic: %v", r)
+		}
+	}()
+
+	for {
+		if err := app.powerEventProvider.WatchPowerEvents(events); err != nil {
+			log.Printf("Power event stream stopped: %v", err)
+		}
+		time.Sleep(PowerEventRestartDelay)
+	}
+}
+
+// waitForConnection waits until the MQTT client is connected or the timeout expires
+func (app *Application) waitForConnection(client mqtt.Client, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for client != nil && !client.IsConnected() && time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+	}
+}
+
+// setLastWake records the time of the last wake
+func (app *Application) setLastWake(wakeTime time.Time) {
+	app.activityMutex.Lock()
+	defer app.activityMutex.Unlock()
+
+	if wakeTime.After(app.lastWake) {
+		app.lastWake = wakeTime
+	}
+}
+
+// publishLastWake publishes the time of the last wake
+func (app *Application) publishLastWake(client mqtt.Client) {
+	app.activityMutex.RLock()
+	lastWake := app.lastWake
+	app.activityMutex.RUnlock()
+
+	if lastWake.IsZero() || client == nil || !client.IsConnected() {
+		return
+	}
+	client.Publish(app.getTopicPrefix()+"/status/last_wake", 0, true, lastWake.Format(time.RFC3339))
+}
+
+// publishPowerEvent publishes a power event
+func (app *Application) publishPowerEvent(client mqtt.Client, event PowerEvent) {
+	log.Printf("Power event: %s at %s (%s)", event.Type, event.Time.Format(time.RFC3339), event.Details)
+	if client == nil || !client.IsConnected() {
+		return
+	}
+
+	eventJSON, _ := json.Marshal(map[string]interface{}{
+		"event_type": event.Type,
+		"timestamp":  event.Time.Format(time.RFC3339),
+		"details":    event.Details,
+	})
+	client.Publish(app.getTopicPrefix()+"/events/power", 0, false, string(eventJSON))
+}
+
+// refreshState publishes every sensor again, e.g. to replace stale values after a wake
+func (app *Application) refreshState(client mqtt.Client) {
+	if client == nil || !client.IsConnected() {
+		log.Println("MQTT client not connected, skipping state refresh")
+		return
+	}
+
+	client.Publish(app.getTopicPrefix()+"/status/alive", 0, true, "online")
+	app.updateVolume(client)
+	app.updateMute(client)
+	app.updateAudioDevices(client)
+	app.updateBattery(client)
+	app.updateCaffeinateStatus(client)
+	app.updateDisplayBrightness(client)
+	app.updateNowPlaying(client)
+	app.updateDiskUsage(client)
+	app.updateCPUUsage(client)
+	app.updateThroughput(client)
+	app.updateMemoryUsage(client)
+	app.updateProcesses(client)
+	app.updateRunningApps(client)
+	app.updateBluetooth(client)
+	app.updateUptime(client)
+	app.updateMediaDevices(client)
+	app.updatePublicIP(client)
+	app.updateNetworkInfo(client)
+	app.publishPresence(client)
+	app.publishScreenLocked(client)
+	app.publishFrontmostApp(client)
+	app.publishProbes(client)
+	app.publishProfile(client)
+}
+
+// IdleTimeProvider reports how long the user has been idle
+type IdleTimeProvider interface {
+	IdleTime() (time.Duration, error)
+}
+
+// newIdleTimeProvider returns the idle time provider for the current platform
+func newIdleTimeProvider() IdleTimeProvider {
+	if runtime.GOOS == "linux" {
+		return &linuxIdleTimeProvider{}
+	}
+	return &ioregIdleTimeProvider{}
+}
+
+// ioregIdleTimeProvider reads HIDIdleTime from the IOHIDSystem registry entry on macOS
+type ioregIdleTimeProvider struct{}
+
+// IdleTime returns the time since the last keyboard or mouse input
+func (p *ioregIdleTimeProvider) IdleTime() (time.Duration, error) {
+	output, err := exec.Command("ioreg", "-c", "IOHIDSystem").Output()
+	if err != nil {
+		return 0, fmt.Errorf("error running ioreg: %w", err)
+	}
+	return parseIoregIdleTime(string(output))
+}
+
+// parseIoregIdleTime parses the HIDIdleTime (in nanoseconds) from ioreg output
+func parseIoregIdleTime(output string) (time.Duration, error) {
+	re := regexp.MustCompile(`"HIDIdleTime" = (\d+)`)
+	matches := re.FindStringSubmatch(output)
+	if len(matches) < 2 {
+		return 0, fmt.Errorf("HIDIdleTime not found in ioreg output")
+	}
+
+	idleTimeNanos, err := strconv.ParseInt(matches[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing idle time: %w", err)
+	}
+	return time.Duration(idleTimeNanos), nil
+}
+
+// linuxIdleTimeProvider uses xprintidle on X11 and falls back to the logind idle hint
+type linuxIdleTimeProvider struct{}
+
+// IdleTime returns the time since the last user input
+func (p *linuxIdleTimeProvider) IdleTime() (time.Duration, error) {
+	if os.Getenv("DISPLAY") != "" {
+		if output, err := exec.Command("xprintidle").Output(); err == nil {
+			return parseXprintidleOutput(string(output))
+		}
+	}
+
+	session := os.Getenv("XDG_SESSION_ID")
+	if session == "" {
+		session = "self"
+	}
+	output, err := exec.Command("loginctl", "show-session", session, "-p", "IdleHint", "-p", "IdleSinceHint").Output()
+	if err != nil {
+		return 0, fmt.Errorf("error running loginctl: %w", err)
+	}
+	return parseLoginctlIdleTime(string(output), time.Now())
+}
+
+// parseXprintidleOutput parses the idle time in milliseconds printed by xprintidle
+func parseXprintidleOutput(output string) (time.Duration, error) {
+	idleTimeMillis, err := strconv.ParseInt(strings.TrimSpace(output), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing xprintidle output: %w", err)
+	}
+	return time.Duration(idleTimeMillis) * time.Millisecond, nil
+}
+
+// parseLoginctlIdleTime parses IdleHint and IdleSinceHint (microseconds since epoch)
+// from loginctl show-session output
+func parseLoginctlIdleTime(output string, now time.Time) (time.Duration, error) {
+	values := map[string]string{}
+	for _, line := range strings.Split(output, "\n") {
+		if key, value, ok := strings.Cut(strings.TrimSpace(line), "="); ok {
+			values[key] = value
+		}
+	}
+
+	idleHint, ok := values["IdleHint"]
+	if !ok {
+		return 0, fmt.Errorf("IdleHint not found in loginctl output")
+	}
+	if idleHint != "yes" {
+		return 0, nil
+	}
+
+	idleSinceMicros, err := strconv.ParseInt(values["IdleSinceHint"], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing IdleSinceHint: %w", err)
+	}
+	idleTime := now.Sub(time.UnixMicro(idleSinceMicros))
+	if idleTime < 0 {
+		return 0, nil
+	}
+	return idleTime, nil
+}
+
+// startUserActivityMonitoring starts monitoring user activity using system idle time.
+func (app *Application) startUserActivityMonitoring(client mqtt.Client) {
+	app.activityOnce.Do(func() {
+		log.Println("Starting user activity monitoring...")
+		go app.monitorUserActivity(client)
+		log.Println("User activity monitoring started successfully")
+	})
+}
+
+// monitorUserActivity publishes user_activity on state transitions and idle_time_seconds
+// on transitions and every idle_time_interval seconds
+func (app *Application) monitorUserActivity(client mqtt.Client) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Activity monitor goroutine recovered from panic: %v", r)
+		}
+	}()
+
+	threshold := time.Duration(app.config.IdleActivityTime) * time.Second
+	var lastIdlePublish time.Time
+
+	for {
+		// Check if client is still connected
+		if client == nil || !client.IsConnected() {
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		idleTime, changed, err := app.checkUserActivity(client, threshold)
+		if err != nil {
+			log.Printf("Error getting system idle time: %v", err)
+			time.Sleep(IdleErrorRetryInterval)
+			continue
+		}
+
+		idleTimeInterval := app.getInterval("idle_time", time.Duration(app.config.IdleTimeInterval)*time.Second)
+		if changed || time.Since(lastIdlePublish) >= idleTimeInterval {
+			client.Publish(app.getTopicPrefix()+"/status/idle_time_seconds", 0, false, strconv.Itoa(int(idleTime.Seconds())))
+			lastIdlePublish = time.Now()
+		}
+
+		pollInterval := app.getInterval("activity", ActivityPollInterval)
+		time.Sleep(getNextActivityCheck(idleTime, threshold, pollInterval, idleTimeInterval-time.Since(lastIdlePublish)))
+	}
+}
+
+// checkUserActivity reads the idle time and updates the activity and presence states.
+// It returns the idle time and whether the activity state changed.
+func (app *Application) checkUserActivity(client mqtt.Client, threshold time.Duration) (time.Duration, bool, error) {
+	idleTime, err := app.idleProvider.IdleTime()
+	if err != nil {
+		return 0, false, err
+	}
+
+	state := "inactive"
+	if idleTime < threshold {
+		state = "active"
+	}
+
+	changed := app.setUserActivityState(client, state)
+	app.setIdleTime(client, idleTime)
+	return idleTime, changed, nil
+}
+
+// getNextActivityCheck returns how long to wait before the idle time needs to be read again.
+// While active nothing can change until the idle threshold is reached, while inactive
+// the idle time is polled so that returning activity is noticed quickly.
+func getNextActivityCheck(idleTime, threshold, pollInterval, untilIdlePublish time.Duration) time.Duration {
+	wait := pollInterval
+	if idleTime < threshold {
+		wait = threshold - idleTime
+	}
+	if untilIdlePublish < wait {
+		wait = untilIdlePublish
+	}
+	if wait < pollInterval {
+		wait = pollInterval
+	}
+	return wait
+}
+
+// publishMediaState publishes the current media state to MQTT
+func (app *Application) publishMediaState(client mqtt.Client, state, title, artist, album, appName string, duration, position int) {
+	// Publish individual attributes
+	client.Publish(app.getTopicPrefix()+"/status/media_state", 0, false, state)
+	client.Publish(app.getTopicPrefix()+"/status/media_title", 0, false, title)
+	client.Publish(app.getTopicPrefix()+"/status/media_artist", 0, false, artist)
+	client.Publish(app.getTopicPrefix()+"/status/media_album", 0, false, album)
+	client.Publish(app.getTopicPrefix()+"/status/media_app", 0, false, appName)
+	client.Publish(app.getTopicPrefix()+"/status/media_duration", 0, false, strconv.Itoa(duration))
+	client.Publish(app.getTopicPrefix()+"/status/media_position", 0, false, strconv.Itoa(position))
+
+	// Publish combined JSON state for media_player entity
+	mediaState := map[string]interface{}{
+		"state":        state,
+		"title":        title,
+		"artist":       artist,
+		"album":        album,
+		"app_name":     appName,
+		"duration":     duration,
+		"position":     position,
+		"media_title":  title,
+		"media_artist": artist,
+		"media_album":  album,
+	}
+
+	stateJSON, _ := json.Marshal(mediaState)
+	mediaPlayerTopic := app.getTopicPrefix() + "/status/media_player"
+	client.Publish(mediaPlayerTopic, 0, false, string(stateJSON))
+	log.Printf("Published media state to %s: %s", mediaPlayerTopic, string(stateJSON))
+}
+
+// updateDisplayBrightness updates the MQTT topics with current display brightness values
+func (app *Application) updateDisplayBrightness(client mqtt.Client) {
+	// Skip if no displays are available
+	if len(app.displays) == 0 {
+		return
+	}
+
+	// Refresh display list to handle dynamic display changes (laptop open/close)
+	currentDisplays := getDisplays()
+	if currentDisplays != nil {
+		app.displays = currentDisplays
+	}
+
+	for _, display := range app.displays {
+		brightness, err := getDisplayBrightness(display.DisplayID)
+		if err != nil {
+			// Only log error once per minute to avoid spam for unavailable displays (e.g., closed laptop)
+			if display.Name == "Built-in Display" || strings.Contains(display.Name, "Built-in") {
+				// Silently skip built-in display when unavailable (laptop closed)
+				continue
+			}
+			log.Printf("Error getting brightness for display %s: %v", display.Name, err)
+			// Check if it's a BetterDisplay CLI error
+			if !isBetterDisplayCLIAvailable() {
+				log.Printf("BetterDisplay CLI is not available for display %s", display.Name)
+			}
+			continue
+		}
+
+		statusTopic := app.getTopicPrefix() + "/status/display_" + display.DisplayID + "_brightness"
+		client.Publish(statusTopic, 0, true, strconv.Itoa(brightness))
+	}
+}
+
+func (app *Application) messagePubHandler(client mqtt.Client, msg mqtt.Message) {
+	log.Printf("Received message: %s from topic: %s\n", msg.Payload(), msg.Topic())
+	if app.client != nil {
+		client = app.client
+	}
+	app.listen(client, msg)
+}
+
+func (app *Application) connectHandler(client mqtt.Client) {
+	log.Println("Connected to MQTT")
+
+	// Publish through the profile client, the monitors started here keep it across profile switches
+	if app.client != nil {
+		client = app.client
+	}
+
+	// Set up device configuration (in case this is a reconnection)
+	app.setDevice(client)
+
+	token := client.Publish(app.getTopicPrefix()+"/status/alive", 0, true, "online")
+	token.Wait()
+
+	log.Println("Sending 'online' to topic: " + app.getTopicPrefix() + "/status/alive")
+	app.sub(client, app.getTopicPrefix()+"/command/#")
+
+	// Start media stream if not already running (for reconnections)
+	if isMediaControlAvailable() {
+		go app.startMediaStream(client)
+	}
+
+	// Start user activity monitoring
+	app.startUserActivityMonitoring(client)
+	app.startScreenLockMonitoring(client)
+	app.startFrontmostAppMonitoring(client)
+	app.startPowerEventMonitoring(client)
+	app.startPowerPolicyMonitoring(client)
+	app.startProbeMonitoring(client)
+
+	// Send initial state updates
+	app.updateVolume(client)
+	app.updateMute(client)
+	app.updateAudioDevices(client)
+	app.updateCaffeinateStatus(client)
+	app.updateDisplayBrightness(client)
+	app.updateNowPlaying(client)
+	app.setUserActivityState(client, "inactive") // Initial state
+	app.publishPresence(client)
+	app.publishProfile(client)
+}
+
+func (app *Application) connectLostHandler(_ mqtt.Client, err error) {
+	log.Printf("Disconnected from MQTT: %v", err)
+
+	// Check if it's a network issue
+	if !app.isNetworkReachable() {
+		log.Println("MQTT broker is not reachable - likely on a different network")
+		log.Println("Will retry connection when network becomes available")
+	} else {
+		log.Println("MQTT client will attempt to reconnect automatically...")
+	}
+}
+
+func (app *Application) getMQTTClient() error {
+	return app.getMQTTClientWithRetry(0)
+}
+
+// brokerConfig holds the MQTT broker settings of the active profile
+type brokerConfig struct {
+	IP       string
+	Port     string
+	User     string
+	Password string
+	SSL      bool
+}
+
+// getBrokerConfig returns the MQTT broker settings of the active profile
+func (app *Application) getBrokerConfig() brokerConfig {
+	app.profileMutex.RLock()
+	defer app.profileMutex.RUnlock()
+	return brokerConfig{
+		IP:       app.config.IP,
+		Port:     app.config.Port,
+		User:     app.config.User,
+		Password: app.config.Password,
+		SSL:      app.config.SSL,
+	}
+}
+
+// isNetworkReachable checks if the MQTT broker is reachable before attempting connection
+func (app *Application) isNetworkReachable() bool {
+	broker := app.getBrokerConfig()
+	// Try to connect to the broker with a short timeout
+	if _, err := measureTCPConnect(net.JoinHostPort(broker.IP, broker.Port), BrokerCheckTimeout); err != nil {
+		log.Printf("Network check failed: MQTT broker %s:%s is not reachable (%v)", broker.IP, broker.Port, err)
+		return false
+	}
+	return true
+}
+
+// measureTCPConnect opens and closes a TCP connection and returns how long connecting took
+func measureTCPConnect(address string, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return 0, err
+	}
+	elapsed := time.Since(start)
+	conn.Close()
+	return elapsed, nil
+}
+
+func (app *Application) getMQTTClientWithRetry(retryCount int) error {
+	// Prevent infinite recursion
+	if retryCount > MaxRetryAttempts {
+		return fmt.Errorf("failed to connect to MQTT broker after multiple attempts")
+	}
+
+	// Check network reachability first to avoid long timeouts
+	if !app.isNetworkReachable() {
+		log.Printf("MQTT broker is not reachable on current network, will retry later")
+		return fmt.Errorf("MQTT broker not reachable")
+	}
+
+	opts := mqtt.NewClientOptions()
+	broker := app.getBrokerConfig()
+
+	// Determine protocol and broker URL
+	protocol := "tcp"
+	if broker.SSL {
+		protocol = "ssl"
+	}
+	brokerURL := fmt.Sprintf("%s://%s:%s", protocol, broker.IP, broker.Port)
+	log.Printf("Connecting to MQTT broker: %s", brokerURL)
+
+	opts.AddBroker(brokerURL)
+	if broker.User != "" {
+		opts.SetUsername(broker.User)
+	}
+	if broker.Password != "" {
+		opts.SetPassword(broker.Password)
+	}
+
+	// Set up handlers with application context
+	opts.OnConnect = app.connectHandler
+	opts.OnConnectionLost = app.connectLostHandler
+	opts.SetDefaultPublishHandler(app.messagePubHandler)
+
+	// Set client ID to ensure unique identification with timestamp to avoid conflicts
+	clientID := fmt.Sprintf("%s_mac2mqtt_%d", app.hostname, time.Now().Unix())
+	opts.SetClientID(clientID)
+
+	// Network-aware connection reliability settings
+	opts.SetClientID(app.hostname + "_mac2mqtt")
+	opts.SetKeepAlive(60 * time.Second)      // Send ping every 60 seconds
+	opts.SetPingTimeout(10 * time.Second)    // Shorter ping timeout for faster network change detection
+	opts.SetConnectTimeout(15 * time.Second) // Shorter connect timeout for network switching
+	opts.SetAutoReconnect(true)              // Enable auto-reconnect
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(15 * time.Second) // Wait 15 seconds between retries (good for network switches)
+	opts.SetMaxReconnectInterval(2 * time.Minute)  // Max 2 minutes between reconnect attempts (faster recovery)
+	opts.SetCleanSession(false)                    // Resume session to avoid losing subscriptions
+	opts.SetOrderMatters(false)                    // Allow out-of-order delivery for better performance
+	opts.SetWriteTimeout(10 * time.Second)         // Shorter write timeout for network issues
+	opts.SetResumeSubs(true)                       // Resume subscriptions on reconnect
+
+	// Set will message
+	opts.SetWill(app.getTopicPrefix()+"/status/alive", "offline", 0, true)
+
+	// Set the client before connecting, the connect handler runs as soon as the connection is up
+	client := mqtt.NewClient(opts)
+	app.setMQTTClient(client)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		// If SSL connection fails, try falling back to non-SSL
+		if broker.SSL {
+			log.Printf("SSL connection failed: %v. Trying non-SSL connection...", token.Error())
+			app.profileMutex.Lock()
+			app.config.SSL = false
+			app.profileMutex.Unlock()
+			return app.getMQTTClientWithRetry(retryCount + 1)
+		}
+		return fmt.Errorf("failed to connect to MQTT broker: %w", token.Error())
+	}
+
+	return nil
+}
+
+// setMQTTClient makes client the client behind app.client
+func (app *Application) setMQTTClient(client mqtt.Client) {
+	if current, ok := app.client.(*profileClient); ok {
+		current.set(client)
+		return
+	}
+	app.client = &profileClient{app: app, client: client}
+}
+
+// profileClient forwards to the MQTT client of the active profile. It stays the same when a
+// profile switch replaces the client, so the monitors that hold on to it keep publishing.
+// Publishes to the topics of sensor groups that the active profile disables are dropped.
+type profileClient struct {
+	app    *Application
+	mutex  sync.RWMutex
+	client mqtt.Client
+}
+
+func (c *profileClient) current() mqtt.Client {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.client
+}
+
+func (c *profileClient) set(client mqtt.Client) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.client = client
+}
+
+func (c *profileClient) IsConnected() bool      { return c.current().IsConnected() }
+func (c *profileClient) IsConnectionOpen() bool { return c.current().IsConnectionOpen() }
+func (c *profileClient) Connect() mqtt.Token    { return c.current().Connect() }
+func (c *profileClient) Disconnect(quiesce uint) {
+	c.current().Disconnect(quiesce)
+}
+
+func (c *profileClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	if !c.app.isTopicEnabled(topic) {
+		return doneToken{}
+	}
+	return c.current().Publish(topic, qos, retained, payload)
+}
+
+func (c *profileClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return c.current().Subscribe(topic, qos, callback)
+}
+
+func (c *profileClient) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	return c.current().SubscribeMultiple(filters, callback)
+}
+
+func (c *profileClient) Unsubscribe(topics ...string) mqtt.Token {
+	return c.current().Unsubscribe(topics...)
+}
+
+func (c *profileClient) AddRoute(topic string, callback mqtt.MessageHandler) {
+	c.current().AddRoute(topic, callback)
+}
+
+func (c *profileClient) OptionsReader() mqtt.ClientOptionsReader {
+	return c.current().OptionsReader()
+}
+
+// doneToken is the token of a dropped publish
+type doneToken struct{}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Error() error                   { return nil }
+func (doneToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+// sensorGroups maps the names used in the sensors setting to the topics they publish, relative to the topic prefix.
+// Topics that are not in a group, like the keep awake state, are always published.
+var sensorGroups = []struct {
+	name   string
+	topics *regexp.Regexp
+}{
+	{"volume", regexp.MustCompile(`^/status/(volume|mute|input_volume|input_mute|audio_output|audio_input)$`)},
+	{"battery", regexp.MustCompile(`^/status/battery(/|$)`)},
+	{"disk", regexp.MustCompile(`^/status/disk/`)},
+	{"throughput", regexp.MustCompile(`^/status/(network/[^/]+/(rx|tx)_rate|disk_io/)`)},
+	{"cpu", regexp.MustCompile(`^/status/cpu/`)},
+	{"memory", regexp.MustCompile(`^/status/memory/`)},
+	{"processes", regexp.MustCompile(`^/(status/processes/|events/process$)`)},
+	{"apps", regexp.MustCompile(`^/status/apps/`)},
+	{"bluetooth", regexp.MustCompile(`^/status/bluetooth/`)},
+	{"uptime", regexp.MustCompile(`^/status/uptime/`)},
+	{"public_ip", regexp.MustCompile(`^/status/public_ip(v6|_attr)?$`)},
+	{"network", regexp.MustCompile(`^/(status/(network|wifi)/|events/network$)`)},
+	{"probes", regexp.MustCompile(`^/status/probe/`)},
+	{"media_devices", regexp.MustCompile(`^/status/(microphone|camera)$`)},
+	{"media", regexp.MustCompile(`^/(status/(media_|now_playing)|events/track_played$)`)},
+	{"presence", regexp.MustCompile(`^/status/(presence|user_activity|idle_time)`)},
+	{"screen_lock", regexp.MustCompile(`^/status/screen_locked$`)},
+	{"frontmost_app", regexp.MustCompile(`^/status/frontmost_`)},
+	{"power_events", regexp.MustCompile(`^/(status/last_wake$|events/power$)`)},
+}
+
+// isTopicEnabled reports whether a topic belongs to a sensor group that the active profile publishes
+func (app *Application) isTopicEnabled(topic string) bool {
+	prefix := app.getTopicPrefix()
+	if !strings.HasPrefix(topic, prefix+"/") {
+		return true
+	}
+	topic = strings.TrimPrefix(topic, prefix)
+
+	app.profileMutex.RLock()
+	sensors := app.config.Sensors
+	app.profileMutex.RUnlock()
+	if len(sensors) == 0 {
+		return true
+	}
+
+	for _, group := range sensorGroups {
+		if !group.topics.MatchString(topic) {
+			continue
+		}
+		for _, name := range sensors {
+			if name == group.name {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// isCommandAllowed reports whether the active profile accepts a command. The commands setting lists
+// command topics (volume, set, app, ...), display brightness as brightness, or single command/set
+// actions like lock.
+func (app *Application) isCommandAllowed(topic, payload string) bool {
+	app.profileMutex.RLock()
+	commands := app.config.Commands
+	app.profileMutex.RUnlock()
+	if len(commands) == 0 {
+		return true
+	}
+
+	name := strings.TrimPrefix(topic, app.getTopicPrefix()+"/command/")
+	name, _, _ = strings.Cut(name, "/")
+	if strings.HasPrefix(name, "display_") {
+		name = "brightness"
+	}
+	for _, command := range commands {
+		if command == name || (name == "set" && command == payload) {
+			return true
+		}
+	}
+	return false
+}
+
+// isComponentEnabled reports whether a discovery component is published by the active profile
+func (app *Application) isComponentEnabled(component map[string]interface{}) bool {
+	if stateTopic, ok := component["state_topic"].(string); ok {
+		return app.isTopicEnabled(stateTopic)
+	}
+	if commandTopic, ok := component["command_topic"].(string); ok {
+		payload, _ := component["payload_press"].(string)
+		return app.isCommandAllowed(commandTopic, payload)
+	}
+	return true
+}
+
+// getProfileName returns the name of the active profile
+func (app *Application) getProfileName() string {
+	app.profileMutex.RLock()
+	defer app.profileMutex.RUnlock()
+	return app.profile
+}
+
+// selectProfile returns the first profile that matches the network, nil when none matches
+func (app *Application) selectProfile(info *NetworkInfo) *profileConfig {
+	var ssid, gatewayMAC string
+	if info != nil {
+		ssid = info.SSID
+		if info.Gateway != "" {
+			gatewayMAC = getGatewayMAC(info.Gateway)
+		}
+	}
+
+	for i := range app.baseConfig.Profiles {
+		profile := &app.baseConfig.Profiles[i]
+		if profileMatchesNetwork(profile, ssid, gatewayMAC) {
+			return profile
+		}
+		if profile.BrokerReachable && isBrokerReachable(app.getProfileBroker(profile)) {
+			return profile
+		}
+	}
+	return nil
+}
+
+// getProfileBroker returns the broker address of a profile, falling back to mqtt_ip and mqtt_port
+func (app *Application) getProfileBroker(profile *profileConfig) string {
+	ip, port := app.baseConfig.IP, app.baseConfig.Port
+	if profile.IP != "" {
+		ip = profile.IP
+	}
+	if profile.Port != "" {
+		port = profile.Port
+	}
+	return net.JoinHostPort(ip, port)
+}
+
+// profileMatchesNetwork reports whether a profile matches the SSID or gateway MAC address.
+// A profile without any criteria always matches.
+func profileMatchesNetwork(profile *profileConfig, ssid, gatewayMAC string) bool {
+	if len(profile.SSIDs) == 0 && len(profile.GatewayMACs) == 0 && !profile.BrokerReachable {
+		return true
+	}
+	if ssid != "" {
+		for _, profileSSID := range profile.SSIDs {
+			if profileSSID == ssid {
+				return true
+			}
+		}
+	}
+	if gatewayMAC != "" {
+		for _, mac := range profile.GatewayMACs {
+			if normalizeMAC(mac) == gatewayMAC {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isBrokerReachable reports whether a broker accepts TCP connections
+func isBrokerReachable(address string) bool {
+	_, err := measureTCPConnect(address, BrokerCheckTimeout)
+	return err == nil
+}
+
+// getGatewayMAC returns the MAC address of the gateway from the ARP cache, empty when unknown
+func getGatewayMAC(gateway string) string {
+	output, err := exec.Command("/usr/sbin/arp", "-n", gateway).Output()
+	if err != nil {
+		return ""
+	}
+	return parseArpMAC(string(output))
+}
+
+// arpMACPattern matches the MAC address in arp -n output
+var arpMACPattern = regexp.MustCompile(` at ([0-9a-fA-F]{1,2}(?::[0-9a-fA-F]{1,2}){5}) on `)
+
+// parseArpMAC parses the MAC address from arp -n output:
+//
+//	? (192.168.1.1) at 0:11:22:33:44:55 on en0 ifscope [ethernet]
+func parseArpMAC(output string) string {
+	match := arpMACPattern.FindStringSubmatch(output)
+	if match == nil {
+		return ""
+	}
+	return normalizeMAC(match[1])
+}
+
+// normalizeMAC lowercases a MAC address and pads every octet to two digits, arp leaves out leading zeros
+func normalizeMAC(mac string) string {
+	octets := strings.Split(strings.ToLower(strings.ReplaceAll(mac, "-", ":")), ":")
+	for i, octet := range octets {
+		if len(octet) == 1 {
+			octets[i] = "0" + octet
+		}
+	}
+	return strings.Join(octets, ":")
+}
+
+// applyProfile makes a profile active, nil for the configuration without overrides.
+// It returns whether the broker or topic changed, which needs a new connection.
+func (app *Application) applyProfile(profile *profileConfig) bool {
+	settings := app.baseConfig
+	name := DefaultProfileName
+	if profile != nil {
+		name = profile.Name
+		if profile.IP != "" {
+			settings.IP = profile.IP
+		}
+		if profile.Port != "" {
+			settings.Port = profile.Port
+		}
+		if profile.User != "" {
+			settings.User = profile.User
+		}
+		if profile.Password != "" {
+			settings.Password = profile.Password
+		}
+		if profile.SSL != nil {
+			settings.SSL = *profile.SSL
+		}
+		if profile.Topic != "" {
+			settings.Topic = profile.Topic
+		}
+		if profile.Sensors != nil {
+			settings.Sensors = profile.Sensors
+		}
+		if profile.Commands != nil {
+			settings.Commands = profile.Commands
+		}
+		if profile.PublicIP != nil {
+			settings.PublicIP = *profile.PublicIP
+		}
+	}
+
+	// The public IP may be different on the new network
+	app.clearPublicIPCache()
+
+	// Append hostname to the topic to allow multiple instances
+	topic := DefaultTopicPrefix + "/" + app.hostname
+	if settings.Topic != "" {
+		topic = settings.Topic + "/" + app.hostname
+	}
+
+	app.profileMutex.Lock()
+	defer app.profileMutex.Unlock()
+
+	changed := app.config.IP != settings.IP || app.config.Port != settings.Port ||
+		app.config.User != settings.User || app.config.Password != settings.Password ||
+		app.config.SSL != settings.SSL || app.topic != topic
+
+	app.config.IP = settings.IP
+	app.config.Port = settings.Port
+	app.config.User = settings.User
+	app.config.Password = settings.Password
+	app.config.SSL = settings.SSL
+	app.config.Topic = settings.Topic
+	app.config.Sensors = settings.Sensors
+	app.config.Commands = settings.Commands
+	app.config.PublicIP = settings.PublicIP
+	app.topic = topic
+	app.profile = name
+	return changed
+}
+
+// startProfileSelection selects the profile of the current network location in the background and sends it to
+// profileSelection. The ARP lookup and broker checks would otherwise block the main loop for seconds.
+func (app *Application) startProfileSelection() {
+	if len(app.baseConfig.Profiles) == 0 {
+		return
+	}
+
+	app.profileMutex.Lock()
+	if app.profileSelecting {
+		app.profileMutex.Unlock()
+		return
+	}
+	app.profileSelecting = true
+	app.profileMutex.Unlock()
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("Profile selection goroutine recovered from panic: %v", r)
+			}
+			app.profileMutex.Lock()
+			app.profileSelecting = false
+			app.profileMutex.Unlock()
+		}()
+
+		app.profileSelection <- app.selectProfile(app.getNetworkInfoSnapshot())
+	}()
+}
+
+// updateProfile switches to the selected profile, nil for the configuration without overrides
+func (app *Application) updateProfile(profile *profileConfig) {
+	name := DefaultProfileName
+	if profile != nil {
+		name = profile.Name
+	}
+
+	if name != app.getProfileName() {
+		log.Printf("Switching from profile %s to profile %s", app.getProfileName(), name)
+		previousPrefix := app.getTopicPrefix()
+		connected := app.isClientConnected()
+
+		if app.applyProfile(profile) {
+			// Connect again, so the will, the subscription and discovery use the new broker and topic
+			if connected {
+				app.client.Publish(previousPrefix+"/status/alive", 0, true, "offline").Wait()
+			}
+			if app.client != nil {
+				app.client.Disconnect(250)
+			}
+			app.profileReconnect = true
+		} else if connected {
+			// Only the sensors or commands changed
+			app.setDevice(app.client)
+			app.refreshState(app.client)
+			app.publishProfile(app.client)
+		}
+	}
+
+	if app.profileReconnect {
+		if err := app.getMQTTClient(); err != nil {
+			log.Printf("Failed to connect with profile %s: %v", name, err)
+			return
+		}
+		app.profileReconnect = false
+	}
+}
+
+// publishProfile publishes the name of the active profile
+func (app *Application) publishProfile(client mqtt.Client) {
+	if client == nil || !client.IsConnected() {
+		return
+	}
+	client.Publish(app.getTopicPrefix()+"/status/profile", 0, false, app.getProfileName())
+}
+
+func (app *Application) sub(client mqtt.Client, topic string) {
+	token := client.Subscribe(topic, 0, nil)
+	token.Wait()
+	log.Printf("Subscribed to topic: %s\n", topic)
+}
+
+func (app *Application) listen(client mqtt.Client, msg mqtt.Message) {
+	topic := msg.Topic()
+	payload := string(msg.Payload())
+
+	// Ignore commands that the active profile doesn't accept
+	if !app.isCommandAllowed(topic, payload) {
+		log.Printf("Command %s is not allowed in profile %s, ignoring it", topic, app.getProfileName())
+		return
+	}
+
+	// Handle volume commands
+	if app.handleVolumeCommand(client, topic, payload) {
+		return
+	}
+
+	// Handle mute commands
+	if app.handleMuteCommand(client, topic, payload) {
+		return
+	}
+
+	// Handle audio device, input volume and input mute commands
+	if app.handleAudioCommand(client, topic, payload) {
+		return
+	}
+
+	// Handle system commands
+	if app.handleSystemCommand(topic, payload) {
+		return
 	}
 
 	// Handle display brightness commands
@@ -1282,495 +3935,3403 @@ func (app *Application) listen(client mqtt.Client, msg mqtt.Message) {
 		return
 	}
 
-	// Handle shortcut commands
-	if app.handleShortcutCommand(topic, payload) {
-		return
+	// Handle shortcut commands
+	if app.handleShortcutCommand(topic, payload) {
+		return
+	}
+
+	// Handle keep awake commands
+	if app.handleKeepAwakeCommand(client, topic, payload) {
+		return
+	}
+
+	// Handle play/pause commands
+	if app.handlePlayPauseCommand(client, topic, payload) {
+		return
+	}
+
+	// Handle app commands
+	if app.handleAppCommand(client, topic, payload) {
+		return
+	}
+
+	// Handle Bluetooth commands
+	if app.handleBluetoothCommand(client, topic, payload) {
+		return
+	}
+}
+
+// handleVolumeCommand handles volume control commands
+func (app *Application) handleVolumeCommand(client mqtt.Client, topic, payload string) bool {
+	if topic != app.getTopicPrefix()+"/command/volume" {
+		return false
+	}
+
+	command, err := app.parseVolumeCommand(payload)
+	if err != nil {
+		log.Printf("Invalid volume value: %v", err)
+		return true
+	}
+
+	// A new command replaces a running fade
+	app.stopVolumeFade()
+
+	volume := command.Volume
+	switch {
+	case command.Fade > 0:
+		if err := app.startVolumeFade(client, volume, command.Fade); err != nil {
+			log.Printf("Cannot fade the volume: %v", err)
+		}
+		return true
+	case command.Relative:
+		current, err := app.getCurrentVolume()
+		if err != nil {
+			log.Printf("Cannot change the volume by %+d, the current volume is unknown: %v", command.Volume, err)
+			return true
+		}
+		volume = min(max(current+command.Volume, MinVolume), MaxVolume)
+	}
+
+	app.setVolume(volume)
+	app.rememberOutputVolume(volume)
+	app.updateVolume(client)
+	app.updateMute(client)
+	return true
+}
+
+// VolumeCommand is a parsed command/volume payload
+type VolumeCommand struct {
+	Volume   int           // the volume, or the change of the volume when Relative is set
+	Relative bool          // the payload was a step like +5 or -10
+	Fade     time.Duration // fade to Volume over this time instead of setting it at once
+}
+
+// volumeFadePattern matches fade payloads like "fade to 20 over 30s" or "fade 20 in 5m"
+var volumeFadePattern = regexp.MustCompile(`(?i)^fade\s+(?:to\s+)?(\S+)\s+(?:over|in)\s+(\S+)$`)
+
+// parseVolumeCommand parses an absolute volume (20), a step (+5, -10) or a fade (fade to 20 over 30s)
+func (app *Application) parseVolumeCommand(payload string) (VolumeCommand, error) {
+	payload = strings.TrimSpace(payload)
+
+	if strings.HasPrefix(payload, "+") || strings.HasPrefix(payload, "-") {
+		step, err := strconv.Atoi(payload)
+		if err != nil {
+			return VolumeCommand{}, fmt.Errorf("volume step must be a number: %w", err)
+		}
+		if step < -MaxVolume || step > MaxVolume {
+			return VolumeCommand{}, fmt.Errorf("volume step must be between -%d and +%d, got %d", MaxVolume, MaxVolume, step)
+		}
+		return VolumeCommand{Volume: step, Relative: true}, nil
+	}
+
+	fade := volumeFadePattern.FindStringSubmatch(payload)
+	if fade != nil {
+		volume, err := app.validateVolumeInput(fade[1])
+		if err != nil {
+			return VolumeCommand{}, err
+		}
+		duration, err := parseFadeDuration(fade[2])
+		if err != nil {
+			return VolumeCommand{}, err
+		}
+		return VolumeCommand{Volume: volume, Fade: duration}, nil
+	}
+
+	volume, err := app.validateVolumeInput(payload)
+	if err != nil {
+		return VolumeCommand{}, err
+	}
+	return VolumeCommand{Volume: volume}, nil
+}
+
+// parseFadeDuration parses a fade duration like 30s or 15m, a number without unit is in seconds
+func parseFadeDuration(s string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(s); err == nil {
+		s = strconv.Itoa(seconds) + "s"
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid fade duration %q: %w", s, err)
+	}
+	if duration <= 0 || duration > MaxVolumeFadeDuration {
+		return 0, fmt.Errorf("fade duration must be between 0 and %s, got %s", MaxVolumeFadeDuration, duration)
+	}
+	return duration, nil
+}
+
+// getFadeVolume returns the volume of a linear fade after elapsed of duration
+func getFadeVolume(from, to int, elapsed, duration time.Duration) int {
+	if elapsed >= duration {
+		return to
+	}
+	progress := float64(elapsed) / float64(duration)
+	return from + int(math.Round(float64(to-from)*progress))
+}
+
+// startVolumeFade fades the volume from the current volume to target.
+// It fails when the current volume is unknown, the fade would start from a wrong level.
+func (app *Application) startVolumeFade(client mqtt.Client, target int, duration time.Duration) error {
+	from, err := app.getCurrentVolume()
+	if err != nil {
+		return fmt.Errorf("the current volume is unknown: %w", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	app.audioMutex.Lock()
+	app.volumeFadeCancel = cancel
+	app.audioMutex.Unlock()
+
+	log.Printf("Fading volume from %d to %d over %s", from, target, duration)
+	go app.fadeVolume(ctx, client, from, target, duration)
+	return nil
+}
+
+// stopVolumeFade stops the running volume fade, if any
+func (app *Application) stopVolumeFade() {
+	app.audioMutex.Lock()
+	defer app.audioMutex.Unlock()
+	if app.volumeFadeCancel != nil {
+		app.volumeFadeCancel()
+		app.volumeFadeCancel = nil
+	}
+}
+
+// fadeVolume changes the volume step by step until the fade is done or stopped
+func (app *Application) fadeVolume(ctx context.Context, client mqtt.Client, from, to int, duration time.Duration) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Volume fade goroutine recovered from panic: %v", r)
+		}
+	}()
+
+	ticker := time.NewTicker(VolumeFadeInterval)
+	defer ticker.Stop()
+
+	start := time.Now()
+	volume := from
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("Volume fade stopped at %d", volume)
+			return
+		case <-ticker.C:
+		}
+
+		elapsed := time.Since(start)
+		if next := getFadeVolume(from, to, elapsed, duration); next != volume {
+			volume = next
+			app.setVolume(volume)
+			if client != nil && client.IsConnected() {
+				client.Publish(app.getTopicPrefix()+"/status/volume", 0, false, strconv.Itoa(volume))
+			}
+		}
+		if elapsed >= duration {
+			break
+		}
+	}
+
+	log.Printf("Volume fade to %d finished", to)
+	app.rememberOutputVolume(to)
+	if client != nil && client.IsConnected() {
+		app.updateVolume(client)
+		app.updateMute(client)
+	}
+}
+
+// rememberOutputVolume remembers the volume of the current output device
+func (app *Application) rememberOutputVolume(volume int) {
+	app.audioMutex.Lock()
+	defer app.audioMutex.Unlock()
+	if app.outputDevice == "" {
+		return
+	}
+	if app.deviceVolumes == nil {
+		app.deviceVolumes = make(map[string]int)
+	}
+	app.deviceVolumes[app.outputDevice] = volume
+}
+
+// switchOutputDevice records the current output device. It reports whether the device changed,
+// and returns the volume remembered for the new device when there is one.
+func (app *Application) switchOutputDevice(device string) (volume int, remembered bool, changed bool) {
+	app.audioMutex.Lock()
+	defer app.audioMutex.Unlock()
+	previous := app.outputDevice
+	app.outputDevice = device
+	if previous == "" || previous == device {
+		return 0, false, false
+	}
+	volume, remembered = app.deviceVolumes[device]
+	return volume, remembered, true
+}
+
+// updateOutputVolumeMemory restores the remembered volume when the output device changed,
+// otherwise it remembers the current volume of the device
+func (app *Application) updateOutputVolumeMemory(device string) {
+	volume, remembered, changed := app.switchOutputDevice(device)
+	if changed {
+		if remembered {
+			log.Printf("Output device changed to %s, restoring its volume %d", device, volume)
+			app.setVolume(volume)
+		}
+		return
+	}
+
+	current, err := app.getCurrentVolume()
+	if err != nil {
+		log.Printf("Error getting the volume of %s: %v", device, err)
+		return
+	}
+	app.rememberOutputVolume(current)
+}
+
+// handleMuteCommand handles mute control commands
+func (app *Application) handleMuteCommand(client mqtt.Client, topic, payload string) bool {
+	if topic != app.getTopicPrefix()+"/command/mute" {
+		return false
+	}
+
+	mute, err := app.validateMuteInput(payload)
+	if err != nil {
+		log.Printf("Invalid mute value: %v", err)
+		return true
+	}
+
+	app.setMute(mute)
+	app.updateVolume(client)
+	app.updateMute(client)
+	return true
+}
+
+// handleAudioCommand handles audio device selection, input volume and input mute commands
+func (app *Application) handleAudioCommand(client mqtt.Client, topic, payload string) bool {
+	switch topic {
+	case app.getTopicPrefix() + "/command/audio_output", app.getTopicPrefix() + "/command/audio_input":
+		deviceType := strings.TrimPrefix(topic, app.getTopicPrefix()+"/command/audio_")
+		known := false
+		for _, name := range app.getAudioDeviceNames(deviceType) {
+			if name == payload {
+				known = true
+				break
+			}
+		}
+		if !known {
+			log.Printf("Unknown audio %s device: %s", deviceType, payload)
+			return true
+		}
+		if err := app.setAudioDevice(deviceType, payload); err != nil {
+			log.Printf("Failed to switch audio device: %v", err)
+		}
+
+	case app.getTopicPrefix() + "/command/input_volume":
+		volume, err := app.validateVolumeInput(payload)
+		if err != nil {
+			log.Printf("Invalid input volume value: %v", err)
+			return true
+		}
+		if err := setInputVolume(volume); err != nil {
+			log.Printf("Failed to set input volume: %v", err)
+		}
+
+	case app.getTopicPrefix() + "/command/input_mute":
+		mute, err := app.validateMuteInput(payload)
+		if err != nil {
+			log.Printf("Invalid input mute value: %v", err)
+			return true
+		}
+		if err := app.setInputMute(mute); err != nil {
+			log.Printf("Failed to set input mute: %v", err)
+		}
+
+	default:
+		return false
+	}
+
+	app.updateAudioDevices(client)
+	app.updateVolume(client)
+	app.updateMute(client)
+	return true
+}
+
+// handleSystemCommand handles system control commands
+func (app *Application) handleSystemCommand(topic, payload string) bool {
+	if topic != app.getTopicPrefix()+"/command/set" {
+		return false
+	}
+
+	switch payload {
+	case "sleep":
+		commandSleep()
+	case "displaysleep":
+		commandDisplaySleep()
+	case "displaywake":
+		commandDisplayWake()
+	case "shutdown":
+		commandShutdown()
+	case "screensaver":
+		commandScreensaver()
+	case "lock":
+		commandLockScreen()
+	default:
+		log.Printf("Unknown system command: %s", payload)
+	}
+	return true
+}
+
+// handleDisplayBrightnessCommand handles display brightness commands
+func (app *Application) handleDisplayBrightnessCommand(client mqtt.Client, topic, payload string) bool {
+	// Check if we have any displays available
+	if len(app.displays) == 0 {
+		log.Printf("Received display brightness command but no displays are available")
+		log.Printf("Topic: %s, Payload: %s", topic, payload)
+		log.Println("This usually means BetterDisplay CLI is not installed or not accessible")
+		return true // Return true to indicate we handled the command
+	}
+
+	for _, display := range app.displays {
+		commandTopic := app.getTopicPrefix() + "/command/display_" + display.DisplayID + "_brightness"
+		if topic == commandTopic {
+			brightness, err := app.validateBrightnessInput(payload)
+			if err != nil {
+				log.Printf("Invalid brightness value for display %s: %v", display.Name, err)
+				return true
+			}
+
+			err = setDisplayBrightness(display.DisplayID, brightness)
+			if err != nil {
+				log.Printf("Error setting brightness for display %s: %v", display.Name, err)
+				// Check if it's a BetterDisplay CLI error
+				if !isBetterDisplayCLIAvailable() {
+					log.Println("BetterDisplay CLI is not available. Please install BetterDisplay and enable CLI access.")
+				}
+			} else {
+				// Update the status immediately
+				statusTopic := app.getTopicPrefix() + "/status/display_" + display.DisplayID + "_brightness"
+				client.Publish(statusTopic, 0, true, strconv.Itoa(brightness))
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// handleShortcutCommand handles shortcut execution commands
+func (app *Application) handleShortcutCommand(topic, payload string) bool {
+	if topic != app.getTopicPrefix()+"/command/runshortcut" {
+		return false
+	}
+
+	if err := app.validateShortcutInput(payload); err != nil {
+		log.Printf("Invalid shortcut: %v", err)
+		return true
+	}
+
+	commandRunShortcut(payload)
+	return true
+}
+
+// handleKeepAwakeCommand handles keep awake commands
+func (app *Application) handleKeepAwakeCommand(client mqtt.Client, topic, payload string) bool {
+	if topic != app.getTopicPrefix()+"/command/keepawake" {
+		return false
+	}
+
+	keepAwake, err := app.validateKeepAwakeInput(payload)
+	if err != nil {
+		log.Printf("Invalid keep awake value: %v", err)
+		return true
+	}
+
+	if keepAwake {
+		commandKeepAwake()
+	} else {
+		commandAllowSleep()
+	}
+	app.updateCaffeinateStatus(client)
+	return true
+}
+
+// handlePlayPauseCommand handles play/pause commands
+func (app *Application) handlePlayPauseCommand(client mqtt.Client, topic, payload string) bool {
+	if topic != app.getTopicPrefix()+"/command/playpause" {
+		return false
+	}
+
+	if payload == "playpause" {
+		commandPlayPause()
+		// Update the now playing sensor after a short delay to reflect the new state
+		time.Sleep(500 * time.Millisecond)
+		app.updateNowPlaying(client)
+	}
+	return true
+}
+
+// handleAppCommand handles command/app and the command/app/<app> switches
+func (app *Application) handleAppCommand(client mqtt.Client, topic, payload string) bool {
+	var command AppCommand
+	switch {
+	case topic == app.getTopicPrefix()+"/command/app":
+		var err error
+		command, err = app.validateAppCommandInput(payload)
+		if err != nil {
+			log.Printf("Invalid app command: %v", err)
+			return true
+		}
+
+	case strings.HasPrefix(topic, app.getTopicPrefix()+"/command/app/"):
+		key := strings.TrimPrefix(topic, app.getTopicPrefix()+"/command/app/")
+		target, ok := app.getAppSwitch(key)
+		if !ok {
+			log.Printf("Unknown app switch: %s", key)
+			return true
+		}
+		command.AppTarget = target
+		switch payload {
+		case "ON":
+			command.Action = "open"
+		case "OFF":
+			command.Action = "quit"
+		default:
+			log.Printf("Invalid app switch value: %s", payload)
+			return true
+		}
+
+	default:
+		return false
+	}
+
+	if !app.isAppAllowed(command.AppTarget) {
+		log.Printf("App %s is not in app_allowlist or app_switches, ignoring %s", command.AppTarget, command.Action)
+		return true
+	}
+
+	var err error
+	switch command.Action {
+	case "open":
+		err = commandOpenApp(command.AppTarget)
+	case "quit":
+		err = commandQuitApp(command.AppTarget)
+	case "force_quit":
+		err = commandForceQuitApp(command.AppTarget)
+	case "activate":
+		err = commandActivateApp(command.AppTarget)
+	}
+	if err != nil {
+		log.Printf("Error running %s for app %s: %v", command.Action, command.AppTarget, err)
+	}
+
+	// Give the app time to launch or quit before publishing the new state
+	time.AfterFunc(AppCommandRefreshDelay, func() {
+		app.updateRunningApps(client)
+	})
+	return true
+}
+
+// getAppSwitch returns the app_switches entry for a topic key
+func (app *Application) getAppSwitch(key string) (AppTarget, bool) {
+	for _, entry := range app.config.AppSwitches {
+		if getTopicKey(entry) == key {
+			return parseAppTarget(entry), true
+		}
+	}
+	return AppTarget{}, false
+}
+
+// isAppAllowed reports whether the app is in app_allowlist or app_switches
+func (app *Application) isAppAllowed(target AppTarget) bool {
+	for _, entry := range append(append([]string{}, app.config.AppAllowlist...), app.config.AppSwitches...) {
+		allowed := parseAppTarget(entry)
+		if target.BundleID != "" && strings.EqualFold(allowed.BundleID, target.BundleID) {
+			return true
+		}
+		if target.Name != "" && strings.EqualFold(allowed.Name, target.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// updateRunningApps publishes the running apps and the state of the app switches
+func (app *Application) updateRunningApps(client mqtt.Client) {
+	apps, err := getRunningApps()
+	if err != nil {
+		log.Printf("Failed to get running apps: %v", err)
+		return
+	}
+
+	appsJSON, _ := json.Marshal(map[string]interface{}{
+		"apps": apps,
+	})
+	client.Publish(app.getTopicPrefix()+"/status/apps/running", 0, false, strconv.Itoa(len(apps)))
+	client.Publish(app.getTopicPrefix()+"/status/apps/running_attr", 0, false, string(appsJSON))
+
+	for _, entry := range app.config.AppSwitches {
+		target := parseAppTarget(entry)
+		running := "OFF"
+		for _, runningApp := range apps {
+			if target.matches(runningApp) {
+				running = "ON"
+				break
+			}
+		}
+		client.Publish(app.getTopicPrefix()+"/status/apps/"+getTopicKey(entry)+"/running", 0, false, running)
+	}
+}
+
+// isBluetoothDeviceSelected reports whether the device is in bluetooth_devices, or bluetooth_devices is empty
+func (app *Application) isBluetoothDeviceSelected(device BluetoothDevice) bool {
+	if len(app.config.BluetoothDevices) == 0 {
+		return true
+	}
+	for _, entry := range app.config.BluetoothDevices {
+		if strings.EqualFold(entry, device.Name) || normalizeMAC(entry) == normalizeMAC(device.Address) {
+			return true
+		}
+	}
+	return false
+}
+
+// updateBluetoothDevices stores the published devices and reports whether their entities changed.
+// The last battery levels are kept while a device is disconnected, the devices are returned with them.
+// Keys of unpaired devices are remembered so their discovery entries can be removed.
+func (app *Application) updateBluetoothDevices(devices []BluetoothDevice) ([]BluetoothDevice, bool) {
+	app.bluetoothMutex.Lock()
+	defer app.bluetoothMutex.Unlock()
+
+	current := make(map[string]BluetoothDevice, len(devices))
+	merged := make([]BluetoothDevice, 0, len(devices))
+	changed := false
+	for _, device := range devices {
+		key := device.key()
+		previous, known := app.bluetoothDevices[key]
+		if !known {
+			log.Printf("Bluetooth device %s was paired", device.Name)
+			changed = true
+		}
+
+		batteries := make(map[string]int)
+		for part, percent := range previous.Batteries {
+			batteries[part] = percent
+		}
+		for part, percent := range device.Batteries {
+			if _, ok := batteries[part]; !ok {
+				changed = true
+			}
+			batteries[part] = percent
+		}
+		if len(batteries) > 0 {
+			device.Batteries = batteries
+		}
+		current[key] = device
+		merged = append(merged, device)
+	}
+	for key, device := range app.bluetoothDevices {
+		if _, ok := current[key]; !ok {
+			log.Printf("Bluetooth device %s was removed", device.Name)
+			app.removedBluetooth = append(app.removedBluetooth, key)
+			changed = true
+		}
+	}
+
+	app.bluetoothDevices = current
+	return merged, changed
+}
+
+// updateBluetooth publishes the paired Bluetooth devices with their connection state and battery levels.
+// system_profiler takes a few seconds, so the lookup runs in the background; a call while one runs is skipped.
+func (app *Application) updateBluetooth(client mqtt.Client) {
+	app.bluetoothMutex.Lock()
+	if app.bluetoothUpdating {
+		app.bluetoothMutex.Unlock()
+		return
+	}
+	app.bluetoothUpdating = true
+	app.bluetoothMutex.Unlock()
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("Bluetooth update goroutine recovered from panic: %v", r)
+			}
+		}()
+		defer func() {
+			app.bluetoothMutex.Lock()
+			app.bluetoothUpdating = false
+			app.bluetoothMutex.Unlock()
+		}()
+
+		devices, err := getBluetoothDevices()
+		if err != nil {
+			log.Printf("Failed to get Bluetooth devices: %v", err)
+			return
+		}
+		app.publishBluetooth(client, devices)
+	}()
+}
+
+// publishBluetooth publishes the selected devices of a Bluetooth lookup
+func (app *Application) publishBluetooth(client mqtt.Client, devices []BluetoothDevice) {
+	var selected []BluetoothDevice
+	for _, device := range devices {
+		if app.isBluetoothDeviceSelected(device) {
+			selected = append(selected, device)
+		}
+	}
+
+	// Republish discovery when devices were paired or removed
+	selected, changed := app.updateBluetoothDevices(selected)
+	if changed {
+		app.setDevice(client)
+	}
+
+	connected := 0
+	for _, device := range selected {
+		topic := app.getTopicPrefix() + "/status/bluetooth/" + device.key()
+		state := "OFF"
+		if device.Connected {
+			state = "ON"
+			connected++
+		}
+		client.Publish(topic+"/connected", 0, false, state)
+
+		// macOS only reports battery levels while a device is connected, the last ones stay published after that
+		for part, percent := range device.Batteries {
+			client.Publish(topic+"/battery_"+part, 0, false, strconv.Itoa(percent))
+		}
+	}
+
+	devicesJSON, _ := json.Marshal(map[string]interface{}{
+		"devices": selected,
+	})
+	client.Publish(app.getTopicPrefix()+"/status/bluetooth/connected", 0, false, strconv.Itoa(connected))
+	client.Publish(app.getTopicPrefix()+"/status/bluetooth/connected_attr", 0, false, string(devicesJSON))
+}
+
+// handleBluetoothCommand connects (ON) or disconnects (OFF) a paired device
+func (app *Application) handleBluetoothCommand(client mqtt.Client, topic, payload string) bool {
+	key, ok := strings.CutPrefix(topic, app.getTopicPrefix()+"/command/bluetooth/")
+	if !ok {
+		return false
+	}
+
+	app.bluetoothMutex.RLock()
+	device, known := app.bluetoothDevices[key]
+	app.bluetoothMutex.RUnlock()
+	if !known {
+		log.Printf("Unknown Bluetooth device: %s", key)
+		return true
+	}
+
+	var connect bool
+	switch payload {
+	case "ON":
+		connect = true
+	case "OFF":
+		connect = false
+	default:
+		log.Printf("Invalid Bluetooth switch value: %s", payload)
+		return true
+	}
+
+	if err := commandBluetoothConnection(device.Address, connect); err != nil {
+		log.Printf("Error changing the connection of Bluetooth device %s: %v", device.Name, err)
+	}
+
+	// Give the device time to connect or disconnect before publishing the new state
+	time.AfterFunc(BluetoothRefreshDelay, func() {
+		app.updateBluetooth(client)
+	})
+	return true
+}
+
+func (app *Application) updateVolume(client mqtt.Client) {
+	volume, err := app.getCurrentVolume()
+	if err != nil {
+		log.Printf("Failed to get volume: %v", err)
+		return
+	}
+	token := client.Publish(app.getTopicPrefix()+"/status/volume", 0, false, strconv.Itoa(volume))
+	token.Wait()
+}
+
+func (app *Application) updateMute(client mqtt.Client) {
+	token := client.Publish(app.getTopicPrefix()+"/status/mute", 0, false, strconv.FormatBool(app.getMuteStatus()))
+	token.Wait()
+}
+
+// updateAudioDevices publishes the current input and output device, the input volume and whether the input is muted.
+// Discovery is republished when devices were added or removed, they are the options of the device selects.
+func (app *Application) updateAudioDevices(client mqtt.Client) {
+	if _, err := exec.LookPath(app.config.SwitchAudioSourcePath); err == nil {
+		devices := make(map[string][]string)
+		for _, deviceType := range []string{"output", "input"} {
+			list, err := app.getAudioDevices(deviceType)
+			if err != nil {
+				log.Printf("Failed to get audio %s devices: %v", deviceType, err)
+				continue
+			}
+			for _, device := range list {
+				devices[deviceType] = append(devices[deviceType], device.Name)
+			}
+		}
+
+		app.audioMutex.Lock()
+		changed := !slices.Equal(devices["output"], app.audioDevices["output"]) ||
+			!slices.Equal(devices["input"], app.audioDevices["input"])
+		app.audioDevices = devices
+		app.audioMutex.Unlock()
+		if changed {
+			app.setDevice(client)
+		}
+
+		for _, deviceType := range []string{"output", "input"} {
+			current, err := app.getCurrentAudioDevice(deviceType)
+			if err != nil {
+				log.Printf("Failed to get current audio %s device: %v", deviceType, err)
+				continue
+			}
+			client.Publish(app.getTopicPrefix()+"/status/audio_"+deviceType, 0, false, current)
+			if deviceType == "output" {
+				app.updateOutputVolumeMemory(current)
+			}
+		}
+	}
+
+	volume, err := getInputVolume()
+	if err != nil {
+		log.Printf("Failed to get input volume: %v", err)
+		return
+	}
+	client.Publish(app.getTopicPrefix()+"/status/input_volume", 0, false, strconv.Itoa(volume))
+	client.Publish(app.getTopicPrefix()+"/status/input_mute", 0, false, strconv.FormatBool(volume == 0))
+}
+
+// getAudioDeviceNames returns the known input or output device names
+func (app *Application) getAudioDeviceNames(deviceType string) []string {
+	app.audioMutex.Lock()
+	defer app.audioMutex.Unlock()
+	return app.audioDevices[deviceType]
+}
+
+// BatteryInfo holds battery and power source information from pmset
+type BatteryInfo struct {
+	Present       bool   `json:"present"`        // false on Macs without an internal battery
+	Percent       int    `json:"percent"`        // charge percentage
+	State         string `json:"state"`          // "charging", "discharging", "charged", "finishing_charge" or "not_charging"
+	PowerSource   string `json:"power_source"`   // "ac", "battery" or "ups", empty for other sources
+	TimeRemaining int    `json:"time_remaining"` // in minutes, -1 if there is no estimate
+}
+
+// BatteryHealth holds battery health information from the AppleSmartBattery IORegistry entry
+type BatteryHealth struct {
+	CycleCount    int     `json:"cycle_count"`
+	HealthPercent float64 `json:"health_percent"` // maximum capacity relative to the design capacity
+	Condition     string  `json:"condition"`      // "Permanent Failure", empty when the battery reports no failure
+	Temperature   float64 `json:"temperature"`    // in degrees Celsius
+	AdapterWatts  int     `json:"adapter_watts"`  // 0 when no adapter is connected
+}
+
+// getBatteryInfo returns the battery and power source information from pmset
+func getBatteryInfo() (*BatteryInfo, error) {
+	output, err := exec.Command("/usr/bin/pmset", "-g", "batt").Output()
+	if err != nil {
+		return nil, fmt.Errorf("error running pmset: %w", err)
+	}
+	return parsePmsetBatt(string(output))
+}
+
+// parsePmsetBatt parses pmset -g batt output:
+//
+//	Now drawing from 'Battery Power'
+//	 -InternalBattery-0 (id=4653155)	100%; discharging; 20:00 remaining present: true
+func parsePmsetBatt(output string) (*BatteryInfo, error) {
+	sourceRe := regexp.MustCompile(`Now drawing from '([^']+)'`)
+	source := sourceRe.FindStringSubmatch(output)
+	if len(source) < 2 {
+		return nil, fmt.Errorf("power source not found in pmset output")
+	}
+
+	info := &BatteryInfo{TimeRemaining: -1}
+	switch source[1] {
+	case "AC Power":
+		info.PowerSource = "ac"
+	case "Battery Power":
+		info.PowerSource = "battery"
+	case "UPS Power":
+		info.PowerSource = "ups"
+	}
+
+	batteryRe := regexp.MustCompile(`-InternalBattery-\d+[^\t]*\t\s*(\d+)%;\s*([^;]+);\s*(\S+)`)
+	battery := batteryRe.FindStringSubmatch(output)
+	if len(battery) < 4 {
+		return info, nil
+	}
+
+	info.Present = true
+	info.Percent, _ = strconv.Atoi(battery[1])
+	switch state := strings.TrimSpace(battery[2]); state {
+	case "AC attached":
+		info.State = "not_charging"
+	default:
+		info.State = strings.ReplaceAll(state, " ", "_")
+	}
+
+	// The time is "(no" when there is no estimate yet
+	if hours, minutes, ok := strings.Cut(battery[3], ":"); ok {
+		h, errH := strconv.Atoi(hours)
+		m, errM := strconv.Atoi(minutes)
+		if errH == nil && errM == nil {
+			info.TimeRemaining = h*60 + m
+		}
+	}
+
+	return info, nil
+}
+
+// getBatteryHealth returns the battery health information from the IORegistry
+func getBatteryHealth() (*BatteryHealth, error) {
+	output, err := exec.Command("ioreg", "-r", "-c", "AppleSmartBattery").Output()
+	if err != nil {
+		return nil, fmt.Errorf("error running ioreg: %w", err)
+	}
+	return parseAppleSmartBattery(string(output))
+}
+
+// getBatteryCondition returns the battery condition that macOS shows in the battery settings
+func getBatteryCondition() (string, error) {
+	output, err := exec.Command("/usr/sbin/system_profiler", "SPPowerDataType", "-json").Output()
+	if err != nil {
+		return "", fmt.Errorf("error running system_profiler: %w", err)
+	}
+	return parseBatteryCondition(output)
+}
+
+// parseBatteryCondition parses the battery condition from system_profiler SPPowerDataType -json output.
+// macOS reports "Normal" (or "Good" before macOS 11) when the battery is fine; every other condition
+// ("Service Recommended", "Check Battery", "Replace Soon", ...) is reported as Service Recommended.
+func parseBatteryCondition(output []byte) (string, error) {
+	var report struct {
+		Power []struct {
+			HealthInfo *struct {
+				Health string `json:"sppower_battery_health"`
+			} `json:"sppower_battery_health_info"`
+		} `json:"SPPowerDataType"`
+	}
+	if err := json.Unmarshal(output, &report); err != nil {
+		return "", fmt.Errorf("error parsing system_profiler output: %w", err)
+	}
+
+	for _, entry := range report.Power {
+		if entry.HealthInfo == nil || entry.HealthInfo.Health == "" {
+			continue
+		}
+		switch entry.HealthInfo.Health {
+		case "Normal", "Good":
+			return "Normal", nil
+		default:
+			return "Service Recommended", nil
+		}
+	}
+	return "", fmt.Errorf("battery condition not found in system_profiler output")
+}
+
+// parseAppleSmartBattery parses the top level properties of ioreg -r -c AppleSmartBattery output
+func parseAppleSmartBattery(output string) (*BatteryHealth, error) {
+	// Top level properties are formatted as "Key" = value, nested ones as "Key"=value
+	property := func(key string) (int, bool) {
+		re := regexp.MustCompile(`"` + key + `" = (-?\d+)`)
+		match := re.FindStringSubmatch(output)
+		if len(match) < 2 {
+			return 0, false
+		}
+		value, err := strconv.Atoi(match[1])
+		return value, err == nil
+	}
+
+	cycleCount, ok := property("CycleCount")
+	if !ok {
+		return nil, fmt.Errorf("AppleSmartBattery not found in ioreg output")
+	}
+	health := &BatteryHealth{CycleCount: cycleCount}
+
+	// On Apple Silicon MaxCapacity is a percentage and the capacity in mAh is AppleRawMaxCapacity
+	maxCapacity, ok := property("AppleRawMaxCapacity")
+	if !ok {
+		maxCapacity, _ = property("MaxCapacity")
+	}
+	if designCapacity, ok := property("DesignCapacity"); ok && designCapacity > 0 {
+		health.HealthPercent = float64(maxCapacity) / float64(designCapacity) * 100
+	}
+	if failure, ok := property("PermanentFailureStatus"); ok && failure != 0 {
+		health.Condition = "Permanent Failure"
+	}
+
+	// Temperature is reported in hundredths of a degree Celsius
+	if temperature, ok := property("Temperature"); ok {
+		health.Temperature = float64(temperature) / 100
+	}
+
+	adapterRe := regexp.MustCompile(`"AdapterDetails" = \{[^}]*"Watts"=(\d+)`)
+	if match := adapterRe.FindStringSubmatch(output); len(match) == 2 {
+		health.AdapterWatts, _ = strconv.Atoi(match[1])
+	}
+	if external, _ := regexp.MatchString(`"ExternalConnected" = Yes`, output); !external {
+		health.AdapterWatts = 0
+	}
+
+	return health, nil
+}
+
+// isLowPowerMode reports whether Low Power Mode is enabled
+func isLowPowerMode() (bool, error) {
+	output, err := exec.Command("/usr/bin/pmset", "-g").Output()
+	if err != nil {
+		return false, fmt.Errorf("error running pmset: %w", err)
+	}
+	return parseLowPowerMode(string(output)), nil
+}
+
+// parseLowPowerMode parses the lowpowermode (or powermode on newer macOS) setting from pmset -g output
+func parseLowPowerMode(output string) bool {
+	re := regexp.MustCompile(`(?m)^\s*(lowpowermode|powermode)\s+(\d+)`)
+	match := re.FindStringSubmatch(output)
+	return len(match) == 3 && match[2] == "1"
+}
+
+// getPowerPolicyFor selects the power policy for the power source and Low Power Mode
+func getPowerPolicyFor(info *BatteryInfo, lowPower bool) string {
+	switch {
+	case lowPower:
+		return PowerPolicyLowPower
+	case info != nil && info.PowerSource == "battery":
+		return PowerPolicyBattery
+	default:
+		return PowerPolicyNormal
+	}
+}
+
+// getPowerPolicy returns the current power policy
+func (app *Application) getPowerPolicy() string {
+	app.powerMutex.RLock()
+	defer app.powerMutex.RUnlock()
+	return app.powerPolicy
+}
+
+// getInterval returns the update interval of a sensor under the current power policy
+func (app *Application) getInterval(sensor string, base time.Duration) time.Duration {
+	multiplier := 1.0
+	switch app.getPowerPolicy() {
+	case PowerPolicyBattery:
+		multiplier = app.config.PowerPolicy.BatteryMultiplier
+	case PowerPolicyLowPower:
+		multiplier = app.config.PowerPolicy.LowPowerMultiplier
+	default:
+		return base
+	}
+
+	if m, ok := app.config.PowerPolicy.Sensors[sensor]; ok {
+		multiplier = m
+	}
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	return time.Duration(float64(base) * multiplier)
+}
+
+// periodicSensor is a sensor that the main loop updates every UpdateInterval, stretched by the power policy
+type periodicSensor struct {
+	name   string // the sensor name in power_policy.sensors
+	update func(mqtt.Client)
+	next   time.Time // when the sensor is updated next
+}
+
+// getPeriodicSensors returns the sensors that the main loop updates, each one after its own interval
+func (app *Application) getPeriodicSensors(now time.Time) []*periodicSensor {
+	sensors := []*periodicSensor{
+		{name: "battery", update: app.updateBattery},
+		{name: "battery_health", update: app.updateBatteryHealth},
+		{name: "disk", update: app.updateDiskUsage},
+		{name: "cpu", update: app.updateCPUUsage},
+		{name: "throughput", update: app.updateThroughput},
+		{name: "memory", update: app.updateMemoryUsage},
+		{name: "processes", update: app.updateProcesses},
+		{name: "apps", update: app.updateRunningApps},
+		{name: "bluetooth", update: app.updateBluetooth},
+		{name: "uptime", update: app.updateUptime},
+		{name: "public_ip", update: app.updatePublicIP},
+	}
+	for _, sensor := range sensors {
+		sensor.next = now.Add(UpdateInterval)
+	}
+	return sensors
+}
+
+// updatePeriodicSensors updates the sensors whose interval has passed
+func (app *Application) updatePeriodicSensors(client mqtt.Client, sensors []*periodicSensor, now time.Time) {
+	for _, sensor := range sensors {
+		if now.Before(sensor.next) {
+			continue
+		}
+		sensor.update(client)
+		sensor.next = now.Add(app.getInterval(sensor.name, UpdateInterval))
+	}
+}
+
+// startPowerPolicyMonitoring starts selecting the power policy from the power source.
+func (app *Application) startPowerPolicyMonitoring(client mqtt.Client) {
+	app.powerPolicyOnce.Do(func() {
+		log.Println("Starting power policy monitoring...")
+		app.updatePowerPolicy(client)
+		go app.monitorPowerPolicy(client)
+	})
+	app.publishPowerPolicy(client)
+}
+
+// monitorPowerPolicy periodically updates the power policy
+func (app *Application) monitorPowerPolicy(client mqtt.Client) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Power policy monitor goroutine recovered from panic: %v", r)
+		}
+	}()
+
+	for {
+		time.Sleep(PowerPolicyCheckInterval)
+		app.updatePowerPolicy(client)
+	}
+}
+
+// updatePowerPolicy selects the power policy and applies it when it changes
+func (app *Application) updatePowerPolicy(client mqtt.Client) {
+	info, err := getBatteryInfo()
+	if err != nil {
+		log.Printf("Failed to get battery info: %v", err)
+	}
+	lowPower, err := isLowPowerMode()
+	if err != nil {
+		log.Printf("Failed to get Low Power Mode: %v", err)
+	}
+
+	policy := getPowerPolicyFor(info, lowPower)
+
+	app.powerMutex.Lock()
+	changed := policy != app.powerPolicy
+	app.powerPolicy = policy
+	app.powerMutex.Unlock()
+
+	if !changed {
+		return
+	}
+
+	log.Printf("Power policy changed to: %s", policy)
+	if app.isMediaStreamPaused() {
+		app.stopMediaStream()
+	}
+	app.publishPowerPolicy(client)
+}
+
+// publishPowerPolicy publishes the current power policy
+func (app *Application) publishPowerPolicy(client mqtt.Client) {
+	if client == nil || !client.IsConnected() {
+		return
+	}
+	client.Publish(app.getTopicPrefix()+"/status/power_policy", 0, false, app.getPowerPolicy())
+}
+
+// DiskUsage holds disk usage statistics
+type DiskUsage struct {
+	Total       uint64  `json:"total"`        // Total bytes
+	Used        uint64  `json:"used"`         // Used bytes
+	Free        uint64  `json:"free"`         // Free bytes
+	UsedPercent float64 `json:"used_percent"` // Used percentage
+	FreePercent float64 `json:"free_percent"` // Free percentage
+}
+
+func getDiskUsage() (*DiskUsage, error) {
+	fs := sigar.FileSystemList{}
+	if err := fs.Get(); err != nil {
+		return nil, fmt.Errorf("failed to get filesystem list: %w", err)
+	}
+
+	// Find the root filesystem
+	for _, filesystem := range fs.List {
+		if filesystem.DirName == "/" {
+			return getFileSystemUsage(filesystem.DirName)
+		}
+	}
+
+	return nil, fmt.Errorf("root filesystem not found")
+}
+
+// getFileSystemUsage returns the disk usage of the filesystem mounted at dirName
+func getFileSystemUsage(dirName string) (*DiskUsage, error) {
+	usage := sigar.FileSystemUsage{}
+	if err := usage.Get(dirName); err != nil {
+		return nil, fmt.Errorf("failed to get disk usage: %w", err)
+	}
+
+	// Convert from KB to bytes (gosigar returns values in KB)
+	totalBytes := usage.Total * 1024
+	usedBytes := usage.Used * 1024
+	freeBytes := usage.Free * 1024
+
+	// Calculate percentages
+	usedPercent := float64(0)
+	freePercent := float64(0)
+	if totalBytes > 0 {
+		usedPercent = float64(usedBytes) / float64(totalBytes) * 100
+		freePercent = float64(freeBytes) / float64(totalBytes) * 100
+	}
+
+	return &DiskUsage{
+		Total:       totalBytes,
+		Used:        usedBytes,
+		Free:        freeBytes,
+		UsedPercent: usedPercent,
+		FreePercent: freePercent,
+	}, nil
+}
+
+// getContainerUsage returns the usage of the APFS container that holds the volume mounted at dirName
+func getContainerUsage(dirName string) (*DiskUsage, error) {
+	output, err := exec.Command("/usr/sbin/diskutil", "info", dirName).Output()
+	if err != nil {
+		return nil, fmt.Errorf("error running diskutil: %w", err)
+	}
+	return parseDiskutilContainer(string(output))
+}
+
+// parseDiskutilContainer parses the APFS container space from diskutil info output:
+//
+//	Container Total Space:     494.4 GB (494384795648 Bytes) (exactly 965595304 512-Byte-Units)
+//	Container Free Space:      201.2 GB (201234567168 Bytes) (exactly 393036264 512-Byte-Units)
+func parseDiskutilContainer(output string) (*DiskUsage, error) {
+	space := func(name string) (uint64, bool) {
+		re := regexp.MustCompile(`Container ` + name + ` Space:\s+.*?\((\d+) Bytes\)`)
+		match := re.FindStringSubmatch(output)
+		if len(match) < 2 {
+			return 0, false
+		}
+		value, err := strconv.ParseUint(match[1], 10, 64)
+		return value, err == nil
+	}
+
+	total, ok := space("Total")
+	if !ok || total == 0 {
+		return nil, fmt.Errorf("volume is not part of an APFS container")
+	}
+	free, _ := space("Free")
+	used := total - free
+
+	return &DiskUsage{
+		Total:       total,
+		Used:        used,
+		Free:        free,
+		UsedPercent: float64(used) / float64(total) * 100,
+		FreePercent: float64(free) / float64(total) * 100,
+	}, nil
+}
+
+// reservedDiskKeys are the keys under /status/disk/ that are used by the disk sensors themselves
+var reservedDiskKeys = []string{"container"}
+
+// getVolumeKey returns the topic key of a mount point.
+// Keys that collide with the topics of the disk sensors get a _volume suffix.
+func getVolumeKey(mountPoint string) string {
+	key := getTopicKey(mountPoint)
+	if slices.Contains(reservedDiskKeys, key) {
+		key += "_volume"
+	}
+	return key
+}
+
+// getMountedVolumes returns the mount points to monitor besides the root filesystem,
+// keyed by their topic key. Configured mount points are included while they are mounted,
+// with auto discovery every visible volume under /Volumes is included as well.
+func getMountedVolumes(mountPoints []string, autoDiscover bool) (map[string]string, error) {
+	fs := sigar.FileSystemList{}
+	if err := fs.Get(); err != nil {
+		return nil, fmt.Errorf("failed to get filesystem list: %w", err)
+	}
+
+	mounted := make(map[string]bool, len(fs.List))
+	for _, filesystem := range fs.List {
+		mounted[filesystem.DirName] = true
+	}
+
+	var monitored []string
+	for _, mountPoint := range mountPoints {
+		if mountPoint != "/" && mounted[mountPoint] {
+			monitored = append(monitored, mountPoint)
+		}
+	}
+
+	if autoDiscover {
+		for _, filesystem := range fs.List {
+			name, ok := strings.CutPrefix(filesystem.DirName, "/Volumes/")
+			if !ok || name == "" || strings.HasPrefix(name, ".") || strings.Contains(name, "/") {
+				continue
+			}
+			monitored = append(monitored, filesystem.DirName)
+		}
+	}
+
+	return getVolumeKeys(monitored), nil
+}
+
+// getVolumeKeys returns the mount points keyed by their topic key. When the keys of mount points collide,
+// like those of "/Volumes/My Disk" and "/Volumes/My_Disk", the first one in sorted order keeps the key and
+// the others get a short hash of their path appended, so the keys don't depend on the mount order.
+func getVolumeKeys(mountPoints []string) map[string]string {
+	sorted := slices.Clone(mountPoints)
+	sort.Strings(sorted)
+	sorted = slices.Compact(sorted)
+
+	volumes := make(map[string]string, len(sorted))
+	for _, mountPoint := range sorted {
+		key := getVolumeKey(mountPoint)
+		if _, taken := volumes[key]; taken {
+			hash := fnv.New32a()
+			hash.Write([]byte(mountPoint))
+			key = fmt.Sprintf("%s_%08x", key, hash.Sum32())
+		}
+		volumes[key] = mountPoint
+	}
+	return volumes
+}
+
+// updateVolumes refreshes the list of monitored volumes and reports whether it changed.
+// Keys of volumes that were ejected are remembered so their discovery entries can be removed.
+func (app *Application) updateVolumes() bool {
+	volumes, err := getMountedVolumes(app.config.DiskVolumes, app.config.DiskAutoDiscover)
+	if err != nil {
+		log.Printf("Failed to get mounted volumes: %v", err)
+		return false
+	}
+
+	app.diskMutex.Lock()
+	defer app.diskMutex.Unlock()
+
+	changed := false
+	for key, mountPoint := range app.volumes {
+		if _, ok := volumes[key]; !ok {
+			log.Printf("Volume %s was ejected", mountPoint)
+			app.removedVolumes = append(app.removedVolumes, key)
+			changed = true
+		}
+	}
+	for key, mountPoint := range volumes {
+		if _, ok := app.volumes[key]; !ok {
+			log.Printf("Volume %s was mounted", mountPoint)
+			changed = true
+		}
+	}
+
+	app.volumes = volumes
+	return changed
+}
+
+// CPUUsage holds CPU usage statistics
+type CPUUsage struct {
+	UsedPercent float64   `json:"used_percent"` // CPU used percentage
+	FreePercent float64   `json:"free_percent"` // CPU idle/free percentage
+	Cores       []float64 `json:"cores"`        // used percentage of each core
+}
+
+// LoadAverage holds the 1, 5 and 15 minute load averages
+type LoadAverage struct {
+	One     float64 `json:"one"`
+	Five    float64 `json:"five"`
+	Fifteen float64 `json:"fifteen"`
+}
+
+// Thermal pressure levels, as reported by com.apple.system.thermalpressurelevel
+var thermalPressureLevels = []string{"nominal", "moderate", "heavy", "trapping", "sleeping"}
+
+// MemoryUsage holds memory usage statistics
+type MemoryUsage struct {
+	Total       uint64  `json:"total"`        // Total bytes
+	Used        uint64  `json:"used"`         // Used bytes
+	Free        uint64  `json:"free"`         // Free bytes
+	UsedPercent float64 `json:"used_percent"` // Used percentage
+	FreePercent float64 `json:"free_percent"` // Free percentage
+}
+
+// MemoryPressure holds the memory statistics that Activity Monitor shows on macOS
+type MemoryPressure struct {
+	Level      string `json:"level"`      // normal, warning or critical
+	App        uint64 `json:"app"`        // App memory bytes
+	Wired      uint64 `json:"wired"`      // Wired memory bytes
+	Compressed uint64 `json:"compressed"` // Bytes occupied by the compressor
+	SwapTotal  uint64 `json:"swap_total"` // Swap file size in bytes
+	SwapUsed   uint64 `json:"swap_used"`  // Used swap bytes
+}
+
+// Memory pressure levels
+var memoryPressureLevels = []string{"normal", "warning", "critical"}
+
+// ProcessInfo holds the resource usage of a process
+type ProcessInfo struct {
+	Name       string  `json:"name"`
+	PID        int32   `json:"pid"`
+	CPUPercent float64 `json:"cpu_percent"` // CPU used since the previous update, 100 per core
+	Memory     uint64  `json:"memory"`      // Resident memory bytes
+}
+
+// WatchedProcess holds the combined usage of all processes with a watchlist name
+type WatchedProcess struct {
+	Name       string  `json:"name"`
+	Running    bool    `json:"running"`
+	PIDs       []int32 `json:"pids"`
+	CPUPercent float64 `json:"cpu_percent"`
+	Memory     uint64  `json:"memory"`
+}
+
+// UptimeInfo holds system uptime information
+type UptimeInfo struct {
+	Seconds uint64 `json:"seconds"` // Uptime in seconds
+	Human   string `json:"human"`   // Human-readable format
+}
+
+// counterDelta returns the increase of a monotonic counter.
+// It returns false when the counter went backwards, i.e. it was reset or wrapped.
+func counterDelta(current, last uint64) (uint64, bool) {
+	if current < last {
+		return 0, false
+	}
+	return current - last, true
+}
+
+// getCPUPercent returns the used percentage of a CPU between two samples.
+// It returns false when there is nothing to compare, i.e. on the first sample or after a counter reset.
+func getCPUPercent(current, last sigar.Cpu) (float64, bool) {
+	// Without a previous sample the counters would give the average since boot
+	if last.Total() == 0 {
+		return 0, false
+	}
+	total, ok := counterDelta(current.Total(), last.Total())
+	if !ok || total == 0 {
+		return 0, false
+	}
+	idle, ok := counterDelta(current.Idle, last.Idle)
+	if !ok || idle > total {
+		return 0, false
+	}
+	return 100 - float64(idle)/float64(total)*100, true
+}
+
+func (app *Application) getCPUUsage() (*CPUUsage, error) {
+	cpu := sigar.Cpu{}
+	if err := cpu.Get(); err != nil {
+		return nil, fmt.Errorf("failed to get CPU stats: %w", err)
+	}
+
+	// Per-core stats are optional, the aggregate is still published without them
+	cores := sigar.CpuList{}
+	if err := cores.Get(); err != nil {
+		log.Printf("Failed to get per-core CPU stats: %v", err)
+	}
+
+	app.cpuMutex.Lock()
+	defer app.cpuMutex.Unlock()
+
+	usage := &CPUUsage{
+		UsedPercent: 0,
+		FreePercent: 100,
+	}
+
+	// If this is the first measurement or nothing changed, report 0% usage
+	if usedPercent, ok := getCPUPercent(cpu, app.lastCPU); ok {
+		usage.UsedPercent = usedPercent
+		usage.FreePercent = 100 - usedPercent
+	}
+
+	// A core is only reported once there is a previous sample for it
+	if len(cores.List) == len(app.lastCPUList) {
+		for i, core := range cores.List {
+			usedPercent, _ := getCPUPercent(core, app.lastCPUList[i])
+			usage.Cores = append(usage.Cores, usedPercent)
+		}
+	}
+
+	// Store current CPU stats for next calculation
+	app.lastCPU = cpu
+	app.lastCPUList = cores.List
+
+	return usage, nil
+}
+
+func getLoadAverage() (*LoadAverage, error) {
+	load := sigar.LoadAverage{}
+	if err := load.Get(); err != nil {
+		return nil, fmt.Errorf("failed to get load average: %w", err)
+	}
+
+	return &LoadAverage{
+		One:     load.One,
+		Five:    load.Five,
+		Fifteen: load.Fifteen,
+	}, nil
+}
+
+// getCPUFrequency returns the nominal CPU frequency in MHz.
+// Apple silicon Macs don't report it, false is returned there.
+func getCPUFrequency() (float64, bool) {
+	output, err := exec.Command("/usr/sbin/sysctl", "-n", "hw.cpufrequency").Output()
+	if err != nil {
+		return 0, false
+	}
+	return parseCPUFrequency(string(output))
+}
+
+// parseCPUFrequency parses the hw.cpufrequency sysctl value (in Hz) into MHz
+func parseCPUFrequency(output string) (float64, bool) {
+	hz, err := strconv.ParseUint(strings.TrimSpace(output), 10, 64)
+	if err != nil || hz == 0 {
+		return 0, false
+	}
+	return float64(hz) / 1e6, true
+}
+
+// getThermalPressure returns the thermal pressure level posted by the system
+func getThermalPressure() (string, error) {
+	output, err := exec.Command("/usr/bin/notifyutil", "-g", "com.apple.system.thermalpressurelevel").Output()
+	if err != nil {
+		return "", fmt.Errorf("error running notifyutil: %w", err)
+	}
+	return parseThermalPressure(string(output))
+}
+
+// parseThermalPressure parses notifyutil -g output, e.g. "com.apple.system.thermalpressurelevel 0"
+func parseThermalPressure(output string) (string, error) {
+	fields := strings.Fields(output)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty thermal pressure output")
+	}
+	level, err := strconv.Atoi(fields[len(fields)-1])
+	if err != nil {
+		return "", fmt.Errorf("invalid thermal pressure level %q", fields[len(fields)-1])
+	}
+	if level < 0 || level >= len(thermalPressureLevels) {
+		return "", fmt.Errorf("unknown thermal pressure level %d", level)
+	}
+	return thermalPressureLevels[level], nil
+}
+
+// ThroughputRate holds the byte rates of a network interface or disk
+type ThroughputRate struct {
+	Name      string  `json:"name"`
+	InPerSec  float64 `json:"in_per_sec"`  // received or read bytes per second
+	OutPerSec float64 `json:"out_per_sec"` // sent or written bytes per second
+}
+
+// getRate returns the per second rate of a counter, 0 when it was reset or wrapped
+func getRate(current, last uint64, elapsed time.Duration) float64 {
+	delta, ok := counterDelta(current, last)
+	if !ok || elapsed <= 0 {
+		return 0
+	}
+	return float64(delta) / elapsed.Seconds()
+}
+
+// isMonitoredInterface reports whether the throughput of a network interface is published.
+// Without network_interfaces only the Ethernet and Wi-Fi (en*) interfaces are published.
+func (c *config) isMonitoredInterface(name string) bool {
+	if len(c.NetworkInterfaces) == 0 {
+		return strings.HasPrefix(name, "en")
+	}
+	for _, iface := range c.NetworkInterfaces {
+		if iface == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isMonitoredDisk reports whether the throughput of a disk is published.
+// Without disk_io_devices every disk is published.
+func (c *config) isMonitoredDisk(name string) bool {
+	if len(c.DiskIODevices) == 0 {
+		return true
+	}
+	for _, device := range c.DiskIODevices {
+		if device == name {
+			return true
+		}
+	}
+	return false
+}
+
+// getNetworkRates returns the throughput of the monitored network interfaces since the last call
+func (app *Application) getNetworkRates() ([]ThroughputRate, error) {
+	counters, err := psnet.IOCounters(true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get network counters: %w", err)
+	}
+	now := time.Now()
+
+	app.ioMutex.Lock()
+	defer app.ioMutex.Unlock()
+
+	elapsed := now.Sub(app.lastNetIOTime)
+	var rates []ThroughputRate
+	current := make(map[string]psnet.IOCountersStat, len(counters))
+	for _, counter := range counters {
+		if !app.config.isMonitoredInterface(counter.Name) {
+			continue
+		}
+		current[counter.Name] = counter
+
+		// The first measurement of an interface only establishes the baseline
+		last, ok := app.lastNetIO[counter.Name]
+		if !ok {
+			continue
+		}
+		rates = append(rates, ThroughputRate{
+			Name:      counter.Name,
+			InPerSec:  getRate(counter.BytesRecv, last.BytesRecv, elapsed),
+			OutPerSec: getRate(counter.BytesSent, last.BytesSent, elapsed),
+		})
+	}
+
+	// Store current counters for next calculation
+	app.lastNetIO = current
+	app.lastNetIOTime = now
+	return rates, nil
+}
+
+// getDiskRates returns the throughput of the monitored disks since the last call
+func (app *Application) getDiskRates() ([]ThroughputRate, error) {
+	counters, err := disk.IOCounters()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get disk counters: %w", err)
+	}
+	now := time.Now()
+
+	app.ioMutex.Lock()
+	defer app.ioMutex.Unlock()
+
+	elapsed := now.Sub(app.lastDiskIOTime)
+	var rates []ThroughputRate
+	current := make(map[string]disk.IOCountersStat, len(counters))
+	for name, counter := range counters {
+		if !app.config.isMonitoredDisk(name) {
+			continue
+		}
+		current[name] = counter
+
+		// The first measurement of a disk only establishes the baseline
+		last, ok := app.lastDiskIO[name]
+		if !ok {
+			continue
+		}
+		rates = append(rates, ThroughputRate{
+			Name:      name,
+			InPerSec:  getRate(counter.ReadBytes, last.ReadBytes, elapsed),
+			OutPerSec: getRate(counter.WriteBytes, last.WriteBytes, elapsed),
+		})
+	}
+
+	// Store current counters for next calculation
+	app.lastDiskIO = current
+	app.lastDiskIOTime = now
+	return rates, nil
+}
+
+// getThroughputNames returns the names of the monitored network interfaces and disks
+func (app *Application) getThroughputNames() ([]string, []string) {
+	var interfaces, disks []string
+
+	if counters, err := psnet.IOCounters(true); err == nil {
+		for _, counter := range counters {
+			if app.config.isMonitoredInterface(counter.Name) {
+				interfaces = append(interfaces, counter.Name)
+			}
+		}
+	}
+
+	if counters, err := disk.IOCounters(); err == nil {
+		for name := range counters {
+			if app.config.isMonitoredDisk(name) {
+				disks = append(disks, name)
+			}
+		}
+	}
+
+	return interfaces, disks
+}
+
+func getMemoryUsage() (*MemoryUsage, error) {
+	vmStat, err := mem.VirtualMemory()
+	if err != nil {
+		log.Fatalf("Error getting virtual memory stats: %v", err)
+	}
+
+	total := vmStat.Total
+	used := vmStat.Used
+	free := vmStat.Free
+
+	return &MemoryUsage{
+		Total:       total,
+		Used:        used,
+		Free:        free,
+		UsedPercent: vmStat.UsedPercent,
+		FreePercent: 100 - vmStat.UsedPercent,
+	}, nil
+}
+
+func getMemoryPressure() (*MemoryPressure, error) {
+	output, err := exec.Command("/usr/bin/vm_stat").Output()
+	if err != nil {
+		return nil, fmt.Errorf("error running vm_stat: %w", err)
+	}
+	pressure, err := parseVMStat(string(output))
+	if err != nil {
+		return nil, err
+	}
+
+	output, err = exec.Command("/usr/sbin/sysctl", "-n", "vm.swapusage").Output()
+	if err != nil {
+		return nil, fmt.Errorf("error reading vm.swapusage: %w", err)
+	}
+	pressure.SwapTotal, pressure.SwapUsed, err = parseSwapUsage(string(output))
+	if err != nil {
+		return nil, err
+	}
+
+	output, err = exec.Command("/usr/sbin/sysctl", "-n", "kern.memorystatus_vm_pressure_level").Output()
+	if err != nil {
+		return nil, fmt.Errorf("error reading kern.memorystatus_vm_pressure_level: %w", err)
+	}
+	pressure.Level, err = parseMemoryPressureLevel(string(output))
+	if err != nil {
+		return nil, err
+	}
+
+	return pressure, nil
+}
+
+// parseVMStat parses vm_stat output into App, Wired and Compressed memory.
+// App memory is computed the way Activity Monitor does it: anonymous pages minus purgeable pages.
+func parseVMStat(output string) (*MemoryPressure, error) {
+	pageSizeRe := regexp.MustCompile(`page size of (\d+) bytes`)
+	match := pageSizeRe.FindStringSubmatch(output)
+	if match == nil {
+		return nil, fmt.Errorf("page size not found in vm_stat output")
+	}
+	pageSize, err := strconv.ParseUint(match[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid page size %q: %w", match[1], err)
+	}
+
+	pages := make(map[string]uint64)
+	lineRe := regexp.MustCompile(`(?m)^"?([^":]+)"?:\s+(\d+)\.?\s*$`)
+	for _, match := range lineRe.FindAllStringSubmatch(output, -1) {
+		value, err := strconv.ParseUint(match[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		pages[match[1]] = value
+	}
+
+	for _, key := range []string{"Anonymous pages", "Pages wired down", "Pages occupied by compressor"} {
+		if _, ok := pages[key]; !ok {
+			return nil, fmt.Errorf("%q not found in vm_stat output", key)
+		}
+	}
+
+	app := pages["Anonymous pages"]
+	if purgeable := pages["Pages purgeable"]; purgeable < app {
+		app -= purgeable
+	}
+
+	return &MemoryPressure{
+		App:        app * pageSize,
+		Wired:      pages["Pages wired down"] * pageSize,
+		Compressed: pages["Pages occupied by compressor"] * pageSize,
+	}, nil
+}
+
+// parseSwapUsage parses the vm.swapusage sysctl value,
+// e.g. "total = 2048.00M  used = 1024.50M  free = 1023.50M  (encrypted)", into total and used bytes
+func parseSwapUsage(output string) (uint64, uint64, error) {
+	re := regexp.MustCompile(`(total|used)\s*=\s*([\d.]+)([KMGT]?)`)
+	values := make(map[string]uint64)
+	for _, match := range re.FindAllStringSubmatch(output, -1) {
+		value, err := strconv.ParseFloat(match[2], 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid swap %s %q: %w", match[1], match[2], err)
+		}
+		switch match[3] {
+		case "K":
+			value *= 1 << 10
+		case "M":
+			value *= 1 << 20
+		case "G":
+			value *= 1 << 30
+		case "T":
+			value *= 1 << 40
+		}
+		values[match[1]] = uint64(value)
+	}
+
+	total, okTotal := values["total"]
+	used, okUsed := values["used"]
+	if !okTotal || !okUsed {
+		return 0, 0, fmt.Errorf("unexpected vm.swapusage output: %q", strings.TrimSpace(output))
+	}
+	return total, used, nil
+}
+
+// parseMemoryPressureLevel parses the kern.memorystatus_vm_pressure_level sysctl value (1, 2 or 4)
+func parseMemoryPressureLevel(output string) (string, error) {
+	switch strings.TrimSpace(output) {
+	case "1":
+		return "normal", nil
+	case "2":
+		return "warning", nil
+	case "4":
+		return "critical", nil
+	default:
+		return "", fmt.Errorf("unknown memory pressure level %q", strings.TrimSpace(output))
+	}
+}
+
+// getProcesses returns every process with its CPU usage since the previous call.
+// Processes that exit while they are being read are skipped.
+func (app *Application) getProcesses() ([]ProcessInfo, error) {
+	procs, err := process.Processes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list processes: %w", err)
+	}
+	now := time.Now()
+
+	app.processMutex.Lock()
+	defer app.processMutex.Unlock()
+
+	elapsed := now.Sub(app.lastProcessTime).Seconds()
+	processes := make([]ProcessInfo, 0, len(procs))
+	cpuTimes := make(map[int32]float64, len(procs))
+	for _, proc := range procs {
+		name, err := proc.Name()
+		if err != nil {
+			continue
+		}
+		info := ProcessInfo{Name: name, PID: proc.Pid}
+
+		if times, err := proc.Times(); err == nil {
+			cpuTime := times.User + times.System
+			cpuTimes[proc.Pid] = cpuTime
+
+			// A new process, or a reused PID, only establishes the baseline
+			if last, ok := app.lastProcessTimes[proc.Pid]; ok && cpuTime >= last && elapsed > 0 {
+				info.CPUPercent = (cpuTime - last) / elapsed * 100
+			}
+		}
+
+		if memory, err := proc.MemoryInfo(); err == nil {
+			info.Memory = memory.RSS
+		}
+
+		processes = append(processes, info)
+	}
+
+	// Store current CPU times for next calculation
+	app.lastProcessTimes = cpuTimes
+	app.lastProcessTime = now
+	return processes, nil
+}
+
+// getTopProcesses returns the n processes using the most CPU, then the most memory
+func getTopProcesses(processes []ProcessInfo, n int) []ProcessInfo {
+	top := make([]ProcessInfo, len(processes))
+	copy(top, processes)
+	sort.SliceStable(top, func(i, j int) bool {
+		if top[i].CPUPercent != top[j].CPUPercent {
+			return top[i].CPUPercent > top[j].CPUPercent
+		}
+		return top[i].Memory > top[j].Memory
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// getWatchedProcess combines all processes whose name matches a watchlist entry, ignoring case
+func getWatchedProcess(processes []ProcessInfo, name string) WatchedProcess {
+	watched := WatchedProcess{Name: name}
+	for _, proc := range processes {
+		if !strings.EqualFold(proc.Name, name) {
+			continue
+		}
+		watched.Running = true
+		watched.PIDs = append(watched.PIDs, proc.PID)
+		watched.CPUPercent += proc.CPUPercent
+		watched.Memory += proc.Memory
+	}
+	return watched
+}
+
+func getSystemUptime() (*UptimeInfo, error) {
+	uptime := sigar.Uptime{}
+	if err := uptime.Get(); err != nil {
+		return nil, fmt.Errorf("failed to get uptime: %w", err)
+	}
+
+	// Convert to human-readable format
+	totalSeconds := uint64(uptime.Length)
+	days := totalSeconds / 86400
+	hours := (totalSeconds % 86400) / 3600
+	minutes := (totalSeconds % 3600) / 60
+
+	var uptimeHuman string
+	if days > 0 {
+		uptimeHuman = fmt.Sprintf("%d days, %d:%02d", days, hours, minutes)
+	} else {
+		uptimeHuman = fmt.Sprintf("%d:%02d", hours, minutes)
+	}
+
+	return &UptimeInfo{
+		Seconds: totalSeconds,
+		Human:   uptimeHuman,
+	}, nil
+}
+
+func (app *Application) updateBattery(client mqtt.Client) {
+	info, err := getBatteryInfo()
+	if err != nil {
+		log.Printf("Failed to get battery info: %v", err)
+		return
+	}
+
+	app.batteryMutex.Lock()
+	app.batteryPresent = info.Present
+	app.batteryMutex.Unlock()
+
+	percent := PayloadUnknown
+	if info.Present {
+		percent = strconv.Itoa(info.Percent)
+	}
+	token := client.Publish(app.getTopicPrefix()+"/status/battery", 0, false, percent)
+	token.Wait()
+
+	if info.PowerSource != "" {
+		client.Publish(app.getTopicPrefix()+"/status/battery/power_source", 0, false, info.PowerSource)
+	}
+	if !info.Present {
+		return
+	}
+
+	timeRemaining := PayloadUnknown
+	if info.TimeRemaining >= 0 {
+		timeRemaining = strconv.Itoa(info.TimeRemaining)
+	}
+	client.Publish(app.getTopicPrefix()+"/status/battery/charging_state", 0, false, info.State)
+	client.Publish(app.getTopicPrefix()+"/status/battery/time_remaining", 0, false, timeRemaining)
+}
+
+// updateBatteryHealth publishes the battery details from the IORegistry and the condition macOS shows
+func (app *Application) updateBatteryHealth(client mqtt.Client) {
+	app.batteryMutex.Lock()
+	present := app.batteryPresent
+	app.batteryMutex.Unlock()
+	if !present {
+		return
+	}
+
+	health, err := getBatteryHealth()
+	if err != nil {
+		log.Printf("Failed to get battery health: %v", err)
+		return
+	}
+
+	client.Publish(app.getTopicPrefix()+"/status/battery/cycle_count", 0, false, strconv.Itoa(health.CycleCount))
+	client.Publish(app.getTopicPrefix()+"/status/battery/health", 0, false, fmt.Sprintf("%.1f", health.HealthPercent))
+	// A permanent failure is only in the IORegistry, the condition macOS shows comes from system_profiler
+	condition := health.Condition
+	if condition == "" {
+		condition = app.getBatteryCondition(client)
+	}
+	if condition != "" {
+		client.Publish(app.getTopicPrefix()+"/status/battery/condition", 0, false, condition)
+	}
+	client.Publish(app.getTopicPrefix()+"/status/battery/temperature", 0, false, fmt.Sprintf("%.1f", health.Temperature))
+	client.Publish(app.getTopicPrefix()+"/status/battery/adapter_watts", 0, false, strconv.Itoa(health.AdapterWatts))
+}
+
+// getBatteryCondition returns the last battery condition from system_profiler and looks it up again in the
+// background when it is older than BatteryConditionInterval. The condition is published when the lookup finishes.
+func (app *Application) getBatteryCondition(client mqtt.Client) string {
+	interval := app.getInterval("battery_condition", BatteryConditionInterval)
+
+	app.batteryMutex.Lock()
+	defer app.batteryMutex.Unlock()
+	if app.batteryConditionUpdating || time.Since(app.batteryConditionUpdatedAt) < interval {
+		return app.batteryCondition
+	}
+	app.batteryConditionUpdating = true
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("Battery condition goroutine recovered from panic: %v", r)
+			}
+		}()
+
+		condition, err := getBatteryCondition()
+		if err != nil {
+			log.Printf("Failed to get battery condition: %v", err)
+		}
+
+		app.batteryMutex.Lock()
+		previous := app.batteryCondition
+		if err == nil {
+			app.batteryCondition = condition
+		}
+		app.batteryConditionUpdatedAt = time.Now()
+		app.batteryConditionUpdating = false
+		app.batteryMutex.Unlock()
+
+		if err == nil && condition != previous {
+			client.Publish(app.getTopicPrefix()+"/status/battery/condition", 0, false, condition)
+		}
+	}()
+	return app.batteryCondition
+}
+
+func (app *Application) updateCaffeinateStatus(client mqtt.Client) {
+	token := client.Publish(app.getTopicPrefix()+"/status/caffeinate", 0, false, strconv.FormatBool(getCaffeinateStatus()))
+	token.Wait()
+}
+
+func (app *Application) updateDiskUsage(client mqtt.Client) {
+	diskUsage, err := getDiskUsage()
+	if err != nil {
+		log.Printf("Failed to get disk usage: %v", err)
+		return
+	}
+
+	// Publish individual metrics
+	client.Publish(app.getTopicPrefix()+"/status/disk/total", 0, false, fmt.Sprintf("%d", diskUsage.Total))
+	client.Publish(app.getTopicPrefix()+"/status/disk/used", 0, false, fmt.Sprintf("%d", diskUsage.Used))
+	client.Publish(app.getTopicPrefix()+"/status/disk/free", 0, false, fmt.Sprintf("%d", diskUsage.Free))
+	client.Publish(app.getTopicPrefix()+"/status/disk/used_percent", 0, false, fmt.Sprintf("%.2f", diskUsage.UsedPercent))
+	client.Publish(app.getTopicPrefix()+"/status/disk/free_percent", 0, false, fmt.Sprintf("%.2f", diskUsage.FreePercent))
+	client.Publish(app.getTopicPrefix()+"/status/disk/full", 0, false, app.getDiskFullState(diskUsage))
+
+	// Volumes in an APFS container share its space
+	if containerUsage, err := getContainerUsage("/"); err == nil {
+		client.Publish(app.getTopicPrefix()+"/status/disk/container/total", 0, false, fmt.Sprintf("%d", containerUsage.Total))
+		client.Publish(app.getTopicPrefix()+"/status/disk/container/free", 0, false, fmt.Sprintf("%d", containerUsage.Free))
+		client.Publish(app.getTopicPrefix()+"/status/disk/container/used_percent", 0, false, fmt.Sprintf("%.2f", containerUsage.UsedPercent))
+	}
+
+	// Republish discovery when volumes were mounted or ejected
+	if app.updateVolumes() {
+		app.setDevice(client)
+	}
+
+	app.diskMutex.RLock()
+	volumes := make(map[string]string, len(app.volumes))
+	for key, mountPoint := range app.volumes {
+		volumes[key] = mountPoint
+	}
+	app.diskMutex.RUnlock()
+
+	for key, mountPoint := range volumes {
+		usage, err := getFileSystemUsage(mountPoint)
+		if err != nil {
+			log.Printf("Failed to get disk usage of %s: %v", mountPoint, err)
+			continue
+		}
+
+		topic := app.getTopicPrefix() + "/status/disk/" + key
+		client.Publish(topic+"/total", 0, false, fmt.Sprintf("%d", usage.Total))
+		client.Publish(topic+"/used", 0, false, fmt.Sprintf("%d", usage.Used))
+		client.Publish(topic+"/free", 0, false, fmt.Sprintf("%d", usage.Free))
+		client.Publish(topic+"/used_percent", 0, false, fmt.Sprintf("%.2f", usage.UsedPercent))
+		client.Publish(topic+"/full", 0, false, app.getDiskFullState(usage))
+	}
+}
+
+// getDiskFullState returns ON when the disk usage is at or above disk_full_threshold
+func (app *Application) getDiskFullState(usage *DiskUsage) string {
+	if usage.UsedPercent >= float64(app.config.DiskFullThreshold) {
+		return "ON"
+	}
+	return "OFF"
+}
+
+func (app *Application) updateCPUUsage(client mqtt.Client) {
+	cpuUsage, err := app.getCPUUsage()
+	if err != nil {
+		log.Printf("Failed to get CPU usage: %v", err)
+		return
+	}
+
+	// Publish CPU metrics
+	client.Publish(app.getTopicPrefix()+"/status/cpu/used_percent", 0, false, fmt.Sprintf("%.2f", cpuUsage.UsedPercent))
+	client.Publish(app.getTopicPrefix()+"/status/cpu/free_percent", 0, false, fmt.Sprintf("%.2f", cpuUsage.FreePercent))
+	for i, usedPercent := range cpuUsage.Cores {
+		client.Publish(app.getTopicPrefix()+"/status/cpu/core/"+strconv.Itoa(i)+"/used_percent", 0, false, fmt.Sprintf("%.2f", usedPercent))
+	}
+
+	if load, err := getLoadAverage(); err != nil {
+		log.Printf("Failed to get load average: %v", err)
+	} else {
+		client.Publish(app.getTopicPrefix()+"/status/cpu/load_1", 0, false, fmt.Sprintf("%.2f", load.One))
+		client.Publish(app.getTopicPrefix()+"/status/cpu/load_5", 0, false, fmt.Sprintf("%.2f", load.Five))
+		client.Publish(app.getTopicPrefix()+"/status/cpu/load_15", 0, false, fmt.Sprintf("%.2f", load.Fifteen))
+	}
+
+	if frequency, ok := getCPUFrequency(); ok {
+		client.Publish(app.getTopicPrefix()+"/status/cpu/frequency", 0, false, fmt.Sprintf("%.0f", frequency))
+	}
+
+	if pressure, err := getThermalPressure(); err != nil {
+		log.Printf("Failed to get thermal pressure: %v", err)
+	} else {
+		client.Publish(app.getTopicPrefix()+"/status/cpu/thermal_pressure", 0, false, pressure)
+	}
+}
+
+func (app *Application) updateThroughput(client mqtt.Client) {
+	networkRates, err := app.getNetworkRates()
+	if err != nil {
+		log.Printf("Failed to get network throughput: %v", err)
+	}
+	for _, rate := range networkRates {
+		topic := app.getTopicPrefix() + "/status/network/" + getTopicKey(rate.Name)
+		client.Publish(topic+"/rx_rate", 0, false, fmt.Sprintf("%.0f", rate.InPerSec))
+		client.Publish(topic+"/tx_rate", 0, false, fmt.Sprintf("%.0f", rate.OutPerSec))
+	}
+
+	diskRates, err := app.getDiskRates()
+	if err != nil {
+		log.Printf("Failed to get disk throughput: %v", err)
+	}
+	for _, rate := range diskRates {
+		topic := app.getTopicPrefix() + "/status/disk_io/" + getTopicKey(rate.Name)
+		client.Publish(topic+"/read_rate", 0, false, fmt.Sprintf("%.0f", rate.InPerSec))
+		client.Publish(topic+"/write_rate", 0, false, fmt.Sprintf("%.0f", rate.OutPerSec))
+	}
+}
+
+func (app *Application) updateMemoryUsage(client mqtt.Client) {
+	memUsage, err := getMemoryUsage()
+	if err != nil {
+		log.Printf("Failed to get memory usage: %v", err)
+		return
+	}
+
+	// Publish memory metrics
+	client.Publish(app.getTopicPrefix()+"/status/memory/total", 0, false, fmt.Sprintf("%d", memUsage.Total))
+	client.Publish(app.getTopicPrefix()+"/status/memory/used", 0, false, fmt.Sprintf("%d", memUsage.Used))
+	client.Publish(app.getTopicPrefix()+"/status/memory/free", 0, false, fmt.Sprintf("%d", memUsage.Free))
+	client.Publish(app.getTopicPrefix()+"/status/memory/used_percent", 0, false, fmt.Sprintf("%.2f", memUsage.UsedPercent))
+	client.Publish(app.getTopicPrefix()+"/status/memory/free_percent", 0, false, fmt.Sprintf("%.2f", memUsage.FreePercent))
+
+	pressure, err := getMemoryPressure()
+	if err != nil {
+		log.Printf("Failed to get memory pressure: %v", err)
+		return
+	}
+
+	client.Publish(app.getTopicPrefix()+"/status/memory/pressure", 0, false, pressure.Level)
+	client.Publish(app.getTopicPrefix()+"/status/memory/app", 0, false, fmt.Sprintf("%d", pressure.App))
+	client.Publish(app.getTopicPrefix()+"/status/memory/wired", 0, false, fmt.Sprintf("%d", pressure.Wired))
+	client.Publish(app.getTopicPrefix()+"/status/memory/compressed", 0, false, fmt.Sprintf("%d", pressure.Compressed))
+	client.Publish(app.getTopicPrefix()+"/status/memory/swap_total", 0, false, fmt.Sprintf("%d", pressure.SwapTotal))
+	client.Publish(app.getTopicPrefix()+"/status/memory/swap_used", 0, false, fmt.Sprintf("%d", pressure.SwapUsed))
+}
+
+func (app *Application) updateProcesses(client mqtt.Client) {
+	processes, err := app.getProcesses()
+	if err != nil {
+		log.Printf("Failed to get processes: %v", err)
+		return
+	}
+
+	// Publish the top processes, the state is the process using the most CPU
+	top := getTopProcesses(processes, app.config.TopProcesses)
+	topState := ""
+	if len(top) > 0 {
+		topState = top[0].Name
+	}
+	topJSON, _ := json.Marshal(map[string]interface{}{
+		"processes": top,
+	})
+	client.Publish(app.getTopicPrefix()+"/status/processes/top", 0, false, topState)
+	client.Publish(app.getTopicPrefix()+"/status/processes/top_attr", 0, false, string(topJSON))
+
+	// Publish the watchlist
+	app.processMutex.Lock()
+	defer app.processMutex.Unlock()
+
+	// The first update only records which processes are running, without events
+	initial := app.watchedProcesses == nil
+	if initial {
+		app.watchedProcesses = make(map[string]bool)
+	}
+
+	for _, name := range app.config.ProcessWatchlist {
+		watched := getWatchedProcess(processes, name)
+		topic := app.getTopicPrefix() + "/status/processes/" + getTopicKey(name)
+
+		running := "OFF"
+		if watched.Running {
+			running = "ON"
+		}
+		client.Publish(topic+"/running", 0, false, running)
+		client.Publish(topic+"/cpu_percent", 0, false, fmt.Sprintf("%.2f", watched.CPUPercent))
+		client.Publish(topic+"/memory", 0, false, fmt.Sprintf("%d", watched.Memory))
+
+		wasRunning := app.watchedProcesses[name]
+		app.watchedProcesses[name] = watched.Running
+		if initial || wasRunning == watched.Running {
+			continue
+		}
+
+		eventType := "stopped"
+		if watched.Running {
+			eventType = "started"
+		}
+		log.Printf("Process %s %s", name, eventType)
+		eventJSON, _ := json.Marshal(map[string]interface{}{
+			"event_type": eventType,
+			"name":       name,
+			"pids":       watched.PIDs,
+			"timestamp":  time.Now().Format(time.RFC3339),
+		})
+		client.Publish(app.getTopicPrefix()+"/events/process", 0, false, string(eventJSON))
+	}
+}
+
+func (app *Application) updateUptime(client mqtt.Client) {
+	uptime, err := getSystemUptime()
+	if err != nil {
+		log.Printf("Failed to get uptime: %v", err)
+		return
+	}
+
+	// Publish uptime metrics
+	client.Publish(app.getTopicPrefix()+"/status/uptime/seconds", 0, false, fmt.Sprintf("%d", uptime.Seconds))
+	client.Publish(app.getTopicPrefix()+"/status/uptime/human", 0, false, uptime.Human)
+}
+
+func getMediaDevicesState() (bool, bool, error) {
+	isMicOn, err := mediadevices.IsMicrophoneOn()
+	if err != nil {
+		return false, false, fmt.Errorf("failed to get microphone state: %w", err)
+	}
+
+	isCameraOn, err := mediadevices.IsCameraOn()
+	if err != nil {
+		return isMicOn, false, fmt.Errorf("failed to get camera state: %w", err)
+	}
+
+	return isMicOn, isCameraOn, nil
+}
+
+func (app *Application) updateMediaDevices(client mqtt.Client) {
+	isMicOn, isCameraOn, err := getMediaDevicesState()
+	if err != nil {
+		log.Printf("Failed to get media devices state: %v", err)
+		// Publish "unknown" state on error
+		client.Publish(app.getTopicPrefix()+"/status/microphone", 0, false, "OFF")
+		client.Publish(app.getTopicPrefix()+"/status/camera", 0, false, "OFF")
+		return
+	}
+
+	// Publish media device states
+	micState := "OFF"
+	if isMicOn {
+		micState = "ON"
+	}
+	cameraState := "OFF"
+	if isCameraOn {
+		cameraState = "ON"
+	}
+
+	client.Publish(app.getTopicPrefix()+"/status/microphone", 0, false, micState)
+	client.Publish(app.getTopicPrefix()+"/status/camera", 0, false, cameraState)
+}
+
+// PublicIPResolver looks up the public address of the Mac
+type PublicIPResolver interface {
+	Name() string
+	// PublicIP returns the public address for family "ipv4" or "ipv6"
+	PublicIP(ctx context.Context, family string) (string, error)
+}
+
+// publicIPEntry is a cached public IP lookup
+type publicIPEntry struct {
+	IP        string
+	Resolver  string
+	UpdatedAt time.Time
+}
+
+// newPublicIPResolvers creates the configured resolvers, dns, https and stun when none are configured
+func newPublicIPResolvers(cfg publicIPConfig) ([]PublicIPResolver, error) {
+	resolverConfigs := cfg.Resolvers
+	if len(resolverConfigs) == 0 {
+		resolverConfigs = []publicIPResolverConfig{{Type: "dns"}, {Type: "https"}, {Type: "stun"}}
 	}
 
-	// Handle keep awake commands
-	if app.handleKeepAwakeCommand(client, topic, payload) {
-		return
+	var resolvers []PublicIPResolver
+	for _, resolverConfig := range resolverConfigs {
+		switch resolverConfig.Type {
+		case "dns":
+			resolver := &dnsPublicIPResolver{server: DefaultDNSServer, name: DefaultDNSName}
+			if resolverConfig.Server != "" {
+				resolver.server = resolverConfig.Server
+			}
+			if resolverConfig.Name != "" {
+				resolver.name = resolverConfig.Name
+			}
+			resolvers = append(resolvers, resolver)
+		case "https":
+			resolver := &httpsPublicIPResolver{url: DefaultHTTPSURL}
+			if resolverConfig.Server != "" {
+				resolver.url = resolverConfig.Server
+			}
+			resolvers = append(resolvers, resolver)
+		case "stun":
+			resolver := &stunPublicIPResolver{server: DefaultSTUNServer}
+			if resolverConfig.Server != "" {
+				resolver.server = resolverConfig.Server
+			}
+			resolvers = append(resolvers, resolver)
+		case "upnp":
+			resolvers = append(resolvers, &upnpPublicIPResolver{location: resolverConfig.Server})
+		default:
+			return nil, fmt.Errorf("unknown public IP resolver %q", resolverConfig.Type)
+		}
 	}
+	return resolvers, nil
+}
 
-	// Handle play/pause commands
-	if app.handlePlayPauseCommand(client, topic, payload) {
-		return
+// familyNetwork returns the network name that only uses one address family, e.g. udp4
+func familyNetwork(network, family string) string {
+	if family == "ipv6" {
+		return network + "6"
 	}
+	return network + "4"
 }
 
-// handleVolumeCommand handles volume control commands
-func (app *Application) handleVolumeCommand(client mqtt.Client, topic, payload string) bool {
-	if topic != app.getTopicPrefix()+"/command/volume" {
-		return false
+// parsePublicIP validates that s is an address of the family
+func parsePublicIP(s, family string) (string, error) {
+	ip := net.ParseIP(strings.TrimSpace(s))
+	if ip == nil {
+		return "", fmt.Errorf("invalid IP address %q", strings.TrimSpace(s))
+	}
+	if (ip.To4() != nil) != (family == "ipv4") {
+		return "", fmt.Errorf("%s is not an %s address", ip, family)
 	}
+	return ip.String(), nil
+}
 
-	volume, err := app.validateVolumeInput(payload)
+// dnsPublicIPResolver asks a DNS server for a TXT record that contains the address of the client,
+// like o-o.myaddr.l.google.com on Google's name servers
+type dnsPublicIPResolver struct {
+	server string
+	name   string
+}
+
+func (r *dnsPublicIPResolver) Name() string { return "dns" }
+
+func (r *dnsPublicIPResolver) PublicIP(ctx context.Context, family string) (string, error) {
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			d := net.Dialer{
+				Timeout: PublicIPDialTimeout,
+			}
+			return d.DialContext(ctx, familyNetwork("udp", family), r.server)
+		},
+	}
+
+	txtRecords, err := resolver.LookupTXT(ctx, r.name)
 	if err != nil {
-		log.Printf("Invalid volume value: %v", err)
-		return true
+		return "", fmt.Errorf("failed to lookup public IP via DNS: %w", err)
 	}
+	if len(txtRecords) == 0 {
+		return "", fmt.Errorf("no IP address found in DNS response")
+	}
+	return parsePublicIP(txtRecords[0], family)
+}
 
-	setVolume(volume)
-	app.updateVolume(client)
-	app.updateMute(client)
-	return true
+// httpsPublicIPResolver fetches the address from an echo endpoint that returns it as plain text
+type httpsPublicIPResolver struct {
+	url string
 }
 
-// handleMuteCommand handles mute control commands
-func (app *Application) handleMuteCommand(client mqtt.Client, topic, payload string) bool {
-	if topic != app.getTopicPrefix()+"/command/mute" {
-		return false
+func (r *httpsPublicIPResolver) Name() string { return "https" }
+
+func (r *httpsPublicIPResolver) PublicIP(ctx context.Context, family string) (string, error) {
+	dialer := &net.Dialer{Timeout: PublicIPDialTimeout}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, address string) (net.Conn, error) {
+			return dialer.DialContext(ctx, familyNetwork("tcp", family), address)
+		},
 	}
+	defer transport.CloseIdleConnections()
 
-	mute, err := app.validateMuteInput(payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url, nil)
 	if err != nil {
-		log.Printf("Invalid mute value: %v", err)
-		return true
+		return "", fmt.Errorf("invalid URL %s: %w", r.url, err)
+	}
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch public IP: %w", err)
 	}
+	defer resp.Body.Close()
 
-	setMute(mute)
-	app.updateVolume(client)
-	app.updateMute(client)
-	return true
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned %s", r.url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxPublicIPResponseLen))
+	if err != nil {
+		return "", fmt.Errorf("failed to read public IP: %w", err)
+	}
+	return parsePublicIP(string(body), family)
 }
 
-// handleSystemCommand handles system control commands
-func (app *Application) handleSystemCommand(topic, payload string) bool {
-	if topic != app.getTopicPrefix()+"/command/set" {
-		return false
+// stunPublicIPResolver sends a STUN binding request (RFC 5389), the server answers with the mapped address
+type stunPublicIPResolver struct {
+	server string
+}
+
+func (r *stunPublicIPResolver) Name() string { return "stun" }
+
+func (r *stunPublicIPResolver) PublicIP(ctx context.Context, family string) (string, error) {
+	d := net.Dialer{Timeout: PublicIPDialTimeout}
+	conn, err := d.DialContext(ctx, familyNetwork("udp", family), r.server)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to STUN server: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
 	}
 
-	switch payload {
-	case "sleep":
-		commandSleep()
-	case "displaysleep":
-		commandDisplaySleep()
-	case "displaywake":
-		commandDisplayWake()
-	case "shutdown":
-		commandShutdown()
-	case "screensaver":
-		commandScreensaver()
-	default:
-		log.Printf("Unknown system command: %s", payload)
+	// Binding request: type, length, magic cookie and a random transaction ID
+	request := make([]byte, 20)
+	binary.BigEndian.PutUint16(request[0:], 0x0001)
+	binary.BigEndian.PutUint32(request[4:], stunMagicCookie)
+	if _, err := rand.Read(request[8:]); err != nil {
+		return "", fmt.Errorf("failed to create STUN transaction ID: %w", err)
 	}
-	return true
+	if _, err := conn.Write(request); err != nil {
+		return "", fmt.Errorf("failed to send STUN request: %w", err)
+	}
+
+	response := make([]byte, 1500)
+	n, err := conn.Read(response)
+	if err != nil {
+		return "", fmt.Errorf("failed to read STUN response: %w", err)
+	}
+	ip, err := parseSTUNResponse(response[:n], request[8:])
+	if err != nil {
+		return "", err
+	}
+	return parsePublicIP(ip, family)
 }
 
-// handleDisplayBrightnessCommand handles display brightness commands
-func (app *Application) handleDisplayBrightnessCommand(client mqtt.Client, topic, payload string) bool {
-	// Check if we have any displays available
-	if len(app.displays) == 0 {
-		log.Printf("Received display brightness command but no displays are available")
-		log.Printf("Topic: %s, Payload: %s", topic, payload)
-		log.Println("This usually means BetterDisplay CLI is not installed or not accessible")
-		return true // Return true to indicate we handled the command
+// parseSTUNResponse returns the XOR-MAPPED-ADDRESS, or the MAPPED-ADDRESS of older servers,
+// from a STUN binding success response
+func parseSTUNResponse(response, transactionID []byte) (string, error) {
+	if len(response) < 20 {
+		return "", fmt.Errorf("STUN response too short")
+	}
+	if binary.BigEndian.Uint16(response[0:]) != 0x0101 {
+		return "", fmt.Errorf("unexpected STUN message type 0x%04x", binary.BigEndian.Uint16(response[0:]))
+	}
+	if binary.BigEndian.Uint32(response[4:]) != stunMagicCookie || string(response[8:20]) != string(transactionID) {
+		return "", fmt.Errorf("STUN response does not match the request")
+	}
+	length := int(binary.BigEndian.Uint16(response[2:]))
+	if 20+length > len(response) {
+		return "", fmt.Errorf("STUN response truncated")
 	}
 
-	for _, display := range app.displays {
-		commandTopic := app.getTopicPrefix() + "/command/display_" + display.DisplayID + "_brightness"
-		if topic == commandTopic {
-			brightness, err := app.validateBrightnessInput(payload)
-			if err != nil {
-				log.Printf("Invalid brightness value for display %s: %v", display.Name, err)
-				return true
-			}
+	var mapped string
+	attributes := response[20 : 20+length]
+	for len(attributes) >= 4 {
+		attributeType := binary.BigEndian.Uint16(attributes[0:])
+		attributeLength := int(binary.BigEndian.Uint16(attributes[2:]))
+		if 4+attributeLength > len(attributes) {
+			return "", fmt.Errorf("STUN attribute truncated")
+		}
+		value := attributes[4 : 4+attributeLength]
 
-			err = setDisplayBrightness(display.DisplayID, brightness)
-			if err != nil {
-				log.Printf("Error setting brightness for display %s: %v", display.Name, err)
-				// Check if it's a BetterDisplay CLI error
-				if !isBetterDisplayCLIAvailable() {
-					log.Println("BetterDisplay CLI is not available. Please install BetterDisplay and enable CLI access.")
-				}
-			} else {
-				// Update the status immediately
-				statusTopic := app.getTopicPrefix() + "/status/display_" + display.DisplayID + "_brightness"
-				client.Publish(statusTopic, 0, true, strconv.Itoa(brightness))
+		switch attributeType {
+		case 0x0020: // XOR-MAPPED-ADDRESS, XORed with the magic cookie and transaction ID
+			if ip := stunAddress(value, response[4:20]); ip != nil {
+				return ip.String(), nil
+			}
+		case 0x0001: // MAPPED-ADDRESS
+			if ip := stunAddress(value, nil); ip != nil {
+				mapped = ip.String()
 			}
-			return true
 		}
+
+		// Attributes are padded to a multiple of 4 bytes
+		next := 4 + (attributeLength+3)/4*4
+		if next > len(attributes) {
+			break
+		}
+		attributes = attributes[next:]
 	}
-	return false
+
+	if mapped == "" {
+		return "", fmt.Errorf("no mapped address in STUN response")
+	}
+	return mapped, nil
 }
 
-// handleShortcutCommand handles shortcut execution commands
-func (app *Application) handleShortcutCommand(topic, payload string) bool {
-	if topic != app.getTopicPrefix()+"/command/runshortcut" {
-		return false
+// stunAddress decodes the address of a (XOR-)MAPPED-ADDRESS attribute, XORed with key when it is set
+func stunAddress(value, key []byte) net.IP {
+	if len(value) < 4 {
+		return nil
+	}
+	var size int
+	switch value[1] {
+	case 0x01:
+		size = net.IPv4len
+	case 0x02:
+		size = net.IPv6len
+	default:
+		return nil
+	}
+	if len(value) < 4+size {
+		return nil
 	}
 
-	if err := app.validateShortcutInput(payload); err != nil {
-		log.Printf("Invalid shortcut: %v", err)
-		return true
+	ip := make(net.IP, size)
+	copy(ip, value[4:4+size])
+	if key != nil {
+		for i := range ip {
+			ip[i] ^= key[i]
+		}
 	}
+	return ip
+}
 
-	commandRunShortcut(payload)
-	return true
+// upnpPublicIPResolver asks the router for its external address over UPnP IGD.
+// The router is found with SSDP unless the device description URL is configured.
+type upnpPublicIPResolver struct {
+	location string
 }
 
-// handleKeepAwakeCommand handles keep awake commands
-func (app *Application) handleKeepAwakeCommand(client mqtt.Client, topic, payload string) bool {
-	if topic != app.getTopicPrefix()+"/command/keepawake" {
-		return false
+func (r *upnpPublicIPResolver) Name() string { return "upnp" }
+
+func (r *upnpPublicIPResolver) PublicIP(ctx context.Context, family string) (string, error) {
+	if family != "ipv4" {
+		return "", fmt.Errorf("UPnP only reports the IPv4 address")
 	}
 
-	keepAwake, err := app.validateKeepAwakeInput(payload)
+	location := r.location
+	if location == "" {
+		var err error
+		if location, err = discoverUPnPGateway(ctx); err != nil {
+			return "", err
+		}
+	}
+
+	description, err := upnpRequest(ctx, http.MethodGet, location, "", nil)
 	if err != nil {
-		log.Printf("Invalid keep awake value: %v", err)
-		return true
+		return "", fmt.Errorf("failed to fetch UPnP device description: %w", err)
+	}
+	controlURL, serviceType, err := parseUPnPDescription(description, location)
+	if err != nil {
+		return "", err
 	}
 
-	if keepAwake {
-		commandKeepAwake()
-	} else {
-		commandAllowSleep()
+	body := `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body><u:GetExternalIPAddress xmlns:u="` + serviceType + `"/></s:Body>
+</s:Envelope>`
+	response, err := upnpRequest(ctx, http.MethodPost, controlURL, serviceType+"#GetExternalIPAddress", strings.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to get external IP from router: %w", err)
 	}
-	app.updateCaffeinateStatus(client)
-	return true
+	ip, err := parseUPnPExternalIP(response)
+	if err != nil {
+		return "", err
+	}
+	return parsePublicIP(ip, family)
 }
 
-// handlePlayPauseCommand handles play/pause commands
-func (app *Application) handlePlayPauseCommand(client mqtt.Client, topic, payload string) bool {
-	if topic != app.getTopicPrefix()+"/command/playpause" {
-		return false
+// discoverUPnPGateway searches the local network for an Internet gateway and returns its device description URL
+func discoverUPnPGateway(ctx context.Context) (string, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return "", fmt.Errorf("failed to open SSDP socket: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
 	}
 
-	if payload == "playpause" {
-		commandPlayPause()
-		// Update the now playing sensor after a short delay to reflect the new state
-		time.Sleep(500 * time.Millisecond)
-		app.updateNowPlaying(client)
+	address, err := net.ResolveUDPAddr("udp4", ssdpAddress)
+	if err != nil {
+		return "", err
+	}
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddress + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n" +
+		"ST: " + upnpGatewayDeviceType + "\r\n\r\n"
+	if _, err := conn.WriteTo([]byte(search), address); err != nil {
+		return "", fmt.Errorf("failed to send SSDP search: %w", err)
+	}
+
+	buffer := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return "", fmt.Errorf("no UPnP gateway found: %w", err)
+		}
+		if location := parseSSDPLocation(string(buffer[:n])); location != "" {
+			return location, nil
+		}
+	}
+}
+
+// parseSSDPLocation returns the LOCATION header of an SSDP response
+func parseSSDPLocation(response string) string {
+	for _, line := range strings.Split(response, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(key), "location") {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// upnpRequest sends a request to the router and returns the response body
+func upnpRequest(ctx context.Context, method, target, soapAction string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if soapAction != "" {
+		req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+		req.Header.Set("SOAPAction", `"`+soapAction+`"`)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", target, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxPublicIPResponseLen))
+}
+
+// parseUPnPDescription returns the absolute control URL and the service type of the
+// WANIPConnection (or WANPPPConnection) service in a UPnP device description
+func parseUPnPDescription(description []byte, location string) (string, string, error) {
+	base, err := url.Parse(location)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid device description URL %s: %w", location, err)
+	}
+
+	decoder := xml.NewDecoder(strings.NewReader(string(description)))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return "", "", fmt.Errorf("no WAN connection service in UPnP device description")
+		}
+		if err != nil {
+			return "", "", fmt.Errorf("error parsing UPnP device description: %w", err)
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "URLBase":
+			var urlBase string
+			if err := decoder.DecodeElement(&urlBase, &start); err == nil && strings.TrimSpace(urlBase) != "" {
+				if parsed, err := url.Parse(strings.TrimSpace(urlBase)); err == nil {
+					base = parsed
+				}
+			}
+		case "service":
+			var service struct {
+				ServiceType string `xml:"serviceType"`
+				ControlURL  string `xml:"controlURL"`
+			}
+			if err := decoder.DecodeElement(&service, &start); err != nil {
+				return "", "", fmt.Errorf("error parsing UPnP service: %w", err)
+			}
+			if !strings.Contains(service.ServiceType, ":WANIPConnection:") && !strings.Contains(service.ServiceType, ":WANPPPConnection:") {
+				continue
+			}
+			controlURL, err := url.Parse(strings.TrimSpace(service.ControlURL))
+			if err != nil {
+				return "", "", fmt.Errorf("invalid control URL %s: %w", service.ControlURL, err)
+			}
+			return base.ResolveReference(controlURL).String(), strings.TrimSpace(service.ServiceType), nil
+		}
+	}
+}
+
+// parseUPnPExternalIP returns NewExternalIPAddress from a GetExternalIPAddress SOAP response
+func parseUPnPExternalIP(response []byte) (string, error) {
+	decoder := xml.NewDecoder(strings.NewReader(string(response)))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return "", fmt.Errorf("no external IP in UPnP response")
+		}
+		if err != nil {
+			return "", fmt.Errorf("error parsing UPnP response: %w", err)
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local == "NewExternalIPAddress" {
+			var ip string
+			if err := decoder.DecodeElement(&ip, &start); err != nil {
+				return "", fmt.Errorf("error parsing UPnP response: %w", err)
+			}
+			return strings.TrimSpace(ip), nil
+		}
+	}
+}
+
+// getPublicIP returns the public address for the family from the cache, or from the first resolver that finds it
+func (app *Application) getPublicIP(family string) (publicIPEntry, error) {
+	app.profileMutex.RLock()
+	cfg := app.config.PublicIP
+	app.profileMutex.RUnlock()
+
+	ttl := time.Duration(cfg.TTL) * time.Second
+	if cfg.TTL == 0 {
+		ttl = DefaultPublicIPTTL * time.Second
+	}
+
+	app.publicIPMutex.Lock()
+	entry, ok := app.publicIPCache[family]
+	app.publicIPMutex.Unlock()
+	if ok && time.Since(entry.UpdatedAt) < ttl {
+		return entry, nil
+	}
+
+	resolvers, err := newPublicIPResolvers(cfg)
+	if err != nil {
+		return publicIPEntry{}, err
+	}
+
+	var errs []string
+	for _, resolver := range resolvers {
+		ctx, cancel := context.WithTimeout(context.Background(), PublicIPLookupTimeout)
+		ip, err := resolver.PublicIP(ctx, family)
+		cancel()
+		if err != nil {
+			errs = append(errs, resolver.Name()+": "+err.Error())
+			continue
+		}
+
+		entry := publicIPEntry{IP: ip, Resolver: resolver.Name(), UpdatedAt: time.Now()}
+		app.publicIPMutex.Lock()
+		if app.publicIPCache == nil {
+			app.publicIPCache = make(map[string]publicIPEntry)
+		}
+		app.publicIPCache[family] = entry
+		app.publicIPMutex.Unlock()
+		return entry, nil
 	}
-	return true
+	return publicIPEntry{}, fmt.Errorf("no resolver found the public %s address: %s", family, strings.Join(errs, "; "))
 }
 
-func (app *Application) updateVolume(client mqtt.Client) {
-	token := client.Publish(app.getTopicPrefix()+"/status/volume", 0, false, strconv.Itoa(getCurrentVolume()))
-	token.Wait()
+// clearPublicIPCache forgets the cached public IPs, e.g. after the network changed
+func (app *Application) clearPublicIPCache() {
+	app.publicIPMutex.Lock()
+	defer app.publicIPMutex.Unlock()
+	app.publicIPCache = nil
 }
 
-func (app *Application) updateMute(client mqtt.Client) {
-	token := client.Publish(app.getTopicPrefix()+"/status/mute", 0, false, strconv.FormatBool(getMuteStatus()))
-	token.Wait()
+// ProbeResult is the outcome of one run of a probe
+type ProbeResult struct {
+	Success    bool    `json:"success"`     // at least one attempt succeeded
+	RTT        float64 `json:"rtt"`         // average round-trip time of the successful attempts in milliseconds
+	PacketLoss float64 `json:"packet_loss"` // percentage of failed attempts
+	Error      string  `json:"error,omitempty"`
 }
 
-func getBatteryChargePercent() string {
-
-	output := getCommandOutput("/usr/bin/pmset", "-g", "batt")
-
-	// $ /usr/bin/pmset -g batt
-	// Now drawing from 'Battery Power'
-	//  -InternalBattery-0 (id=4653155)        100%; discharging; 20:00 remaining present: true
+// validateProbes checks that every probe has a unique name, a known type and a target
+func validateProbes(probes []probeConfig) error {
+	keys := make(map[string]bool)
+	for _, probe := range probes {
+		key := getTopicKey(probe.Name)
+		if key == "" {
+			return fmt.Errorf("every probe needs a name")
+		}
+		if keys[key] {
+			return fmt.Errorf("duplicate probe %s", probe.Name)
+		}
+		keys[key] = true
 
-	r := regexp.MustCompile(`(\d+)%`)
-	res := r.FindStringSubmatch(output)
-	if len(res) == 0 {
-		return ""
+		switch probe.Type {
+		case "ping", "tcp", "http":
+		default:
+			return fmt.Errorf("probe %s: unknown type %q", probe.Name, probe.Type)
+		}
+		if probe.Target == "" {
+			return fmt.Errorf("probe %s: target is required", probe.Name)
+		}
 	}
-
-	return res[1]
+	return nil
 }
 
-// DiskUsage holds disk usage statistics
-type DiskUsage struct {
-	Total       uint64  `json:"total"`        // Total bytes
-	Used        uint64  `json:"used"`         // Used bytes
-	Free        uint64  `json:"free"`         // Free bytes
-	UsedPercent float64 `json:"used_percent"` // Used percentage
-	FreePercent float64 `json:"free_percent"` // Free percentage
+// withDefaults returns the probe with the default interval, timeout and count filled in
+func (p probeConfig) withDefaults() probeConfig {
+	if p.Interval <= 0 {
+		p.Interval = DefaultProbeInterval
+	}
+	if p.Timeout <= 0 {
+		p.Timeout = DefaultProbeTimeout
+	}
+	if p.Count <= 0 {
+		p.Count = DefaultProbeCount
+	}
+	return p
 }
 
-func getDiskUsage() (*DiskUsage, error) {
-	fs := sigar.FileSystemList{}
-	if err := fs.Get(); err != nil {
-		return nil, fmt.Errorf("failed to get filesystem list: %w", err)
+// runProbe runs a probe once
+func runProbe(probe probeConfig) ProbeResult {
+	probe = probe.withDefaults()
+	timeout := time.Duration(probe.Timeout) * time.Second
+
+	switch probe.Type {
+	case "ping":
+		return runPingProbe(probe.Target, probe.Count, timeout)
+	case "tcp":
+		return runAttempts(probe.Count, func() (time.Duration, error) {
+			return measureTCPConnect(probe.Target, timeout)
+		})
+	case "http":
+		return runAttempts(probe.Count, func() (time.Duration, error) {
+			return measureHTTPRequest(probe.Target, timeout)
+		})
+	default:
+		return ProbeResult{Error: fmt.Sprintf("unknown probe type %q", probe.Type), PacketLoss: 100}
 	}
+}
 
-	// Find the root filesystem
-	for _, filesystem := range fs.List {
-		if filesystem.DirName == "/" {
-			usage := sigar.FileSystemUsage{}
-			if err := usage.Get(filesystem.DirName); err != nil {
-				return nil, fmt.Errorf("failed to get disk usage: %w", err)
-			}
-
-			// Convert from KB to bytes (gosigar returns values in KB)
-			totalBytes := usage.Total * 1024
-			usedBytes := usage.Used * 1024
-			freeBytes := usage.Free * 1024
-
-			// Calculate percentages
-			usedPercent := float64(0)
-			freePercent := float64(0)
-			if totalBytes > 0 {
-				usedPercent = float64(usedBytes) / float64(totalBytes) * 100
-				freePercent = float64(freeBytes) / float64(totalBytes) * 100
-			}
-
-			return &DiskUsage{
-				Total:       totalBytes,
-				Used:        usedBytes,
-				Free:        freeBytes,
-				UsedPercent: usedPercent,
-				FreePercent: freePercent,
-			}, nil
+// runAttempts runs an attempt count times and combines the round-trip times and failures
+func runAttempts(count int, attempt func() (time.Duration, error)) ProbeResult {
+	var total time.Duration
+	var succeeded int
+	var lastErr error
+	for i := 0; i < count; i++ {
+		rtt, err := attempt()
+		if err != nil {
+			lastErr = err
+			continue
 		}
+		total += rtt
+		succeeded++
 	}
 
-	return nil, fmt.Errorf("root filesystem not found")
+	result := ProbeResult{
+		Success:    succeeded > 0,
+		PacketLoss: float64(count-succeeded) / float64(count) * 100,
+	}
+	if succeeded > 0 {
+		result.RTT = float64(total.Microseconds()) / 1000 / float64(succeeded)
+	}
+	if lastErr != nil {
+		result.Error = lastErr.Error()
+	}
+	return result
 }
 
-// CPUUsage holds CPU usage statistics
-type CPUUsage struct {
-	UsedPercent float64 `json:"used_percent"` // CPU used percentage
-	FreePercent float64 `json:"free_percent"` // CPU idle/free percentage
-}
+// measureHTTPRequest sends a GET request and returns how long it took until the response headers arrived
+func measureHTTPRequest(target string, timeout time.Duration) (time.Duration, error) {
+	client := &http.Client{Timeout: timeout}
+	start := time.Now()
+	resp, err := client.Get(target)
+	if err != nil {
+		return 0, err
+	}
+	elapsed := time.Since(start)
+	resp.Body.Close()
 
-// MemoryUsage holds memory usage statistics
-type MemoryUsage struct {
-	Total       uint64  `json:"total"`        // Total bytes
-	Used        uint64  `json:"used"`         // Used bytes
-	Free        uint64  `json:"free"`         // Free bytes
-	UsedPercent float64 `json:"used_percent"` // Used percentage
-	FreePercent float64 `json:"free_percent"` // Free percentage
+	if resp.StatusCode >= 400 {
+		return 0, fmt.Errorf("%s returned %s", target, resp.Status)
+	}
+	return elapsed, nil
 }
 
-// UptimeInfo holds system uptime information
-type UptimeInfo struct {
-	Seconds uint64 `json:"seconds"` // Uptime in seconds
-	Human   string `json:"human"`   // Human-readable format
+// runPingProbe sends ICMP echo requests with ping
+func runPingProbe(host string, count int, timeout time.Duration) ProbeResult {
+	// ping exits with an error when packets are lost, the summary is still printed
+	output, err := exec.Command("/sbin/ping", "-n", "-q", "-c", strconv.Itoa(count),
+		"-W", strconv.FormatInt(timeout.Milliseconds(), 10), host).CombinedOutput()
+	result, parseErr := parsePingOutput(string(output))
+	if parseErr != nil {
+		if err != nil {
+			parseErr = fmt.Errorf("ping failed: %w: %s", err, strings.TrimSpace(string(output)))
+		}
+		return ProbeResult{PacketLoss: 100, Error: parseErr.Error()}
+	}
+	return result
 }
 
-func (app *Application) getCPUUsage() (*CPUUsage, error) {
-	cpu := sigar.Cpu{}
-	if err := cpu.Get(); err != nil {
-		return nil, fmt.Errorf("failed to get CPU stats: %w", err)
+// parsePingOutput parses the summary of ping, e.g.
+//
+//	3 packets transmitted, 3 packets received, 0.0% packet loss
+//	round-trip min/avg/max/stddev = 11.203/12.524/14.007/1.150 ms
+func parsePingOutput(output string) (ProbeResult, error) {
+	counts := regexp.MustCompile(`(\d+) packets? transmitted, (\d+) (?:packets? )?received`).FindStringSubmatch(output)
+	if counts == nil {
+		return ProbeResult{}, fmt.Errorf("no ping summary in output")
+	}
+	transmitted, _ := strconv.Atoi(counts[1])
+	received, _ := strconv.Atoi(counts[2])
+	if transmitted == 0 {
+		return ProbeResult{}, fmt.Errorf("no packets transmitted")
 	}
 
-	app.cpuMutex.Lock()
-	defer app.cpuMutex.Unlock()
+	result := ProbeResult{
+		Success:    received > 0,
+		PacketLoss: float64(transmitted-received) / float64(transmitted) * 100,
+	}
+	if rtt := regexp.MustCompile(`= [\d.]+/([\d.]+)/`).FindStringSubmatch(output); rtt != nil {
+		result.RTT, _ = strconv.ParseFloat(rtt[1], 64)
+	}
+	if received == 0 {
+		result.Error = "no reply"
+	}
+	return result, nil
+}
+
+// startProbeMonitoring starts a monitor for every configured probe.
+func (app *Application) startProbeMonitoring(client mqtt.Client) {
+	app.probeOnce.Do(func() {
+		if len(app.config.Probes) == 0 {
+			return
+		}
+		log.Printf("Starting %d probes...", len(app.config.Probes))
+		for _, probe := range app.config.Probes {
+			go app.monitorProbe(client, probe)
+		}
+	})
+	app.publishProbes(client)
+}
 
-	// Calculate the delta since last measurement
-	userDelta := cpu.User - app.lastCPU.User
-	sysDelta := cpu.Sys - app.lastCPU.Sys
-	idleDelta := cpu.Idle - app.lastCPU.Idle
-	waitDelta := cpu.Wait - app.lastCPU.Wait
-	niceDelta := cpu.Nice - app.lastCPU.Nice
-	irqDelta := cpu.Irq - app.lastCPU.Irq
-	softIrqDelta := cpu.SoftIrq - app.lastCPU.SoftIrq
-	stolenDelta := cpu.Stolen - app.lastCPU.Stolen
+// monitorProbe runs a probe at its interval and publishes the results
+func (app *Application) monitorProbe(client mqtt.Client, probe probeConfig) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Probe %s goroutine recovered from panic: %v", probe.Name, r)
+		}
+	}()
 
-	// Calculate total time delta
-	totalDelta := userDelta + sysDelta + idleDelta + waitDelta + niceDelta + irqDelta + softIrqDelta + stolenDelta
+	interval := time.Duration(probe.withDefaults().Interval) * time.Second
+	for {
+		result := runProbe(probe)
+		if !result.Success {
+			log.Printf("Probe %s failed: %s", probe.Name, result.Error)
+		}
 
-	// Store current CPU stats for next calculation
-	app.lastCPU = cpu
+		app.probeMutex.Lock()
+		if app.probeResults == nil {
+			app.probeResults = make(map[string]ProbeResult)
+		}
+		app.probeResults[probe.Name] = result
+		app.probeMutex.Unlock()
 
-	// If this is the first measurement or total is zero, return 0% usage
-	if totalDelta == 0 {
-		return &CPUUsage{
-			UsedPercent: 0,
-			FreePercent: 100,
-		}, nil
+		app.publishProbe(client, probe, result)
+		time.Sleep(app.getInterval("probes", interval))
 	}
+}
 
-	// Calculate idle and used percentages
-	idlePercent := float64(idleDelta) / float64(totalDelta) * 100
-	usedPercent := 100 - idlePercent
+// publishProbes publishes the last result of every probe that has run
+func (app *Application) publishProbes(client mqtt.Client) {
+	app.probeMutex.RLock()
+	defer app.probeMutex.RUnlock()
 
-	return &CPUUsage{
-		UsedPercent: usedPercent,
-		FreePercent: idlePercent,
-	}, nil
+	for _, probe := range app.config.Probes {
+		if result, ok := app.probeResults[probe.Name]; ok {
+			app.publishProbe(client, probe, result)
+		}
+	}
 }
 
-func getMemoryUsage() (*MemoryUsage, error) {
-	vmStat, err := mem.VirtualMemory()
-	if err != nil {
-		log.Fatalf("Error getting virtual memory stats: %v", err)
+// publishProbe publishes the result of a probe.
+// The round-trip time is unknown when no attempt succeeded.
+func (app *Application) publishProbe(client mqtt.Client, probe probeConfig, result ProbeResult) {
+	if client == nil || !client.IsConnected() {
+		return
 	}
 
-	total := vmStat.Total
-	used := vmStat.Used
-	free := vmStat.Free
+	topic := app.getTopicPrefix() + "/status/probe/" + getTopicKey(probe.Name)
+	success, rtt := "OFF", PayloadUnknown
+	if result.Success {
+		success, rtt = "ON", fmt.Sprintf("%.2f", result.RTT)
+	}
+	client.Publish(topic+"/rtt", 0, false, rtt)
+	client.Publish(topic+"/success", 0, false, success)
+	client.Publish(topic+"/packet_loss", 0, false, fmt.Sprintf("%.1f", result.PacketLoss))
 
-	return &MemoryUsage{
-		Total:       total,
-		Used:        used,
-		Free:        free,
-		UsedPercent: vmStat.UsedPercent,
-		FreePercent: 100 - vmStat.UsedPercent,
-	}, nil
+	attributesJSON, _ := json.Marshal(map[string]interface{}{
+		"type":   probe.Type,
+		"target": probe.Target,
+		"error":  result.Error,
+	})
+	client.Publish(topic+"/success_attr", 0, false, string(attributesJSON))
 }
 
-func getSystemUptime() (*UptimeInfo, error) {
-	uptime := sigar.Uptime{}
-	if err := uptime.Get(); err != nil {
-		return nil, fmt.Errorf("failed to get uptime: %w", err)
+// NetworkInfo describes the network the Mac is connected to
+type NetworkInfo struct {
+	Interface     string   `json:"interface"`      // interface of the default route, empty when offline
+	Gateway       string   `json:"gateway"`        // default gateway
+	IPv4          []string `json:"ipv4"`           // addresses of the default route interface
+	IPv6          []string `json:"ipv6"`           // addresses of the default route interface, without link-local ones
+	VPN           bool     `json:"vpn"`            // whether a VPN tunnel has an address
+	VPNInterfaces []string `json:"vpn_interfaces"` // tunnels that have an address
+	WiFiDevice    string   `json:"wifi_device"`    // the Wi-Fi interface, e.g. en0
+	WiFiConnected bool     `json:"wifi_connected"` // whether the Wi-Fi interface is associated with a network
+	SSID          string   `json:"ssid"`
+	BSSID         string   `json:"bssid"`
+	RSSI          int      `json:"rssi"`      // in dBm, 0 when not connected to Wi-Fi
+	LinkRate      int      `json:"link_rate"` // in Mbit/s, 0 when not connected to Wi-Fi
+}
+
+// getNetworkInfo collects the current network state. Parts that can't be read are left empty.
+func getNetworkInfo() *NetworkInfo {
+	info := &NetworkInfo{}
+
+	// There is no default route while offline, route exits with an error then
+	if output, err := exec.Command("/sbin/route", "-n", "get", "default").Output(); err == nil {
+		info.Interface, info.Gateway = parseDefaultRoute(string(output))
 	}
 
-	// Convert to human-readable format
-	totalSeconds := uint64(uptime.Length)
-	days := totalSeconds / 86400
-	hours := (totalSeconds % 86400) / 3600
-	minutes := (totalSeconds % 3600) / 60
+	if info.Interface != "" {
+		if iface, err := net.InterfaceByName(info.Interface); err == nil {
+			if addrs, err := iface.Addrs(); err == nil {
+				info.IPv4, info.IPv6 = splitAddresses(addrs)
+			}
+		}
+	}
 
-	var uptimeHuman string
-	if days > 0 {
-		uptimeHuman = fmt.Sprintf("%d days, %d:%02d", days, hours, minutes)
-	} else {
-		uptimeHuman = fmt.Sprintf("%d:%02d", hours, minutes)
+	if ifaces, err := net.Interfaces(); err == nil {
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagUp == 0 || !isVPNInterface(iface.Name) {
+				continue
+			}
+			addrs, err := iface.Addrs()
+			if err != nil {
+				continue
+			}
+			// macOS keeps a few utun interfaces with only link-local addresses for system services
+			if ipv4, ipv6 := splitAddresses(addrs); len(ipv4) > 0 || len(ipv6) > 0 {
+				info.VPNInterfaces = append(info.VPNInterfaces, iface.Name)
+			}
+		}
+		info.VPN = len(info.VPNInterfaces) > 0
 	}
 
-	return &UptimeInfo{
-		Seconds: totalSeconds,
-		Human:   uptimeHuman,
-	}, nil
-}
+	output, err := exec.Command("/usr/sbin/networksetup", "-listallhardwareports").Output()
+	if err != nil {
+		log.Printf("Error running networksetup: %v", err)
+		return info
+	}
+	info.WiFiDevice = parseHardwarePorts(string(output))["Wi-Fi"]
+	if info.WiFiDevice == "" {
+		return info
+	}
 
-func (app *Application) updateBattery(client mqtt.Client) {
-	token := client.Publish(app.getTopicPrefix()+"/status/battery", 0, false, getBatteryChargePercent())
-	token.Wait()
+	output, err = exec.Command("/usr/sbin/ipconfig", "getsummary", info.WiFiDevice).Output()
+	if err != nil {
+		log.Printf("Error running ipconfig: %v", err)
+		return info
+	}
+	info.SSID, info.BSSID, info.WiFiConnected = parseIpconfigSummary(string(output))
+	return info
 }
 
-func (app *Application) updateCaffeinateStatus(client mqtt.Client) {
-	token := client.Publish(app.getTopicPrefix()+"/status/caffeinate", 0, false, strconv.FormatBool(getCaffeinateStatus()))
-	token.Wait()
+// AirPortInfo holds the Wi-Fi details that are only available from system_profiler
+type AirPortInfo struct {
+	Device    string
+	SSID      string
+	RSSI      int
+	LinkRate  int
+	UpdatedAt time.Time
 }
 
-func (app *Application) updateDiskUsage(client mqtt.Client) {
-	diskUsage, err := getDiskUsage()
+// getAirPortInfo reads the SSID, signal strength and link rate of a Wi-Fi interface.
+// system_profiler takes a few seconds, so it runs in the background.
+func getAirPortInfo(device string) (AirPortInfo, error) {
+	output, err := exec.Command("/usr/sbin/system_profiler", "SPAirPortDataType", "-json").Output()
 	if err != nil {
-		log.Printf("Failed to get disk usage: %v", err)
-		return
+		return AirPortInfo{}, fmt.Errorf("error running system_profiler: %w", err)
 	}
-
-	// Publish individual metrics
-	client.Publish(app.getTopicPrefix()+"/status/disk/total", 0, false, fmt.Sprintf("%d", diskUsage.Total))
-	client.Publish(app.getTopicPrefix()+"/status/disk/used", 0, false, fmt.Sprintf("%d", diskUsage.Used))
-	client.Publish(app.getTopicPrefix()+"/status/disk/free", 0, false, fmt.Sprintf("%d", diskUsage.Free))
-	client.Publish(app.getTopicPrefix()+"/status/disk/used_percent", 0, false, fmt.Sprintf("%.2f", diskUsage.UsedPercent))
-	client.Publish(app.getTopicPrefix()+"/status/disk/free_percent", 0, false, fmt.Sprintf("%.2f", diskUsage.FreePercent))
+	ssid, rssi, linkRate, err := parseAirPortInfo(output, device)
+	if err != nil {
+		return AirPortInfo{}, err
+	}
+	return AirPortInfo{Device: device, SSID: ssid, RSSI: rssi, LinkRate: linkRate, UpdatedAt: time.Now()}, nil
 }
 
-func (app *Application) updateCPUUsage(client mqtt.Client) {
-	cpuUsage, err := app.getCPUUsage()
-	if err != nil {
-		log.Printf("Failed to get CPU usage: %v", err)
+// mergeAirPortInfo adds the Wi-Fi details of the last system_profiler lookup to the network state.
+// ipconfig redacts the SSID on recent macOS versions, then the SSID from system_profiler is used.
+func mergeAirPortInfo(info *NetworkInfo, airPort AirPortInfo) {
+	if !info.WiFiConnected || airPort.Device != info.WiFiDevice || airPort.UpdatedAt.IsZero() {
 		return
 	}
+	if info.SSID == "" {
+		info.SSID = airPort.SSID
+	}
+	info.RSSI, info.LinkRate = airPort.RSSI, airPort.LinkRate
+}
 
-	// Publish CPU metrics
-	client.Publish(app.getTopicPrefix()+"/status/cpu/used_percent", 0, false, fmt.Sprintf("%.2f", cpuUsage.UsedPercent))
-	client.Publish(app.getTopicPrefix()+"/status/cpu/free_percent", 0, false, fmt.Sprintf("%.2f", cpuUsage.FreePercent))
+// parseDefaultRoute parses the interface and gateway from route -n get default output:
+//
+//	  gateway: 192.168.1.1
+//	interface: en0
+func parseDefaultRoute(output string) (string, string) {
+	var iface, gateway string
+	for _, line := range strings.Split(output, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "interface":
+			iface = strings.TrimSpace(value)
+		case "gateway":
+			gateway = strings.TrimSpace(value)
+		}
+	}
+	return iface, gateway
 }
 
-func (app *Application) updateMemoryUsage(client mqtt.Client) {
-	memUsage, err := getMemoryUsage()
-	if err != nil {
-		log.Printf("Failed to get memory usage: %v", err)
-		return
+// parseHardwarePorts parses networksetup -listallhardwareports output into devices by hardware port name:
+//
+//	Hardware Port: Wi-Fi
+//	Device: en0
+func parseHardwarePorts(output string) map[string]string {
+	ports := make(map[string]string)
+	var port string
+	for _, line := range strings.Split(output, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "Hardware Port":
+			port = strings.TrimSpace(value)
+		case "Device":
+			if port != "" {
+				ports[port] = strings.TrimSpace(value)
+			}
+			port = ""
+		}
 	}
+	return ports
+}
 
-	// Publish memory metrics
-	client.Publish(app.getTopicPrefix()+"/status/memory/total", 0, false, fmt.Sprintf("%d", memUsage.Total))
-	client.Publish(app.getTopicPrefix()+"/status/memory/used", 0, false, fmt.Sprintf("%d", memUsage.Used))
-	client.Publish(app.getTopicPrefix()+"/status/memory/free", 0, false, fmt.Sprintf("%d", memUsage.Free))
-	client.Publish(app.getTopicPrefix()+"/status/memory/used_percent", 0, false, fmt.Sprintf("%.2f", memUsage.UsedPercent))
-	client.Publish(app.getTopicPrefix()+"/status/memory/free_percent", 0, false, fmt.Sprintf("%.2f", memUsage.FreePercent))
+// parseIpconfigSummary parses the SSID and BSSID from ipconfig getsummary output, and whether the interface
+// is connected. Recent macOS versions redact the SSID and BSSID as <redacted> unless ipconfig setverbose 1
+// was run as root; they are returned empty then, but the interface still counts as connected.
+func parseIpconfigSummary(output string) (string, string, bool) {
+	var ssid, bssid string
+	var connected bool
+	for _, line := range strings.Split(output, "\n") {
+		key, value, ok := strings.Cut(line, " : ")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "LinkStatusActive":
+			connected = connected || value == "TRUE"
+		case "SSID":
+			connected = true
+			if value != "<redacted>" {
+				ssid = value
+			}
+		case "BSSID":
+			connected = true
+			if value != "<redacted>" {
+				bssid = value
+			}
+		}
+	}
+	return ssid, bssid, connected
 }
 
-func (app *Application) updateUptime(client mqtt.Client) {
-	uptime, err := getSystemUptime()
-	if err != nil {
-		log.Printf("Failed to get uptime: %v", err)
-		return
+// parseAirPortInfo parses the SSID, signal strength (dBm) and link rate (Mbit/s) of a Wi-Fi
+// interface from system_profiler SPAirPortDataType -json output
+func parseAirPortInfo(output []byte, device string) (string, int, int, error) {
+	var data struct {
+		SPAirPortDataType []struct {
+			Interfaces []struct {
+				Name    string `json:"_name"`
+				Network *struct {
+					Name        string `json:"_name"`
+					Rate        int    `json:"spairport_network_rate"`
+					SignalNoise string `json:"spairport_signal_noise"` // "-55 dBm / -92 dBm"
+				} `json:"spairport_current_network_information"`
+			} `json:"spairport_airport_interfaces"`
+		} `json:"SPAirPortDataType"`
+	}
+	if err := json.Unmarshal(output, &data); err != nil {
+		return "", 0, 0, fmt.Errorf("error parsing system_profiler output: %w", err)
+	}
+
+	for _, entry := range data.SPAirPortDataType {
+		for _, iface := range entry.Interfaces {
+			if iface.Name != device {
+				continue
+			}
+			if iface.Network == nil {
+				return "", 0, 0, nil
+			}
+			var rssi int
+			fmt.Sscanf(iface.Network.SignalNoise, "%d dBm", &rssi)
+			return iface.Network.Name, rssi, iface.Network.Rate, nil
+		}
 	}
+	return "", 0, 0, fmt.Errorf("interface %s not found in system_profiler output", device)
+}
 
-	// Publish uptime metrics
-	client.Publish(app.getTopicPrefix()+"/status/uptime/seconds", 0, false, fmt.Sprintf("%d", uptime.Seconds))
-	client.Publish(app.getTopicPrefix()+"/status/uptime/human", 0, false, uptime.Human)
+// splitAddresses returns the IPv4 and IPv6 addresses, leaving out link-local addresses
+func splitAddresses(addrs []net.Addr) ([]string, []string) {
+	var ipv4, ipv6 []string
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() || ipNet.IP.IsLoopback() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			ipv4 = append(ipv4, ipNet.IP.String())
+		} else {
+			ipv6 = append(ipv6, ipNet.IP.String())
+		}
+	}
+	return ipv4, ipv6
 }
 
-func getMediaDevicesState() (bool, bool, error) {
-	isMicOn, err := mediadevices.IsMicrophoneOn()
-	if err != nil {
-		return false, false, fmt.Errorf("failed to get microphone state: %w", err)
+// isVPNInterface reports whether an interface is a tunnel that VPN clients use
+func isVPNInterface(name string) bool {
+	for _, prefix := range []string{"utun", "ipsec", "ppp", "tun", "tap", "wg"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
 	}
+	return false
+}
 
-	isCameraOn, err := mediadevices.IsCameraOn()
-	if err != nil {
-		return isMicOn, false, fmt.Errorf("failed to get camera state: %w", err)
+// getNetworkEvents returns the event types for the differences between two network states
+func getNetworkEvents(previous, current *NetworkInfo) []string {
+	var events []string
+	if previous.Interface != current.Interface {
+		events = append(events, "interface_changed")
+	}
+	if previous.SSID != current.SSID || previous.BSSID != current.BSSID {
+		events = append(events, "wifi_changed")
+	}
+	if previous.Gateway != current.Gateway {
+		events = append(events, "gateway_changed")
+	}
+	if strings.Join(previous.IPv4, ",") != strings.Join(current.IPv4, ",") {
+		events = append(events, "ip_changed")
 	}
+	if !previous.VPN && current.VPN {
+		events = append(events, "vpn_connected")
+	}
+	if previous.VPN && !current.VPN {
+		events = append(events, "vpn_disconnected")
+	}
+	return events
+}
 
-	return isMicOn, isCameraOn, nil
+// getNetworkInfoSnapshot returns the last network state, nil before the first update
+func (app *Application) getNetworkInfoSnapshot() *NetworkInfo {
+	app.networkMutex.RLock()
+	defer app.networkMutex.RUnlock()
+	return app.networkInfo
 }
 
-func (app *Application) updateMediaDevices(client mqtt.Client) {
-	isMicOn, isCameraOn, err := getMediaDevicesState()
-	if err != nil {
-		log.Printf("Failed to get media devices state: %v", err)
-		// Publish "unknown" state on error
-		client.Publish(app.getTopicPrefix()+"/status/microphone", 0, false, "OFF")
-		client.Publish(app.getTopicPrefix()+"/status/camera", 0, false, "OFF")
+// updateNetworkInfo reads the network state, publishes it and publishes an event for each change
+func (app *Application) updateNetworkInfo(client mqtt.Client) {
+	current := getNetworkInfo()
+
+	app.networkMutex.Lock()
+	previous := app.networkInfo
+	if !current.WiFiConnected {
+		// Another network may be joined next, its details must not come from this one
+		app.airPortInfo = AirPortInfo{}
+	}
+	mergeAirPortInfo(current, app.airPortInfo)
+	app.networkInfo = current
+	app.networkMutex.Unlock()
+
+	app.startAirPortInfoUpdate(client, current)
+
+	app.publishNetworkInfo(client)
+
+	// The first update has nothing to compare with
+	if previous == nil {
+		return
+	}
+	events := getNetworkEvents(previous, current)
+	if len(events) > 0 {
+		// The public IP may be different on the new network
+		app.clearPublicIPCache()
+	}
+	if client == nil || !client.IsConnected() {
+		return
+	}
+	for _, eventType := range events {
+		log.Printf("Network event: %s (interface %s, SSID %q, gateway %s)", eventType, current.Interface, current.SSID, current.Gateway)
+		eventJSON, _ := json.Marshal(map[string]interface{}{
+			"event_type": eventType,
+			"interface":  current.Interface,
+			"ssid":       current.SSID,
+			"bssid":      current.BSSID,
+			"gateway":    current.Gateway,
+			"ipv4":       current.IPv4,
+			"vpn":        current.VPN,
+			"timestamp":  time.Now().Format(time.RFC3339),
+		})
+		client.Publish(app.getTopicPrefix()+"/events/network", 0, false, string(eventJSON))
+	}
+}
+
+// startAirPortInfoUpdate starts a system_profiler lookup when Wi-Fi is connected and the last lookup is too old.
+// When the lookup finds new details, the network state is updated and published again.
+func (app *Application) startAirPortInfoUpdate(client mqtt.Client, info *NetworkInfo) {
+	if !info.WiFiConnected {
 		return
 	}
 
-	// Publish media device states
-	micState := "OFF"
-	if isMicOn {
-		micState = "ON"
-	}
-	cameraState := "OFF"
-	if isCameraOn {
-		cameraState = "ON"
+	app.networkMutex.Lock()
+	defer app.networkMutex.Unlock()
+	if app.airPortDone != nil ||
+		(app.airPortInfo.Device == info.WiFiDevice && time.Since(app.airPortInfo.UpdatedAt) < AirPortInfoInterval) {
+		return
 	}
+	done := make(chan struct{})
+	app.airPortDone = done
 
-	client.Publish(app.getTopicPrefix()+"/status/microphone", 0, false, micState)
-	client.Publish(app.getTopicPrefix()+"/status/camera", 0, false, cameraState)
-}
-
-func getPublicIP() (string, error) {
-	// Use DNS over HTTPS to query Cloudflare's whoami service
-	resolver := &net.Resolver{
-		PreferGo: true,
-		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
-			d := net.Dialer{
-				Timeout: 5 * time.Second,
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("Wi-Fi lookup goroutine recovered from panic: %v", r)
 			}
-			return d.DialContext(ctx, "udp", "ns1.google.com:53")
+		}()
 
-		},
-	}
+		airPort, err := getAirPortInfo(info.WiFiDevice)
+		if err != nil {
+			log.Printf("Error getting Wi-Fi information: %v", err)
+			// Don't retry on every network check
+			airPort = AirPortInfo{Device: info.WiFiDevice, UpdatedAt: time.Now()}
+		}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+		app.networkMutex.Lock()
+		previous := app.airPortInfo
+		app.airPortInfo = airPort
+		app.airPortDone = nil
+		app.networkMutex.Unlock()
+		close(done)
 
-	// Query TXT record from Cloudflare's whoami service
-	txtRecords, err := resolver.LookupTXT(ctx, "o-o.myaddr.l.google.com")
-	if err != nil {
-		return "", fmt.Errorf("failed to lookup public IP via DNS: %w", err)
+		if airPort.SSID != previous.SSID || airPort.RSSI != previous.RSSI || airPort.LinkRate != previous.LinkRate {
+			app.updateNetworkInfo(client)
+		}
+	}()
+}
+
+// waitForAirPortInfo waits until the running system_profiler lookup finished, at most timeout
+func (app *Application) waitForAirPortInfo(timeout time.Duration) {
+	app.networkMutex.RLock()
+	done := app.airPortDone
+	app.networkMutex.RUnlock()
+	if done == nil {
+		return
 	}
 
-	if len(txtRecords) > 0 {
-		return txtRecords[0], nil
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("Wi-Fi information not available after %s, continuing without it", timeout)
+	}
+}
+
+// publishNetworkInfo publishes the last network state
+func (app *Application) publishNetworkInfo(client mqtt.Client) {
+	if client == nil || !client.IsConnected() {
+		return
+	}
+	info := app.getNetworkInfoSnapshot()
+	if info == nil {
+		return
 	}
 
-	return "", fmt.Errorf("no IP address found in DNS response")
+	first := func(values []string) string {
+		if len(values) == 0 {
+			return ""
+		}
+		return values[0]
+	}
+	vpn := "OFF"
+	if info.VPN {
+		vpn = "ON"
+	}
+
+	infoJSON, _ := json.Marshal(info)
+	client.Publish(app.getTopicPrefix()+"/status/network/interface", 0, false, info.Interface)
+	client.Publish(app.getTopicPrefix()+"/status/network/interface_attr", 0, false, string(infoJSON))
+	client.Publish(app.getTopicPrefix()+"/status/network/gateway", 0, false, info.Gateway)
+	client.Publish(app.getTopicPrefix()+"/status/network/ipv4", 0, false, first(info.IPv4))
+	client.Publish(app.getTopicPrefix()+"/status/network/ipv6", 0, false, first(info.IPv6))
+	client.Publish(app.getTopicPrefix()+"/status/network/vpn", 0, false, vpn)
+	client.Publish(app.getTopicPrefix()+"/status/wifi/ssid", 0, false, info.SSID)
+	client.Publish(app.getTopicPrefix()+"/status/wifi/bssid", 0, false, info.BSSID)
+	client.Publish(app.getTopicPrefix()+"/status/wifi/rssi", 0, false, strconv.Itoa(info.RSSI))
+	client.Publish(app.getTopicPrefix()+"/status/wifi/link_rate", 0, false, strconv.Itoa(info.LinkRate))
 }
 
 func (app *Application) updatePublicIP(client mqtt.Client) {
-	publicIP, err := getPublicIP()
-	if err != nil {
-		log.Printf("Failed to get public IP: %v", err)
-		// Publish empty string on error
-		client.Publish(app.getTopicPrefix()+"/status/public_ip", 0, false, "unavailable")
-		return
+	families := []string{"ipv4"}
+	app.profileMutex.RLock()
+	if app.config.PublicIP.IPv6 {
+		families = append(families, "ipv6")
+	}
+	app.profileMutex.RUnlock()
+
+	attributes := make(map[string]interface{})
+	for _, family := range families {
+		topic := app.getTopicPrefix() + "/status/public_ip"
+		if family == "ipv6" {
+			topic = app.getTopicPrefix() + "/status/public_ipv6"
+		}
+
+		entry, err := app.getPublicIP(family)
+		if err != nil {
+			log.Printf("Failed to get public IP: %v", err)
+			// Publish unavailable on error
+			client.Publish(topic, 0, false, "unavailable")
+			continue
+		}
+
+		// Publish public IP
+		client.Publish(topic, 0, false, entry.IP)
+		attributes[family+"_resolver"] = entry.Resolver
+		attributes[family+"_updated_at"] = entry.UpdatedAt.Format(time.RFC3339)
 	}
 
-	// Publish public IP
-	client.Publish(app.getTopicPrefix()+"/status/public_ip", 0, false, publicIP)
+	attributesJSON, _ := json.Marshal(attributes)
+	client.Publish(app.getTopicPrefix()+"/status/public_ip_attr", 0, false, string(attributesJSON))
 }
 
 func (app *Application) setDevice(client mqtt.Client) {
@@ -1813,6 +7374,34 @@ func (app *Application) setDevice(client mqtt.Client) {
 		"icon":          "mdi:monitor-star",
 	}
 
+	lockScreen := map[string]interface{}{
+		"p":             "button",
+		"name":          "Lock Screen",
+		"unique_id":     app.hostname + "_lock",
+		"command_topic": app.getTopicPrefix() + "/command/set",
+		"payload_press": "lock",
+		"icon":          "mdi:monitor-lock",
+	}
+
+	screenLocked := map[string]interface{}{
+		"p":           "binary_sensor",
+		"name":        "Screen Locked",
+		"unique_id":   app.hostname + "_screen_locked",
+		"state_topic": app.getTopicPrefix() + "/status/screen_locked",
+		"payload_on":  "ON",
+		"payload_off": "OFF",
+		"icon":        "mdi:lock",
+	}
+
+	frontmostApp := map[string]interface{}{
+		"p":                     "sensor",
+		"name":                  "Frontmost App",
+		"unique_id":             app.hostname + "_frontmost_app",
+		"state_topic":           app.getTopicPrefix() + "/status/frontmost_app",
+		"json_attributes_topic": app.getTopicPrefix() + "/status/frontmost_app_attr",
+		"icon":                  "mdi:application-outline",
+	}
+
 	sleep := map[string]interface{}{
 		"p":             "button",
 		"name":          "Sleep",
@@ -1855,6 +7444,56 @@ func (app *Application) setDevice(client mqtt.Client) {
 		"icon":          "mdi:volume-high",
 	}
 
+	inputMute := map[string]interface{}{
+		"p":             "switch",
+		"name":          "Input Mute",
+		"unique_id":     app.hostname + "_input_mute",
+		"command_topic": app.getTopicPrefix() + "/command/input_mute",
+		"payload_on":    "true",
+		"payload_off":   "false",
+		"state_topic":   app.getTopicPrefix() + "/status/input_mute",
+		"icon":          "mdi:microphone-off",
+	}
+
+	inputVolume := map[string]interface{}{
+		"p":             "number",
+		"name":          "Input Volume",
+		"unique_id":     app.hostname + "_input_volume",
+		"command_topic": app.getTopicPrefix() + "/command/input_volume",
+		"state_topic":   app.getTopicPrefix() + "/status/input_volume",
+		"min_value":     MinVolume,
+		"max_value":     MaxVolume,
+		"step":          1,
+		"mode":          "slider",
+		"icon":          "mdi:microphone",
+	}
+
+	// Device selects are only added when switchaudiosource lists devices
+	audioOutput := map[string]interface{}{"p": "select"}
+	if names := app.getAudioDeviceNames("output"); len(names) > 0 {
+		audioOutput = map[string]interface{}{
+			"p":             "select",
+			"name":          "Audio Output",
+			"unique_id":     app.hostname + "_audio_output",
+			"command_topic": app.getTopicPrefix() + "/command/audio_output",
+			"state_topic":   app.getTopicPrefix() + "/status/audio_output",
+			"options":       names,
+			"icon":          "mdi:speaker",
+		}
+	}
+	audioInput := map[string]interface{}{"p": "select"}
+	if names := app.getAudioDeviceNames("input"); len(names) > 0 {
+		audioInput = map[string]interface{}{
+			"p":             "select",
+			"name":          "Audio Input",
+			"unique_id":     app.hostname + "_audio_input",
+			"command_topic": app.getTopicPrefix() + "/command/audio_input",
+			"state_topic":   app.getTopicPrefix() + "/status/audio_input",
+			"options":       names,
+			"icon":          "mdi:microphone-settings",
+		}
+	}
+
 	battery := map[string]interface{}{
 		"p":                   "sensor",
 		"name":                "Battery",
@@ -1865,6 +7504,95 @@ func (app *Application) setDevice(client mqtt.Client) {
 		"device_class":        "battery",
 	}
 
+	batteryChargingState := map[string]interface{}{
+		"p":                  "sensor",
+		"name":               "Battery Charging State",
+		"unique_id":          app.hostname + "_battery_charging_state",
+		"state_topic":        app.getTopicPrefix() + "/status/battery/charging_state",
+		"enabled_by_default": false,
+		"device_class":       "enum",
+		"options":            []string{"charging", "discharging", "charged", "finishing_charge", "not_charging"},
+		"icon":               "mdi:battery-charging",
+	}
+
+	powerSource := map[string]interface{}{
+		"p":            "sensor",
+		"name":         "Power Source",
+		"unique_id":    app.hostname + "_power_source",
+		"state_topic":  app.getTopicPrefix() + "/status/battery/power_source",
+		"device_class": "enum",
+		"options":      []string{"ac", "battery", "ups"},
+		"icon":         "mdi:power-plug",
+	}
+
+	batteryTimeRemaining := map[string]interface{}{
+		"p":                   "sensor",
+		"name":                "Battery Time Remaining",
+		"unique_id":           app.hostname + "_battery_time_remaining",
+		"state_topic":         app.getTopicPrefix() + "/status/battery/time_remaining",
+		"enabled_by_default":  false,
+		"unit_of_measurement": "min",
+		"device_class":        "duration",
+		"icon":                "mdi:battery-clock",
+	}
+
+	batteryCycleCount := map[string]interface{}{
+		"p":                  "sensor",
+		"name":               "Battery Cycle Count",
+		"unique_id":          app.hostname + "_battery_cycle_count",
+		"state_topic":        app.getTopicPrefix() + "/status/battery/cycle_count",
+		"enabled_by_default": false,
+		"state_class":        "total_increasing",
+		"entity_category":    "diagnostic",
+		"icon":               "mdi:battery-sync",
+	}
+
+	batteryHealth := map[string]interface{}{
+		"p":                   "sensor",
+		"name":                "Battery Health",
+		"unique_id":           app.hostname + "_battery_health",
+		"state_topic":         app.getTopicPrefix() + "/status/battery/health",
+		"enabled_by_default":  false,
+		"unit_of_measurement": "%",
+		"state_class":         "measurement",
+		"entity_category":     "diagnostic",
+		"icon":                "mdi:battery-heart-variant",
+	}
+
+	batteryCondition := map[string]interface{}{
+		"p":                  "sensor",
+		"name":               "Battery Condition",
+		"unique_id":          app.hostname + "_battery_condition",
+		"state_topic":        app.getTopicPrefix() + "/status/battery/condition",
+		"enabled_by_default": false,
+		"entity_category":    "diagnostic",
+		"icon":               "mdi:battery-alert-variant-outline",
+	}
+
+	batteryTemperature := map[string]interface{}{
+		"p":                   "sensor",
+		"name":                "Battery Temperature",
+		"unique_id":           app.hostname + "_battery_temperature",
+		"state_topic":         app.getTopicPrefix() + "/status/battery/temperature",
+		"enabled_by_default":  false,
+		"unit_of_measurement": "°C",
+		"device_class":        "temperature",
+		"state_class":         "measurement",
+		"entity_category":     "diagnostic",
+	}
+
+	adapterWatts := map[string]interface{}{
+		"p":                   "sensor",
+		"name":                "Power Adapter",
+		"unique_id":           app.hostname + "_adapter_watts",
+		"state_topic":         app.getTopicPrefix() + "/status/battery/adapter_watts",
+		"enabled_by_default":  false,
+		"unit_of_measurement": "W",
+		"device_class":        "power",
+		"state_class":         "measurement",
+		"icon":                "mdi:power-plug-battery",
+	}
+
 	diskTotal := map[string]interface{}{
 		"p":                   "sensor",
 		"name":                "Disk Total",
@@ -1938,6 +7666,29 @@ func (app *Application) setDevice(client mqtt.Client) {
 		"icon":                "mdi:cpu-64-bit",
 	}
 
+	cpuLoad := make(map[string]map[string]interface{})
+	for _, minutes := range []string{"1", "5", "15"} {
+		cpuLoad["cpu_load_"+minutes] = map[string]interface{}{
+			"p":               "sensor",
+			"name":            "Load Average " + minutes + "m",
+			"unique_id":       app.hostname + "_cpu_load_" + minutes,
+			"state_topic":     app.getTopicPrefix() + "/status/cpu/load_" + minutes,
+			"state_class":     "measurement",
+			"icon":            "mdi:gauge",
+			"entity_category": "diagnostic",
+		}
+	}
+
+	thermalPressure := map[string]interface{}{
+		"p":            "sensor",
+		"name":         "Thermal Pressure",
+		"unique_id":    app.hostname + "_thermal_pressure",
+		"state_topic":  app.getTopicPrefix() + "/status/cpu/thermal_pressure",
+		"device_class": "enum",
+		"options":      thermalPressureLevels,
+		"icon":         "mdi:thermometer-alert",
+	}
+
 	memoryTotal := map[string]interface{}{
 		"p":                   "sensor",
 		"name":                "Memory Total",
@@ -1991,6 +7742,36 @@ func (app *Application) setDevice(client mqtt.Client) {
 		"icon":                "mdi:memory",
 	}
 
+	memoryPressure := map[string]interface{}{
+		"p":            "sensor",
+		"name":         "Memory Pressure",
+		"unique_id":    app.hostname + "_memory_pressure",
+		"state_topic":  app.getTopicPrefix() + "/status/memory/pressure",
+		"device_class": "enum",
+		"options":      memoryPressureLevels,
+		"icon":         "mdi:memory",
+	}
+
+	memoryDetails := make(map[string]map[string]interface{})
+	for _, detail := range []struct{ key, name string }{
+		{"app", "Memory App"},
+		{"wired", "Memory Wired"},
+		{"compressed", "Memory Compressed"},
+		{"swap_total", "Swap Total"},
+		{"swap_used", "Swap Used"},
+	} {
+		memoryDetails["memory_"+detail.key] = map[string]interface{}{
+			"p":                   "sensor",
+			"name":                detail.name,
+			"unique_id":           app.hostname + "_memory_" + detail.key,
+			"state_topic":         app.getTopicPrefix() + "/status/memory/" + detail.key,
+			"unit_of_measurement": "B",
+			"device_class":        "data_size",
+			"state_class":         "measurement",
+			"icon":                "mdi:memory",
+		}
+	}
+
 	uptimeSeconds := map[string]interface{}{
 		"p":                   "sensor",
 		"name":                "Uptime Seconds",
@@ -2033,22 +7814,149 @@ func (app *Application) setDevice(client mqtt.Client) {
 	}
 
 	publicIP := map[string]interface{}{
+		"p":                     "sensor",
+		"name":                  "Public IP",
+		"unique_id":             app.hostname + "_public_ip",
+		"state_topic":           app.getTopicPrefix() + "/status/public_ip",
+		"json_attributes_topic": app.getTopicPrefix() + "/status/public_ip_attr",
+		"icon":                  "mdi:ip-network",
+	}
+
+	// The IPv6 sensor is removed again when the active profile doesn't look it up
+	publicIPv6 := map[string]interface{}{"p": "sensor"}
+	app.profileMutex.RLock()
+	lookupIPv6 := app.config.PublicIP.IPv6
+	app.profileMutex.RUnlock()
+	if lookupIPv6 {
+		publicIPv6 = map[string]interface{}{
+			"p":           "sensor",
+			"name":        "Public IPv6",
+			"unique_id":   app.hostname + "_public_ipv6",
+			"state_topic": app.getTopicPrefix() + "/status/public_ipv6",
+			"icon":        "mdi:ip-network",
+		}
+	}
+
+	networkInterface := map[string]interface{}{
+		"p":                     "sensor",
+		"name":                  "Network Interface",
+		"unique_id":             app.hostname + "_network_interface",
+		"state_topic":           app.getTopicPrefix() + "/status/network/interface",
+		"json_attributes_topic": app.getTopicPrefix() + "/status/network/interface_attr",
+		"icon":                  "mdi:lan",
+	}
+
+	networkGateway := map[string]interface{}{
+		"p":               "sensor",
+		"name":            "Default Gateway",
+		"unique_id":       app.hostname + "_network_gateway",
+		"state_topic":     app.getTopicPrefix() + "/status/network/gateway",
+		"entity_category": "diagnostic",
+		"icon":            "mdi:router-network",
+	}
+
+	localIPv4 := map[string]interface{}{
+		"p":           "sensor",
+		"name":        "Local IPv4",
+		"unique_id":   app.hostname + "_network_ipv4",
+		"state_topic": app.getTopicPrefix() + "/status/network/ipv4",
+		"icon":        "mdi:ip-network-outline",
+	}
+
+	localIPv6 := map[string]interface{}{
+		"p":               "sensor",
+		"name":            "Local IPv6",
+		"unique_id":       app.hostname + "_network_ipv6",
+		"state_topic":     app.getTopicPrefix() + "/status/network/ipv6",
+		"entity_category": "diagnostic",
+		"icon":            "mdi:ip-network-outline",
+	}
+
+	vpn := map[string]interface{}{
+		"p":            "binary_sensor",
+		"name":         "VPN",
+		"unique_id":    app.hostname + "_vpn",
+		"state_topic":  app.getTopicPrefix() + "/status/network/vpn",
+		"payload_on":   "ON",
+		"payload_off":  "OFF",
+		"device_class": "connectivity",
+		"icon":         "mdi:vpn",
+	}
+
+	wifiSSID := map[string]interface{}{
 		"p":           "sensor",
-		"name":        "Public IP",
-		"unique_id":   app.hostname + "_public_ip",
-		"state_topic": app.getTopicPrefix() + "/status/public_ip",
-		"icon":        "mdi:ip-network",
+		"name":        "Wi-Fi SSID",
+		"unique_id":   app.hostname + "_wifi_ssid",
+		"state_topic": app.getTopicPrefix() + "/status/wifi/ssid",
+		"icon":        "mdi:wifi",
+	}
+
+	wifiBSSID := map[string]interface{}{
+		"p":               "sensor",
+		"name":            "Wi-Fi BSSID",
+		"unique_id":       app.hostname + "_wifi_bssid",
+		"state_topic":     app.getTopicPrefix() + "/status/wifi/bssid",
+		"entity_category": "diagnostic",
+		"icon":            "mdi:access-point",
+	}
+
+	wifiRSSI := map[string]interface{}{
+		"p":                   "sensor",
+		"name":                "Wi-Fi Signal",
+		"unique_id":           app.hostname + "_wifi_rssi",
+		"state_topic":         app.getTopicPrefix() + "/status/wifi/rssi",
+		"unit_of_measurement": "dBm",
+		"device_class":        "signal_strength",
+		"state_class":         "measurement",
+		"entity_category":     "diagnostic",
+		"icon":                "mdi:wifi-strength-2",
+	}
+
+	wifiLinkRate := map[string]interface{}{
+		"p":                   "sensor",
+		"name":                "Wi-Fi Link Rate",
+		"unique_id":           app.hostname + "_wifi_link_rate",
+		"state_topic":         app.getTopicPrefix() + "/status/wifi/link_rate",
+		"unit_of_measurement": "Mbit/s",
+		"device_class":        "data_rate",
+		"state_class":         "measurement",
+		"entity_category":     "diagnostic",
+		"icon":                "mdi:speedometer",
+	}
+
+	networkEvent := map[string]interface{}{
+		"p":           "event",
+		"name":        "Network Event",
+		"unique_id":   app.hostname + "_network_event",
+		"state_topic": app.getTopicPrefix() + "/events/network",
+		"event_types": []string{"interface_changed", "wifi_changed", "gateway_changed", "ip_changed", "vpn_connected", "vpn_disconnected"},
+		"icon":        "mdi:lan-pending",
 	}
 
 	components := map[string]interface{}{
 		"sleep":               sleep,
 		"shutdown":            shutdown,
 		"volume":              volume,
+		"input_mute":          inputMute,
+		"input_volume":        inputVolume,
+		"audio_output":        audioOutput,
+		"audio_input":         audioInput,
 		"mute":                mute,
 		"displaywake":         displaywake,
 		"displaysleep":        displaysleep,
 		"screensaver":         screensaver,
+		"lock":                lockScreen,
+		"screen_locked":       screenLocked,
+		"frontmost_app":       frontmostApp,
 		"battery":             battery,
+		"battery_charging":    batteryChargingState,
+		"power_source":        powerSource,
+		"battery_remaining":   batteryTimeRemaining,
+		"battery_cycle_count": batteryCycleCount,
+		"battery_health":      batteryHealth,
+		"battery_condition":   batteryCondition,
+		"battery_temperature": batteryTemperature,
+		"adapter_watts":       adapterWatts,
 		"keepawake":           keepawake,
 		"disk_total":          diskTotal,
 		"disk_used":           diskUsed,
@@ -2057,16 +7965,29 @@ func (app *Application) setDevice(client mqtt.Client) {
 		"disk_free_percent":   diskFreePercent,
 		"cpu_used_percent":    cpuUsedPercent,
 		"cpu_free_percent":    cpuFreePercent,
+		"thermal_pressure":    thermalPressure,
 		"memory_total":        memoryTotal,
 		"memory_used":         memoryUsed,
 		"memory_free":         memoryFree,
 		"memory_used_percent": memoryUsedPercent,
 		"memory_free_percent": memoryFreePercent,
+		"memory_pressure":     memoryPressure,
 		"uptime_seconds":      uptimeSeconds,
 		"uptime_human":        uptimeHuman,
 		"microphone":          microphone,
 		"camera":              camera,
 		"public_ip":           publicIP,
+		"public_ipv6":         publicIPv6,
+		"network_interface":   networkInterface,
+		"network_gateway":     networkGateway,
+		"network_ipv4":        localIPv4,
+		"network_ipv6":        localIPv6,
+		"vpn":                 vpn,
+		"wifi_ssid":           wifiSSID,
+		"wifi_bssid":          wifiBSSID,
+		"wifi_rssi":           wifiRSSI,
+		"wifi_link_rate":      wifiLinkRate,
+		"network_event":       networkEvent,
 	}
 
 	// Add user activity sensor
@@ -2095,6 +8016,250 @@ func (app *Application) setDevice(client mqtt.Client) {
 	}
 	components["idle_time_seconds"] = idleTime
 
+	// Add presence sensors
+	presence := map[string]interface{}{
+		"p":                     "sensor",
+		"name":                  "Presence",
+		"unique_id":             app.hostname + "_presence",
+		"state_topic":           app.getTopicPrefix() + "/status/presence",
+		"json_attributes_topic": app.getTopicPrefix() + "/status/presence_attr",
+		"device_class":          "enum",
+		"options":               []string{PresenceActive, PresenceIdle, PresenceAway, PresenceLocked, PresenceAsleep},
+		"icon":                  "mdi:account-clock",
+	}
+	components["presence"] = presence
+
+	presenceChangedAt := map[string]interface{}{
+		"p":            "sensor",
+		"name":         "Presence Changed",
+		"unique_id":    app.hostname + "_presence_changed_at",
+		"state_topic":  app.getTopicPrefix() + "/status/presence_changed_at",
+		"device_class": "timestamp",
+		"icon":         "mdi:clock-check-outline",
+	}
+	components["presence_changed_at"] = presenceChangedAt
+
+	// Add sleep/wake sensors
+	lastWake := map[string]interface{}{
+		"p":            "sensor",
+		"name":         "Last Wake",
+		"unique_id":    app.hostname + "_last_wake",
+		"state_topic":  app.getTopicPrefix() + "/status/last_wake",
+		"device_class": "timestamp",
+		"icon":         "mdi:weather-sunset-up",
+	}
+	components["last_wake"] = lastWake
+
+	powerEvent := map[string]interface{}{
+		"p":           "event",
+		"name":        "Power Event",
+		"unique_id":   app.hostname + "_power_event",
+		"state_topic": app.getTopicPrefix() + "/events/power",
+		"event_types": []string{"will_sleep", "did_wake", "display_off", "display_on"},
+		"icon":        "mdi:power-sleep",
+	}
+	components["power_event"] = powerEvent
+
+	if app.config.FrontmostWindowTitle {
+		components["frontmost_window_title"] = map[string]interface{}{
+			"p":           "sensor",
+			"name":        "Frontmost Window Title",
+			"unique_id":   app.hostname + "_frontmost_window_title",
+			"state_topic": app.getTopicPrefix() + "/status/frontmost_window_title",
+			"icon":        "mdi:application-outline",
+		}
+	}
+
+	topProcess := map[string]interface{}{
+		"p":                     "sensor",
+		"name":                  "Top Process",
+		"unique_id":             app.hostname + "_top_process",
+		"state_topic":           app.getTopicPrefix() + "/status/processes/top",
+		"json_attributes_topic": app.getTopicPrefix() + "/status/processes/top_attr",
+		"icon":                  "mdi:format-list-numbered",
+	}
+	components["top_process"] = topProcess
+
+	// Add sensors for each process on the watchlist
+	for _, name := range app.config.ProcessWatchlist {
+		key := getTopicKey(name)
+		topic := app.getTopicPrefix() + "/status/processes/" + key
+		components["process_"+key+"_running"] = map[string]interface{}{
+			"p":            "binary_sensor",
+			"name":         name + " Running",
+			"unique_id":    app.hostname + "_process_" + key + "_running",
+			"state_topic":  topic + "/running",
+			"device_class": "running",
+			"icon":         "mdi:application-cog",
+		}
+		components["process_"+key+"_cpu_percent"] = map[string]interface{}{
+			"p":                   "sensor",
+			"name":                name + " CPU Percent",
+			"unique_id":           app.hostname + "_process_" + key + "_cpu_percent",
+			"state_topic":         topic + "/cpu_percent",
+			"unit_of_measurement": "%",
+			"state_class":         "measurement",
+			"icon":                "mdi:cpu-64-bit",
+		}
+		components["process_"+key+"_memory"] = map[string]interface{}{
+			"p":                   "sensor",
+			"name":                name + " Memory",
+			"unique_id":           app.hostname + "_process_" + key + "_memory",
+			"state_topic":         topic + "/memory",
+			"unit_of_measurement": "B",
+			"device_class":        "data_size",
+			"state_class":         "measurement",
+			"icon":                "mdi:memory",
+		}
+	}
+	runningApps := map[string]interface{}{
+		"p":                     "sensor",
+		"name":                  "Running Apps",
+		"unique_id":             app.hostname + "_running_apps",
+		"state_topic":           app.getTopicPrefix() + "/status/apps/running",
+		"json_attributes_topic": app.getTopicPrefix() + "/status/apps/running_attr",
+		"state_class":           "measurement",
+		"icon":                  "mdi:apps",
+	}
+	components["running_apps"] = runningApps
+
+	// Add a switch for each app in app_switches that opens and quits the app
+	for _, entry := range app.config.AppSwitches {
+		key := getTopicKey(entry)
+		components["app_"+key] = map[string]interface{}{
+			"p":             "switch",
+			"name":          entry + " Running",
+			"unique_id":     app.hostname + "_app_" + key,
+			"command_topic": app.getTopicPrefix() + "/command/app/" + key,
+			"state_topic":   app.getTopicPrefix() + "/status/apps/" + key + "/running",
+			"payload_on":    "ON",
+			"payload_off":   "OFF",
+			"icon":          "mdi:application",
+		}
+	}
+
+	bluetoothDevices := map[string]interface{}{
+		"p":                     "sensor",
+		"name":                  "Bluetooth Devices Connected",
+		"unique_id":             app.hostname + "_bluetooth_connected",
+		"state_topic":           app.getTopicPrefix() + "/status/bluetooth/connected",
+		"json_attributes_topic": app.getTopicPrefix() + "/status/bluetooth/connected_attr",
+		"state_class":           "measurement",
+		"icon":                  "mdi:bluetooth-connect",
+	}
+	components["bluetooth_connected"] = bluetoothDevices
+
+	// Add the connection state and battery levels of each Bluetooth device.
+	// With blueutil the connection state is a switch that connects and disconnects the device.
+	bluetoothPlatform := "binary_sensor"
+	if getBlueutilPath() != "" {
+		bluetoothPlatform = "switch"
+	}
+	app.bluetoothMutex.Lock()
+	for key, device := range app.bluetoothDevices {
+		topic := app.getTopicPrefix() + "/status/bluetooth/" + key
+		connected := map[string]interface{}{
+			"p":           bluetoothPlatform,
+			"name":        device.Name + " Connected",
+			"unique_id":   app.hostname + "_bluetooth_" + key + "_connected",
+			"state_topic": topic + "/connected",
+			"payload_on":  "ON",
+			"payload_off": "OFF",
+			"icon":        "mdi:bluetooth",
+		}
+		if bluetoothPlatform == "switch" {
+			connected["command_topic"] = app.getTopicPrefix() + "/command/bluetooth/" + key
+		} else {
+			connected["device_class"] = "connectivity"
+		}
+		components["bluetooth_"+key+"_connected"] = connected
+
+		for part := range device.Batteries {
+			name := device.Name + " Battery"
+			if part != "main" {
+				name += " " + strings.ToUpper(part[:1]) + part[1:]
+			}
+			components["bluetooth_"+key+"_battery_"+part] = map[string]interface{}{
+				"p":                   "sensor",
+				"name":                name,
+				"unique_id":           app.hostname + "_bluetooth_" + key + "_battery_" + part,
+				"state_topic":         topic + "/battery_" + part,
+				"unit_of_measurement": "%",
+				"device_class":        "battery",
+				"state_class":         "measurement",
+			}
+		}
+	}
+
+	// Components that only contain the platform are removed by Home Assistant
+	for _, key := range app.removedBluetooth {
+		if _, ok := app.bluetoothDevices[key]; ok {
+			continue
+		}
+		components["bluetooth_"+key+"_connected"] = map[string]interface{}{"p": bluetoothPlatform}
+		for _, part := range []string{"main", "left", "right", "case"} {
+			components["bluetooth_"+key+"_battery_"+part] = map[string]interface{}{"p": "sensor"}
+		}
+	}
+	app.removedBluetooth = nil
+	app.bluetoothMutex.Unlock()
+
+	// Add sensors for each probe
+	for _, probe := range app.config.Probes {
+		key := getTopicKey(probe.Name)
+		topic := app.getTopicPrefix() + "/status/probe/" + key
+		components["probe_"+key+"_success"] = map[string]interface{}{
+			"p":                     "binary_sensor",
+			"name":                  probe.Name + " Reachable",
+			"unique_id":             app.hostname + "_probe_" + key + "_success",
+			"state_topic":           topic + "/success",
+			"json_attributes_topic": topic + "/success_attr",
+			"device_class":          "connectivity",
+		}
+		components["probe_"+key+"_rtt"] = map[string]interface{}{
+			"p":                   "sensor",
+			"name":                probe.Name + " Round Trip Time",
+			"unique_id":           app.hostname + "_probe_" + key + "_rtt",
+			"state_topic":         topic + "/rtt",
+			"unit_of_measurement": "ms",
+			"device_class":        "duration",
+			"state_class":         "measurement",
+			"icon":                "mdi:timer-outline",
+		}
+		components["probe_"+key+"_packet_loss"] = map[string]interface{}{
+			"p":                   "sensor",
+			"name":                probe.Name + " Packet Loss",
+			"unique_id":           app.hostname + "_probe_" + key + "_packet_loss",
+			"state_topic":         topic + "/packet_loss",
+			"unit_of_measurement": "%",
+			"state_class":         "measurement",
+			"icon":                "mdi:lan-disconnect",
+		}
+	}
+
+	if len(app.config.ProcessWatchlist) > 0 {
+		components["process_event"] = map[string]interface{}{
+			"p":           "event",
+			"name":        "Process Event",
+			"unique_id":   app.hostname + "_process_event",
+			"state_topic": app.getTopicPrefix() + "/events/process",
+			"event_types": []string{"started", "stopped"},
+			"icon":        "mdi:application-cog",
+		}
+	}
+
+	powerPolicy := map[string]interface{}{
+		"p":               "sensor",
+		"name":            "Power Policy",
+		"unique_id":       app.hostname + "_power_policy",
+		"state_topic":     app.getTopicPrefix() + "/status/power_policy",
+		"device_class":    "enum",
+		"options":         []string{PowerPolicyNormal, PowerPolicyBattery, PowerPolicyLowPower},
+		"entity_category": "diagnostic",
+		"icon":            "mdi:leaf",
+	}
+	components["power_policy"] = powerPolicy
+
 	// Add media control components if Media Control is available
 	if isMediaControlAvailable() {
 		playPause := map[string]interface{}{
@@ -2115,12 +8280,240 @@ func (app *Application) setDevice(client mqtt.Client) {
 			"icon":                  "mdi:music",
 		}
 
+		mediaStream := map[string]interface{}{
+			"p":               "sensor",
+			"name":            "Media Stream",
+			"unique_id":       app.hostname + "_media_stream",
+			"state_topic":     app.getTopicPrefix() + "/status/media_stream",
+			"entity_category": "diagnostic",
+			"icon":            "mdi:heart-pulse",
+		}
+
+		mediaProgress := map[string]interface{}{
+			"p":                   "sensor",
+			"name":                "Media Progress",
+			"unique_id":           app.hostname + "_media_progress",
+			"state_topic":         app.getTopicPrefix() + "/status/media_progress",
+			"unit_of_measurement": "%",
+			"state_class":         "measurement",
+			"icon":                "mdi:progress-clock",
+		}
+
+		mediaTimeRemaining := map[string]interface{}{
+			"p":                   "sensor",
+			"name":                "Media Time Remaining",
+			"unique_id":           app.hostname + "_media_time_remaining",
+			"state_topic":         app.getTopicPrefix() + "/status/media_time_remaining",
+			"unit_of_measurement": "s",
+			"device_class":        "duration",
+			"icon":                "mdi:timer-outline",
+		}
+
 		components["playpause"] = playPause
 		components["now_playing"] = nowPlaying
+		components["media_progress"] = mediaProgress
+		components["media_time_remaining"] = mediaTimeRemaining
+		trackPlayed := map[string]interface{}{
+			"p":           "event",
+			"name":        "Track Played",
+			"unique_id":   app.hostname + "_track_played",
+			"state_topic": app.getTopicPrefix() + "/events/track_played",
+			"event_types": []string{"track_played", "track_finished"},
+			"icon":        "mdi:playlist-music",
+		}
+
+		components["media_stream"] = mediaStream
+		components["track_played"] = trackPlayed
+
+		// Add a now playing sensor for each configured app
+		for _, bundleID := range app.config.MediaAppSensors {
+			key := getTopicKey(bundleID)
+			components["now_playing_"+key] = map[string]interface{}{
+				"p":                     "sensor",
+				"name":                  "Now Playing " + bundleID,
+				"unique_id":             app.hostname + "_now_playing_" + key,
+				"state_topic":           app.getTopicPrefix() + "/status/now_playing_" + key,
+				"json_attributes_topic": app.getTopicPrefix() + "/status/now_playing_" + key + "_attr",
+				"icon":                  "mdi:music",
+			}
+		}
 	}
 
 	// Note: Media player will be published as separate standard MQTT autodiscovery message
 
+	diskFull := map[string]interface{}{
+		"p":            "binary_sensor",
+		"name":         "Disk Almost Full",
+		"unique_id":    app.hostname + "_disk_full",
+		"state_topic":  app.getTopicPrefix() + "/status/disk/full",
+		"payload_on":   "ON",
+		"payload_off":  "OFF",
+		"device_class": "problem",
+		"icon":         "mdi:harddisk-remove",
+	}
+	components["disk_full"] = diskFull
+
+	containerTotal := map[string]interface{}{
+		"p":                   "sensor",
+		"name":                "APFS Container Total",
+		"unique_id":           app.hostname + "_disk_container_total",
+		"state_topic":         app.getTopicPrefix() + "/status/disk/container/total",
+		"unit_of_measurement": "B",
+		"device_class":        "data_size",
+		"state_class":         "measurement",
+		"icon":                "mdi:harddisk",
+	}
+	components["disk_container_total"] = containerTotal
+
+	containerFree := map[string]interface{}{
+		"p":                   "sensor",
+		"name":                "APFS Container Free",
+		"unique_id":           app.hostname + "_disk_container_free",
+		"state_topic":         app.getTopicPrefix() + "/status/disk/container/free",
+		"unit_of_measurement": "B",
+		"device_class":        "data_size",
+		"state_class":         "measurement",
+		"icon":                "mdi:harddisk",
+	}
+	components["disk_container_free"] = containerFree
+
+	containerUsedPercent := map[string]interface{}{
+		"p":                   "sensor",
+		"name":                "APFS Container Used Percent",
+		"unique_id":           app.hostname + "_disk_container_used_percent",
+		"state_topic":         app.getTopicPrefix() + "/status/disk/container/used_percent",
+		"unit_of_measurement": "%",
+		"state_class":         "measurement",
+		"icon":                "mdi:chart-pie",
+	}
+	components["disk_container_used_percent"] = containerUsedPercent
+
+	// Add load average sensors
+	for name, component := range cpuLoad {
+		components[name] = component
+	}
+
+	// Add the memory breakdown sensors
+	for name, component := range memoryDetails {
+		components[name] = component
+	}
+
+	// Add a usage sensor for each CPU core
+	cores := sigar.CpuList{}
+	if err := cores.Get(); err == nil {
+		for i := range cores.List {
+			core := strconv.Itoa(i)
+			components["cpu_core_"+core+"_used_percent"] = map[string]interface{}{
+				"p":                   "sensor",
+				"name":                "CPU Core " + core + " Used Percent",
+				"unique_id":           app.hostname + "_cpu_core_" + core + "_used_percent",
+				"state_topic":         app.getTopicPrefix() + "/status/cpu/core/" + core + "/used_percent",
+				"unit_of_measurement": "%",
+				"state_class":         "measurement",
+				"icon":                "mdi:cpu-64-bit",
+				"entity_category":     "diagnostic",
+			}
+		}
+	}
+
+	// Add the CPU frequency sensor where the Mac reports it
+	if _, ok := getCPUFrequency(); ok {
+		components["cpu_frequency"] = map[string]interface{}{
+			"p":                   "sensor",
+			"name":                "CPU Frequency",
+			"unique_id":           app.hostname + "_cpu_frequency",
+			"state_topic":         app.getTopicPrefix() + "/status/cpu/frequency",
+			"unit_of_measurement": "MHz",
+			"device_class":        "frequency",
+			"state_class":         "measurement",
+			"icon":                "mdi:speedometer",
+			"entity_category":     "diagnostic",
+		}
+	}
+
+	// Add throughput sensors for each monitored network interface and disk
+	interfaces, disks := app.getThroughputNames()
+	for _, iface := range interfaces {
+		key := getTopicKey(iface)
+		for _, direction := range []string{"rx", "tx"} {
+			components["network_"+key+"_"+direction+"_rate"] = map[string]interface{}{
+				"p":                   "sensor",
+				"name":                iface + " " + strings.ToUpper(direction) + " Rate",
+				"unique_id":           app.hostname + "_network_" + key + "_" + direction + "_rate",
+				"state_topic":         app.getTopicPrefix() + "/status/network/" + key + "/" + direction + "_rate",
+				"unit_of_measurement": "B/s",
+				"device_class":        "data_rate",
+				"state_class":         "measurement",
+				"icon":                "mdi:swap-vertical",
+			}
+		}
+	}
+	for _, diskName := range disks {
+		key := getTopicKey(diskName)
+		for _, direction := range []string{"read", "write"} {
+			components["disk_io_"+key+"_"+direction+"_rate"] = map[string]interface{}{
+				"p":                   "sensor",
+				"name":                diskName + " " + strings.ToUpper(direction[:1]) + direction[1:] + " Rate",
+				"unique_id":           app.hostname + "_disk_io_" + key + "_" + direction + "_rate",
+				"state_topic":         app.getTopicPrefix() + "/status/disk_io/" + key + "/" + direction + "_rate",
+				"unit_of_measurement": "B/s",
+				"device_class":        "data_rate",
+				"state_class":         "measurement",
+				"icon":                "mdi:harddisk",
+			}
+		}
+	}
+
+	// Add disk usage sensors for each monitored volume
+	app.diskMutex.Lock()
+	for key, mountPoint := range app.volumes {
+		topic := app.getTopicPrefix() + "/status/disk/" + key
+		for _, metric := range []string{"total", "used", "free"} {
+			components["disk_"+key+"_"+metric] = map[string]interface{}{
+				"p":                   "sensor",
+				"name":                mountPoint + " " + strings.ToUpper(metric[:1]) + metric[1:],
+				"unique_id":           app.hostname + "_disk_" + key + "_" + metric,
+				"state_topic":         topic + "/" + metric,
+				"unit_of_measurement": "B",
+				"device_class":        "data_size",
+				"state_class":         "measurement",
+				"icon":                "mdi:harddisk",
+			}
+		}
+		components["disk_"+key+"_used_percent"] = map[string]interface{}{
+			"p":                   "sensor",
+			"name":                mountPoint + " Used Percent",
+			"unique_id":           app.hostname + "_disk_" + key + "_used_percent",
+			"state_topic":         topic + "/used_percent",
+			"unit_of_measurement": "%",
+			"state_class":         "measurement",
+			"icon":                "mdi:chart-pie",
+		}
+		components["disk_"+key+"_full"] = map[string]interface{}{
+			"p":            "binary_sensor",
+			"name":         mountPoint + " Almost Full",
+			"unique_id":    app.hostname + "_disk_" + key + "_full",
+			"state_topic":  topic + "/full",
+			"payload_on":   "ON",
+			"payload_off":  "OFF",
+			"device_class": "problem",
+			"icon":         "mdi:harddisk-remove",
+		}
+	}
+
+	// Components that only contain the platform are removed by Home Assistant
+	for _, key := range app.removedVolumes {
+		if _, ok := app.volumes[key]; ok {
+			continue
+		}
+		for _, metric := range []string{"total", "used", "free", "used_percent"} {
+			components["disk_"+key+"_"+metric] = map[string]interface{}{"p": "sensor"}
+		}
+		components["disk_"+key+"_full"] = map[string]interface{}{"p": "binary_sensor"}
+	}
+	app.removedVolumes = nil
+	app.diskMutex.Unlock()
+
 	// Add display brightness controls for each display
 	for _, display := range app.displays {
 		displayBrightness := map[string]interface{}{
@@ -2138,6 +8531,23 @@ func (app *Application) setDevice(client mqtt.Client) {
 		components["display_"+display.DisplayID+"_brightness"] = displayBrightness
 	}
 
+	profile := map[string]interface{}{
+		"p":               "sensor",
+		"name":            "Profile",
+		"unique_id":       app.hostname + "_profile",
+		"state_topic":     app.getTopicPrefix() + "/status/profile",
+		"entity_category": "diagnostic",
+		"icon":            "mdi:map-marker-radius",
+	}
+	components["profile"] = profile
+
+	// Remove the entities of sensors and commands that the active profile disables
+	for name, value := range components {
+		if component, ok := value.(map[string]interface{}); ok && !app.isComponentEnabled(component) {
+			components[name] = map[string]interface{}{"p": component["p"]}
+		}
+	}
+
 	origin := map[string]interface{}{
 		"name": "mac2mqtt",
 	}
@@ -2179,8 +8589,10 @@ func (app *Application) Run() error {
 	log.Printf("Working directory: %s", getWorkingDirectory())
 	log.Printf("Hostname set to: %s", app.hostname)
 	log.Printf("Discovery Prefix: %s", app.config.DiscoveryPrefix)
-	log.Printf("MQTT Broker: %s:%s", app.config.IP, app.config.Port)
-	log.Printf("MQTT Topic: %s", app.topic)
+	broker := app.getBrokerConfig()
+	log.Printf("MQTT Broker: %s:%s", broker.IP, broker.Port)
+	log.Printf("MQTT Topic: %s", app.getTopicPrefix())
+	log.Printf("Profile: %s", app.getProfileName())
 
 	// Initialize displays before MQTT connection
 	log.Println("=== DISCOVERING DISPLAYS ===")
@@ -2220,12 +8632,13 @@ func (app *Application) Run() error {
 	}
 
 	// Set up tickers for periodic updates
-	volumeTicker := time.NewTicker(UpdateInterval)
-	batteryTicker := time.NewTicker(UpdateInterval)
+	volumeTicker := time.NewTicker(VolumeUpdateInterval)
+	sensorTicker := time.NewTicker(SensorCheckInterval)
+	periodicSensors := app.getPeriodicSensors(time.Now())
 	awakeTicker := time.NewTicker(UpdateInterval)
 	networkCheckTicker := time.NewTicker(30 * time.Second) // Check network every 30 seconds
 	defer volumeTicker.Stop()
-	defer batteryTicker.Stop()
+	defer sensorTicker.Stop()
 	defer awakeTicker.Stop()
 	defer networkCheckTicker.Stop()
 
@@ -2244,16 +8657,26 @@ func (app *Application) Run() error {
 		app.setUserActivityState(app.client, "inactive") // Initial user activity state
 		app.updateDiskUsage(app.client)                  // Initial disk usage update
 		app.updateCPUUsage(app.client)                   // Initial CPU usage update
+		app.updateThroughput(app.client)                 // Initial network and disk throughput update
 		app.updateMemoryUsage(app.client)                // Initial memory usage update
+		app.updateProcesses(app.client)                  // Initial processes update
+		app.updateRunningApps(app.client)                // Initial running apps update
+		app.updateBluetooth(app.client)                  // Initial Bluetooth devices update
 		app.updateUptime(app.client)                     // Initial uptime update
 		app.updateMediaDevices(app.client)               // Initial media devices update
 		app.updatePublicIP(app.client)                   // Initial public IP update
+		app.updateNetworkInfo(app.client)                // Initial network state update
 
 		// Start media stream for real-time updates
 		app.startMediaStream(app.client)
 
 		// Start user activity monitoring
 		app.startUserActivityMonitoring(app.client)
+		app.startScreenLockMonitoring(app.client)
+		app.startFrontmostAppMonitoring(app.client)
+		app.startPowerEventMonitoring(app.client)
+		app.startPowerPolicyMonitoring(app.client)
+		app.startProbeMonitoring(app.client)
 	} else {
 		log.Println("Skipping initial MQTT setup - will configure when connection is established")
 	}
@@ -2264,6 +8687,7 @@ func (app *Application) Run() error {
 		case <-volumeTicker.C:
 			// Check if client is connected before publishing
 			if app.isClientConnected() {
+				app.updateAudioDevices(app.client)
 				app.updateVolume(app.client)
 				app.updateMute(app.client)
 				app.updateMediaDevices(app.client)
@@ -2271,17 +8695,11 @@ func (app *Application) Run() error {
 			} else if networkReachable {
 				log.Println("MQTT client not connected but network is reachable, connection may be recovering")
 			}
+			volumeTicker.Reset(app.getInterval("volume", VolumeUpdateInterval))
 
-		case <-batteryTicker.C:
+		case now := <-sensorTicker.C:
 			if app.isClientConnected() {
-				app.updateBattery(app.client)
-				app.updateDiskUsage(app.client)
-				app.updateCPUUsage(app.client)
-				app.updateMemoryUsage(app.client)
-				app.updateUptime(app.client)
-				app.updatePublicIP(app.client)
-			} else if networkReachable {
-				log.Println("MQTT client not connected but network is reachable, skipping battery update")
+				app.updatePeriodicSensors(app.client, periodicSensors, now)
 			}
 
 		case <-awakeTicker.C:
@@ -2291,14 +8709,23 @@ func (app *Application) Run() error {
 			} else if networkReachable {
 				log.Println("MQTT client not connected but network is reachable, skipping status updates")
 			}
+			awakeTicker.Reset(app.getInterval("status", UpdateInterval))
 			// Note: Media updates now come from the media-control stream
 
+		case profile := <-app.profileSelection:
+			app.updateProfile(profile)
+
 		case <-networkCheckTicker.C:
 			// Periodic network reachability check
 			currentNetworkState := app.isNetworkReachable()
 			currentConnectionState := app.isClientConnected()
 
+			// Publish the network state and its changes, and follow it with the matching profile
+			app.updateNetworkInfo(app.client)
+			app.startProfileSelection()
+
 			// Log network state changes
+			becameReachable := currentNetworkState && !networkReachable
 			if currentNetworkState != networkReachable {
 				if currentNetworkState {
 					log.Println("Network connectivity restored - MQTT broker is now reachable")
@@ -2318,21 +8745,15 @@ func (app *Application) Run() error {
 				lastConnectionState = currentConnectionState
 			}
 
-			// Handle network state changes
-			if currentNetworkState && !networkReachable {
-				// Network just became reachable - try to reconnect if not already connected
-				if !currentConnectionState {
-					log.Println("Attempting to reconnect to MQTT broker...")
-					// The auto-reconnect should handle this, but we can force a reconnection attempt
-					go func() {
-						if app.client == nil {
-							return
-						}
-						if token := app.client.Connect(); token.Wait() && token.Error() != nil {
-							log.Printf("Reconnection attempt failed: %v", token.Error())
-						}
-					}()
+			// Without a client the broker was unreachable at startup, connect as soon as it can be reached.
+			// An existing client reconnects by itself, connecting it again would race with its auto-reconnect.
+			if currentNetworkState && app.client == nil {
+				log.Println("Attempting to connect to MQTT broker...")
+				if err := app.getMQTTClient(); err != nil {
+					log.Printf("Connection attempt failed: %v", err)
 				}
+			} else if becameReachable && !currentConnectionState {
+				log.Println("MQTT client will reconnect automatically")
 			}
 		}
 	}
@@ -2397,6 +8818,39 @@ func (app *Application) validateShortcutInput(payload string) error {
 	return nil
 }
 
+// bundleIDCharsPattern matches the characters allowed in the bundle ID of an app command
+var bundleIDCharsPattern = regexp.MustCompile(`^[A-Za-z0-9.-]+$`)
+
+// validateAppCommandInput validates command/app input, e.g. {"action": "quit", "app": "Zoom"}
+func (app *Application) validateAppCommandInput(payload string) (AppCommand, error) {
+	var command AppCommand
+	if err := json.Unmarshal([]byte(payload), &command); err != nil {
+		return command, fmt.Errorf("app command must be JSON: %w", err)
+	}
+
+	switch command.Action {
+	case "open", "quit", "force_quit", "activate":
+	default:
+		return command, fmt.Errorf("unknown app action %q", command.Action)
+	}
+
+	switch {
+	case command.BundleID != "":
+		if !bundleIDCharsPattern.MatchString(command.BundleID) {
+			return command, fmt.Errorf("bundle ID contains invalid characters")
+		}
+		command.Name = ""
+	case command.Name != "":
+		// The name is quoted in AppleScript
+		if strings.ContainsAny(command.Name, "\"\\\n") {
+			return command, fmt.Errorf("app name contains invalid characters")
+		}
+	default:
+		return command, fmt.Errorf("app or bundle_id is required")
+	}
+	return command, nil
+}
+
 // validateKeepAwakeInput validates keep awake input (true/false)
 func (app *Application) validateKeepAwakeInput(payload string) (bool, error) {
 	keepAwake, err := strconv.ParseBool(payload)
@@ -0,0 +1,2397 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	sigar "github.com/cloudfoundry/gosigar"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// fakeMQTTClient is a connected MQTT client that records the published messages
+type fakeMQTTClient struct {
+	mqtt.Client
+	mutex     sync.Mutex
+	published map[string][]string // payloads by topic, oldest first
+}
+
+func newFakeMQTTClient() *fakeMQTTClient {
+	return &fakeMQTTClient{published: make(map[string][]string)}
+}
+
+func (c *fakeMQTTClient) IsConnected() bool { return true }
+
+func (c *fakeMQTTClient) Publish(topic string, _ byte, _ bool, payload interface{}) mqtt.Token {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	switch p := payload.(type) {
+	case string:
+		c.published[topic] = append(c.published[topic], p)
+	case []byte:
+		c.published[topic] = append(c.published[topic], string(p))
+	}
+	return &mqtt.DummyToken{}
+}
+
+// payloads returns the payloads published to a topic below the test prefix
+func (c *fakeMQTTClient) payloads(topic string) []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string(nil), c.published[testTopicPrefix+topic]...)
+}
+
+const testTopicPrefix = "mac2mqtt/test"
+
+// newTestApplication returns an application with the default idle times that publishes below testTopicPrefix
+func newTestApplication() *Application {
+	cfg := &config{IdleActivityTime: DefaultIdleActivityTime, IdleAwayTime: DefaultIdleAwayTime}
+	return &Application{config: cfg, topic: testTopicPrefix, hostname: "test"}
+}
+
+// fakeAudioControlServer is a stand-in for the audio control API that records the requests it gets
+type fakeAudioControlServer struct {
+	*httptest.Server
+	paths      []string
+	rawQueries []string
+	status     int    // response status, 200 when 0
+	body       string // response body of /get
+	delay      time.Duration
+}
+
+func newFakeAudioControlServer(t *testing.T) *fakeAudioControlServer {
+	fake := &fakeAudioControlServer{}
+	fake.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fake.paths = append(fake.paths, r.URL.Path)
+		fake.rawQueries = append(fake.rawQueries, r.URL.RawQuery)
+		time.Sleep(fake.delay)
+		if fake.status != 0 {
+			w.WriteHeader(fake.status)
+		}
+		if r.URL.Path == "/get" {
+			w.Write([]byte(fake.body))
+		}
+	}))
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+func TestAudioControlClientRequests(t *testing.T) {
+	tests := []struct {
+		name      string
+		call      func(c *AudioControlClient) (interface{}, error)
+		body      string
+		want      interface{}
+		wantPath  string
+		wantQuery string
+	}{
+		{
+			name:      "get volume",
+			call:      func(c *AudioControlClient) (interface{}, error) { return c.GetVolume("LG HDR 4K") },
+			body:      "0.35\n",
+			want:      0.35,
+			wantPath:  "/get",
+			wantQuery: "name=LG%20HDR%204K&volume",
+		},
+		{
+			name:      "set volume",
+			call:      func(c *AudioControlClient) (interface{}, error) { return nil, c.SetVolume("Dock & Speakers", 0.5) },
+			wantPath:  "/set",
+			wantQuery: "name=Dock%20%26%20Speakers&volume=0.500000",
+		},
+		{
+			name:      "get mute on",
+			call:      func(c *AudioControlClient) (interface{}, error) { return c.GetMute("USB+Audio") },
+			body:      "on\n",
+			want:      true,
+			wantPath:  "/get",
+			wantQuery: "name=USB%2BAudio&mute",
+		},
+		{
+			name:      "get mute off",
+			call:      func(c *AudioControlClient) (interface{}, error) { return c.GetMute("Kopfhörer") },
+			body:      "off",
+			want:      false,
+			wantPath:  "/get",
+			wantQuery: "name=Kopfh%C3%B6rer&mute",
+		},
+		{
+			name:      "set mute",
+			call:      func(c *AudioControlClient) (interface{}, error) { return nil, c.SetMute("LG HDR 4K", true) },
+			wantPath:  "/set",
+			wantQuery: "name=LG%20HDR%204K&mute=on",
+		},
+		{
+			name:      "unmute",
+			call:      func(c *AudioControlClient) (interface{}, error) { return nil, c.SetMute("LG HDR 4K", false) },
+			wantPath:  "/set",
+			wantQuery: "name=LG%20HDR%204K&mute=off",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeAudioControlServer(t)
+			fake.body = tt.body
+			client := NewAudioControlClient(fake.URL+"/", time.Second)
+
+			got, err := tt.call(client)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if len(fake.paths) != 1 || fake.paths[0] != tt.wantPath {
+				t.Errorf("paths = %v, want [%s]", fake.paths, tt.wantPath)
+			}
+			if len(fake.rawQueries) != 1 || fake.rawQueries[0] != tt.wantQuery {
+				t.Errorf("queries = %v, want [%s]", fake.rawQueries, tt.wantQuery)
+			}
+		})
+	}
+}
+
+func TestAudioControlClientErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		call   func(c *AudioControlClient) error
+	}{
+		{
+			name:   "get volume not found",
+			status: http.StatusNotFound,
+			body:   "unknown device",
+			call:   func(c *AudioControlClient) error { _, err := c.GetVolume("Speakers"); return err },
+		},
+		{
+			name:   "set volume server error",
+			status: http.StatusInternalServerError,
+			call:   func(c *AudioControlClient) error { return c.SetVolume("Speakers", 0.2) },
+		},
+		{
+			name:   "set mute server error",
+			status: http.StatusInternalServerError,
+			call:   func(c *AudioControlClient) error { return c.SetMute("Speakers", true) },
+		},
+		{
+			name: "volume is not a number",
+			body: "loud",
+			call: func(c *AudioControlClient) error { _, err := c.GetVolume("Speakers"); return err },
+		},
+		{
+			name: "unknown mute state",
+			body: "maybe",
+			call: func(c *AudioControlClient) error { _, err := c.GetMute("Speakers"); return err },
+		},
+		{
+			name: "empty mute state",
+			call: func(c *AudioControlClient) error { _, err := c.GetMute("Speakers"); return err },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeAudioControlServer(t)
+			fake.status = tt.status
+			fake.body = tt.body
+			if err := tt.call(NewAudioControlClient(fake.URL, time.Second)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestAudioControlClientTimeout(t *testing.T) {
+	fake := newFakeAudioControlServer(t)
+	fake.body = "on"
+	fake.delay = 200 * time.Millisecond
+
+	start := time.Now()
+	_, err := NewAudioControlClient(fake.URL, 20*time.Millisecond).GetMute("Speakers")
+	if err == nil {
+		t.Fatal("expected a timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("request took %s, the timeout is 20ms", elapsed)
+	}
+}
+
+func TestAudioControlClientUnreachable(t *testing.T) {
+	fake := newFakeAudioControlServer(t)
+	url := fake.URL
+	fake.Close()
+
+	if err := NewAudioControlClient(url, time.Second).SetMute("Speakers", false); err == nil ||
+		!strings.Contains(err.Error(), "audio control request failed") {
+		t.Errorf("got %v, want a request error", err)
+	}
+}
+
+func TestParseDefaultRoute(t *testing.T) {
+	output := `   route to: default
+destination: default
+       mask: default
+    gateway: 192.168.1.1
+  interface: en0
+      flags: <UP,GATEWAY,DONE,STATIC,PRCLONING,GLOBAL>
+ recvpipe  sendpipe  ssthresh  rtt,msec    rttvar  hopcount      mtu     expire
+       0         0         0         0         0         0      1500         0
+`
+	iface, gateway := parseDefaultRoute(output)
+	if iface != "en0" || gateway != "192.168.1.1" {
+		t.Errorf("got %q, %q, want en0, 192.168.1.1", iface, gateway)
+	}
+
+	iface, gateway = parseDefaultRoute("route: writing to routing socket: not in table\n")
+	if iface != "" || gateway != "" {
+		t.Errorf("got %q, %q without a default route", iface, gateway)
+	}
+}
+
+func TestParseHardwarePorts(t *testing.T) {
+	output := `
+Hardware Port: Ethernet Adapter (en4)
+Device: en4
+Ethernet Address: 9e:2b:1a:00:11:22
+
+Hardware Port: Wi-Fi
+Device: en0
+Ethernet Address: 3c:22:fb:00:11:22
+
+Hardware Port: Thunderbolt Bridge
+Device: bridge0
+Ethernet Address: N/A
+
+VLAN Configurations
+===================
+`
+	ports := parseHardwarePorts(output)
+	if ports["Wi-Fi"] != "en0" || ports["Thunderbolt Bridge"] != "bridge0" || len(ports) != 3 {
+		t.Errorf("got %v", ports)
+	}
+}
+
+func TestParseIpconfigSummary(t *testing.T) {
+	tests := []struct {
+		name          string
+		output        string
+		wantSSID      string
+		wantBSSID     string
+		wantConnected bool
+	}{
+		{
+			name: "connected",
+			output: `<dictionary> {
+  BSSID : 8c:3b:ad:00:11:22
+  IPv4 : <array> {
+    0 : <dictionary> {
+      Addresses : <array> {
+        0 : 192.168.1.23
+      }
+    }
+  }
+  InterfaceType : WiFi
+  LinkStatusActive : TRUE
+  SSID : Home Network
+  Security : WPA2_PSK
+}`,
+			wantSSID:      "Home Network",
+			wantBSSID:     "8c:3b:ad:00:11:22",
+			wantConnected: true,
+		},
+		{
+			name: "redacted",
+			output: `<dictionary> {
+  BSSID : <redacted>
+  InterfaceType : WiFi
+  LinkStatusActive : TRUE
+  SSID : <redacted>
+  Security : WPA3_SAE
+}`,
+			wantConnected: true,
+		},
+		{
+			name: "redacted without link status",
+			output: `<dictionary> {
+  BSSID : <redacted>
+  SSID : <redacted>
+}`,
+			wantConnected: true,
+		},
+		{
+			name: "disconnected",
+			output: `<dictionary> {
+  InterfaceType : WiFi
+  LinkStatusActive : FALSE
+  NetworkID : 2B9C0F8E-64D6-4F7B-9C0D-7D1E2A3B4C5D
+}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ssid, bssid, connected := parseIpconfigSummary(tt.output)
+			if ssid != tt.wantSSID || bssid != tt.wantBSSID || connected != tt.wantConnected {
+				t.Errorf("got %q, %q, %v, want %q, %q, %v", ssid, bssid, connected, tt.wantSSID, tt.wantBSSID, tt.wantConnected)
+			}
+		})
+	}
+}
+
+func TestParseAirPortInfo(t *testing.T) {
+	output := []byte(`{
+  "SPAirPortDataType" : [
+    {
+      "spairport_airport_interfaces" : [
+        {
+          "_name" : "en0",
+          "spairport_current_network_information" : {
+            "_name" : "Home Network",
+            "spairport_network_channel" : "44 (5GHz, 80MHz)",
+            "spairport_network_phymode" : "802.11ac",
+            "spairport_network_rate" : 866,
+            "spairport_security_mode" : "spairport_security_mode_wpa2_personal",
+            "spairport_signal_noise" : "-55 dBm / -92 dBm"
+          },
+          "spairport_status_information" : "spairport_status_connected"
+        },
+        {
+          "_name" : "awdl0",
+          "spairport_status_information" : "spairport_status_connected"
+        }
+      ]
+    }
+  ]
+}`)
+
+	ssid, rssi, linkRate, err := parseAirPortInfo(output, "en0")
+	if err != nil || ssid != "Home Network" || rssi != -55 || linkRate != 866 {
+		t.Errorf("got %q, %d, %d, %v", ssid, rssi, linkRate, err)
+	}
+
+	ssid, rssi, linkRate, err = parseAirPortInfo(output, "awdl0")
+	if err != nil || ssid != "" || rssi != 0 || linkRate != 0 {
+		t.Errorf("got %q, %d, %d, %v for an interface without a network", ssid, rssi, linkRate, err)
+	}
+
+	if _, _, _, err = parseAirPortInfo(output, "en1"); err == nil {
+		t.Error("expected an error for a missing interface")
+	}
+	if _, _, _, err = parseAirPortInfo([]byte("not json"), "en0"); err == nil {
+		t.Error("expected an error for invalid output")
+	}
+}
+
+func TestMergeAirPortInfo(t *testing.T) {
+	airPort := AirPortInfo{Device: "en0", SSID: "Home Network", RSSI: -55, LinkRate: 866, UpdatedAt: time.Now()}
+
+	// ipconfig redacted the SSID
+	info := &NetworkInfo{WiFiDevice: "en0", WiFiConnected: true}
+	mergeAirPortInfo(info, airPort)
+	if info.SSID != "Home Network" || info.RSSI != -55 || info.LinkRate != 866 {
+		t.Errorf("got %+v", info)
+	}
+
+	// The SSID from ipconfig wins
+	info = &NetworkInfo{WiFiDevice: "en0", WiFiConnected: true, SSID: "Office"}
+	mergeAirPortInfo(info, airPort)
+	if info.SSID != "Office" {
+		t.Errorf("got SSID %q, want Office", info.SSID)
+	}
+
+	for _, info := range []*NetworkInfo{
+		{WiFiDevice: "en0"},
+		{WiFiDevice: "en1", WiFiConnected: true},
+	} {
+		mergeAirPortInfo(info, airPort)
+		if info.SSID != "" || info.RSSI != 0 || info.LinkRate != 0 {
+			t.Errorf("got %+v, want no Wi-Fi details", info)
+		}
+	}
+
+	info = &NetworkInfo{WiFiDevice: "en0", WiFiConnected: true}
+	mergeAirPortInfo(info, AirPortInfo{})
+	if info.SSID != "" {
+		t.Errorf("got SSID %q before the first lookup", info.SSID)
+	}
+}
+
+// listenUDP starts a local UDP server that answers every packet with respond, a nil answer is dropped
+func listenUDP(t *testing.T, respond func(request []byte) []byte) string {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			if response := respond(append([]byte(nil), buffer[:n]...)); response != nil {
+				conn.WriteTo(response, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// dnsTXTResponse answers a DNS query with one TXT record
+func dnsTXTResponse(query []byte, txt string) []byte {
+	// The question follows the 12 byte header: the name, then type and class
+	end := 12
+	for end < len(query) && query[end] != 0 {
+		end += int(query[end]) + 1
+	}
+	end += 5
+
+	response := append([]byte(nil), query[:2]...)                   // ID
+	response = append(response, 0x81, 0x80, 0, 1, 0, 1, 0, 0, 0, 0) // flags and counts
+	response = append(response, query[12:end]...)
+	response = append(response, 0xc0, 12, 0, 16, 0, 1, 0, 0, 0, 60) // name pointer, TXT, IN, TTL
+	response = binary.BigEndian.AppendUint16(response, uint16(len(txt)+1))
+	response = append(response, byte(len(txt)))
+	return append(response, txt...)
+}
+
+func TestDNSPublicIPResolver(t *testing.T) {
+	server := listenUDP(t, func(query []byte) []byte { return dnsTXTResponse(query, "203.0.113.7") })
+	resolver := &dnsPublicIPResolver{server: server, name: "myaddr.example."}
+
+	ip, err := resolver.PublicIP(context.Background(), "ipv4")
+	if err != nil || ip != "203.0.113.7" {
+		t.Errorf("got %q, %v, want 203.0.113.7", ip, err)
+	}
+
+	// The TXT record holds an IPv4 address, an IPv6 lookup must not accept it
+	server = listenUDP(t, func(query []byte) []byte { return dnsTXTResponse(query, "203.0.113.7") })
+	resolver = &dnsPublicIPResolver{server: server, name: "myaddr.example."}
+	if _, err := resolver.PublicIP(context.Background(), "ipv6"); err == nil {
+		t.Error("expected an error for an address of the wrong family")
+	}
+
+	server = listenUDP(t, func(query []byte) []byte { return dnsTXTResponse(query, "not an address") })
+	resolver = &dnsPublicIPResolver{server: server, name: "myaddr.example."}
+	if _, err := resolver.PublicIP(context.Background(), "ipv4"); err == nil {
+		t.Error("expected an error for an invalid TXT record")
+	}
+}
+
+func TestHTTPSPublicIPResolver(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ip":
+			io.WriteString(w, "203.0.113.7\n")
+		case "/html":
+			io.WriteString(w, "<html>203.0.113.7</html>")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	ip, err := (&httpsPublicIPResolver{url: server.URL + "/ip"}).PublicIP(context.Background(), "ipv4")
+	if err != nil || ip != "203.0.113.7" {
+		t.Errorf("got %q, %v, want 203.0.113.7", ip, err)
+	}
+	for _, path := range []string{"/html", "/missing"} {
+		if _, err := (&httpsPublicIPResolver{url: server.URL + path}).PublicIP(context.Background(), "ipv4"); err == nil {
+			t.Errorf("expected an error for %s", path)
+		}
+	}
+}
+
+// stunResponse answers a STUN binding request with an address attribute
+func stunResponse(request []byte, attributeType uint16, ip net.IP) []byte {
+	value := []byte{0, 0x01, 0x12, 0x34}
+	address := append([]byte(nil), ip.To4()...)
+	if attributeType == 0x0020 {
+		for i := range address {
+			address[i] ^= request[4+i]
+		}
+	}
+	value = append(value, address...)
+
+	response := binary.BigEndian.AppendUint16(nil, 0x0101)
+	response = binary.BigEndian.AppendUint16(response, uint16(4+len(value)))
+	response = append(response, request[4:20]...) // magic cookie and transaction ID
+	response = binary.BigEndian.AppendUint16(response, attributeType)
+	response = binary.BigEndian.AppendUint16(response, uint16(len(value)))
+	return append(response, value...)
+}
+
+func TestSTUNPublicIPResolver(t *testing.T) {
+	tests := []struct {
+		name          string
+		attributeType uint16
+	}{
+		{name: "xor mapped address", attributeType: 0x0020},
+		{name: "mapped address", attributeType: 0x0001},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := listenUDP(t, func(request []byte) []byte {
+				if len(request) != 20 || binary.BigEndian.Uint16(request) != 0x0001 {
+					return nil
+				}
+				return stunResponse(request, tt.attributeType, net.ParseIP("203.0.113.7"))
+			})
+
+			ip, err := (&stunPublicIPResolver{server: server}).PublicIP(context.Background(), "ipv4")
+			if err != nil || ip != "203.0.113.7" {
+				t.Errorf("got %q, %v, want 203.0.113.7", ip, err)
+			}
+		})
+	}
+
+	// A response to another transaction is rejected
+	server := listenUDP(t, func(request []byte) []byte {
+		response := stunResponse(request, 0x0020, net.ParseIP("203.0.113.7"))
+		response[19] ^= 0xff
+		return response
+	})
+	if _, err := (&stunPublicIPResolver{server: server}).PublicIP(context.Background(), "ipv4"); err == nil {
+		t.Error("expected an error for a mismatched transaction ID")
+	}
+
+	// No answer at all
+	server = listenUDP(t, func([]byte) []byte { return nil })
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := (&stunPublicIPResolver{server: server}).PublicIP(ctx, "ipv4"); err == nil {
+		t.Error("expected a timeout error")
+	}
+}
+
+func TestUPnPPublicIPResolver(t *testing.T) {
+	var soapAction string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/rootDesc.xml":
+			io.WriteString(w, `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+    <deviceList>
+      <device>
+        <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+        <serviceList>
+          <service>
+            <serviceType>urn:schemas-upnp-org:service:WANCommonInterfaceConfig:1</serviceType>
+            <controlURL>/ctl/CmnIfCfg</controlURL>
+          </service>
+        </serviceList>
+        <deviceList>
+          <device>
+            <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+            <serviceList>
+              <service>
+                <serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+                <controlURL>/ctl/IPConn</controlURL>
+              </service>
+            </serviceList>
+          </device>
+        </deviceList>
+      </device>
+    </deviceList>
+  </device>
+</root>`)
+		case "/ctl/IPConn":
+			soapAction = r.Header.Get("SOAPAction")
+			io.WriteString(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+  <s:Body>
+    <u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">
+      <NewExternalIPAddress>203.0.113.7</NewExternalIPAddress>
+    </u:GetExternalIPAddressResponse>
+  </s:Body>
+</s:Envelope>`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	resolver := &upnpPublicIPResolver{location: server.URL + "/rootDesc.xml"}
+	ip, err := resolver.PublicIP(context.Background(), "ipv4")
+	if err != nil || ip != "203.0.113.7" {
+		t.Errorf("got %q, %v, want 203.0.113.7", ip, err)
+	}
+	if want := `"urn:schemas-upnp-org:service:WANIPConnection:1#GetExternalIPAddress"`; soapAction != want {
+		t.Errorf("SOAPAction = %s, want %s", soapAction, want)
+	}
+
+	if _, err := resolver.PublicIP(context.Background(), "ipv6"); err == nil {
+		t.Error("expected an error for IPv6")
+	}
+	if _, err := (&upnpPublicIPResolver{location: server.URL + "/missing.xml"}).PublicIP(context.Background(), "ipv4"); err == nil {
+		t.Error("expected an error for a missing device description")
+	}
+}
+
+func TestParseBluetoothDevices(t *testing.T) {
+	output := []byte(`{
+  "SPBluetoothDataType" : [
+    {
+      "controller_properties" : {
+        "controller_address" : "3C:22:FB:00:11:22",
+        "controller_state" : "attrib_on"
+      },
+      "device_connected" : [
+        {
+          "AirPods Pro" : {
+            "device_address" : "AC:90:85:00:11:22",
+            "device_batteryLevelCase" : "45%",
+            "device_batteryLevelLeft" : "100%",
+            "device_batteryLevelRight" : "98%",
+            "device_firmwareVersion" : "6A321",
+            "device_minorType" : "Headphones",
+            "device_productID" : "0x2014",
+            "device_vendorID" : "0x004C"
+          }
+        }
+      ],
+      "device_not_connected" : [
+        {
+          "Magic Keyboard" : {
+            "device_address" : "F0:B3:EC:00:11:22",
+            "device_minorType" : "Keyboard"
+          }
+        },
+        {
+          "Living Room TV" : {
+            "device_minorType" : "Display"
+          }
+        }
+      ]
+    }
+  ]
+}`)
+
+	devices, err := parseBluetoothDevices(output)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []BluetoothDevice{
+		{
+			Name:      "AirPods Pro",
+			Address:   "AC:90:85:00:11:22",
+			Type:      "Headphones",
+			Connected: true,
+			Batteries: map[string]int{"left": 100, "right": 98, "case": 45},
+		},
+		{Name: "Magic Keyboard", Address: "F0:B3:EC:00:11:22", Type: "Keyboard"},
+	}
+	if !reflect.DeepEqual(devices, want) {
+		t.Errorf("got %+v, want %+v", devices, want)
+	}
+
+	if _, err := parseBluetoothDevices([]byte("not json")); err == nil {
+		t.Error("expected an error for invalid output")
+	}
+}
+
+func TestUpdateBluetoothDevicesKeepsBatteries(t *testing.T) {
+	app := &Application{}
+	airPods := BluetoothDevice{Name: "AirPods Pro", Address: "AC:90:85:00:11:22", Connected: true,
+		Batteries: map[string]int{"left": 100, "right": 98, "case": 45}}
+	keyboard := BluetoothDevice{Name: "Magic Keyboard", Address: "F0:B3:EC:00:11:22"}
+
+	devices, changed := app.updateBluetoothDevices([]BluetoothDevice{airPods, keyboard})
+	if !changed || len(devices) != 2 || devices[1].Batteries != nil {
+		t.Errorf("first update: got %+v, %v", devices, changed)
+	}
+
+	// The AirPods go back in their case and disconnect, macOS stops reporting the batteries
+	devices, changed = app.updateBluetoothDevices([]BluetoothDevice{
+		{Name: airPods.Name, Address: airPods.Address},
+		keyboard,
+	})
+	if changed {
+		t.Error("no device was paired or removed")
+	}
+	if !reflect.DeepEqual(devices[0].Batteries, airPods.Batteries) || devices[0].Connected {
+		t.Errorf("got %+v, want the last battery levels", devices[0])
+	}
+
+	// A new battery part adds entities, an unpaired device removes them
+	devices, changed = app.updateBluetoothDevices([]BluetoothDevice{
+		{Name: keyboard.Name, Address: keyboard.Address, Connected: true, Batteries: map[string]int{"main": 60}},
+	})
+	if !changed || len(devices) != 1 || devices[0].Batteries["main"] != 60 {
+		t.Errorf("got %+v, %v", devices, changed)
+	}
+	if want := []string{airPods.key()}; !reflect.DeepEqual(app.removedBluetooth, want) {
+		t.Errorf("removed = %v, want %v", app.removedBluetooth, want)
+	}
+}
+
+func TestParsePmsetBatt(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		want    BatteryInfo
+		wantErr bool
+	}{
+		{
+			name: "discharging",
+			output: "Now drawing from 'Battery Power'\n" +
+				" -InternalBattery-0 (id=4653155)\t87%; discharging; 5:42 remaining present: true\n",
+			want: BatteryInfo{Present: true, Percent: 87, State: "discharging", PowerSource: "battery", TimeRemaining: 342},
+		},
+		{
+			name: "charging without an estimate",
+			output: "Now drawing from 'AC Power'\n" +
+				" -InternalBattery-0 (id=4653155)\t42%; charging; (no estimate) present: true\n",
+			want: BatteryInfo{Present: true, Percent: 42, State: "charging", PowerSource: "ac", TimeRemaining: -1},
+		},
+		{
+			name: "charged",
+			output: "Now drawing from 'AC Power'\n" +
+				" -InternalBattery-0 (id=4653155)\t100%; charged; 0:00 remaining present: true\n",
+			want: BatteryInfo{Present: true, Percent: 100, State: "charged", PowerSource: "ac", TimeRemaining: 0},
+		},
+		{
+			name: "charging paused by optimized charging",
+			output: "Now drawing from 'AC Power'\n" +
+				" -InternalBattery-0 (id=4653155)\t80%; AC attached; not charging present: true\n",
+			want: BatteryInfo{Present: true, Percent: 80, State: "not_charging", PowerSource: "ac", TimeRemaining: -1},
+		},
+		{
+			name: "finishing charge",
+			output: "Now drawing from 'AC Power'\n" +
+				" -InternalBattery-0 (id=4653155)\t99%; finishing charge; 0:10 remaining present: true\n",
+			want: BatteryInfo{Present: true, Percent: 99, State: "finishing_charge", PowerSource: "ac", TimeRemaining: 10},
+		},
+		{
+			name:   "desktop without a battery",
+			output: "Now drawing from 'AC Power'\n",
+			want:   BatteryInfo{PowerSource: "ac", TimeRemaining: -1},
+		},
+		{
+			name: "desktop on a UPS",
+			output: "Now drawing from 'UPS Power'\n" +
+				" -CP1500PFCLCD (id=1234567)\t95%; discharging; 38:00 remaining present: true\n",
+			want: BatteryInfo{PowerSource: "ups", TimeRemaining: -1},
+		},
+		{
+			name:   "unknown power source",
+			output: "Now drawing from 'Solar Power'\n",
+			want:   BatteryInfo{TimeRemaining: -1},
+		},
+		{
+			name:    "no power source",
+			output:  "",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := parsePmsetBatt(tt.output)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if *info != tt.want {
+				t.Errorf("got %+v, want %+v", *info, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAppleSmartBattery(t *testing.T) {
+	appleSilicon := `+-o AppleSmartBattery  <class AppleSmartBattery, id 0x100000a4c, registered, matched, active, busy 0 (0 ms), retain 7>
+    {
+      "PostChargeWaitSeconds" = 120
+      "AdapterDetails" = {"AdapterVoltage"=20000,"Watts"=96,"FamilyCode"=18446744073172697098,"Current"=4700}
+      "ExternalConnected" = Yes
+      "AppleRawMaxCapacity" = 4382
+      "MaxCapacity" = 100
+      "DesignCapacity" = 4563
+      "CycleCount" = 187
+      "Temperature" = 3071
+      "PermanentFailureStatus" = 0
+      "BatteryData" = {"CycleCount"=187,"DesignCapacity"=4563,"Voltage"=12890}
+    }
+`
+	health, err := parseAppleSmartBattery(appleSilicon)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if health.CycleCount != 187 || health.Condition != "" || health.AdapterWatts != 96 ||
+		health.Temperature != 30.71 || health.HealthPercent < 96 || health.HealthPercent > 96.1 {
+		t.Errorf("got %+v", health)
+	}
+
+	// Intel Macs report the capacity in mAh as MaxCapacity, the adapter is unplugged
+	intel := `    {
+      "AdapterDetails" = {"Watts"=87}
+      "ExternalConnected" = No
+      "MaxCapacity" = 5103
+      "DesignCapacity" = 6669
+      "CycleCount" = 1021
+      "Temperature" = 2981
+      "PermanentFailureStatus" = 1
+    }
+`
+	health, err = parseAppleSmartBattery(intel)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if health.Condition != "Permanent Failure" || health.AdapterWatts != 0 ||
+		health.HealthPercent < 76.5 || health.HealthPercent > 76.6 {
+		t.Errorf("got %+v", health)
+	}
+
+	if _, err := parseAppleSmartBattery(""); err == nil {
+		t.Error("expected an error without a battery")
+	}
+}
+
+func TestParseBatteryCondition(t *testing.T) {
+	report := func(health string) []byte {
+		return []byte(`{
+  "SPPowerDataType" : [
+    {
+      "_name" : "spbattery_information",
+      "sppower_battery_charge_info" : {
+        "sppower_battery_at_warn_level" : "FALSE",
+        "sppower_battery_fully_charged" : "FALSE",
+        "sppower_battery_is_charging" : "TRUE",
+        "sppower_battery_state_of_charge" : 81
+      },
+      "sppower_battery_health_info" : {
+        "sppower_battery_cycle_count" : 187,
+        "sppower_battery_health" : "` + health + `",
+        "sppower_battery_health_maximum_capacity" : "96%"
+      }
+    },
+    {
+      "_name" : "sppower_information",
+      "AC Power" : {
+        "Current Power Source" : "TRUE"
+      }
+    }
+  ]
+}`)
+	}
+
+	tests := []struct {
+		health string
+		want   string
+	}{
+		{health: "Normal", want: "Normal"},
+		{health: "Good", want: "Normal"},
+		{health: "Service Recommended", want: "Service Recommended"},
+		{health: "Check Battery", want: "Service Recommended"},
+		{health: "Replace Soon", want: "Service Recommended"},
+	}
+	for _, tt := range tests {
+		condition, err := parseBatteryCondition(report(tt.health))
+		if err != nil || condition != tt.want {
+			t.Errorf("%s: got %q, %v, want %q", tt.health, condition, err, tt.want)
+		}
+	}
+
+	// Desktop Macs have no battery information
+	desktop := []byte(`{"SPPowerDataType" : [{"_name" : "sppower_information", "AC Power" : {"Current Power Source" : "TRUE"}}]}`)
+	if _, err := parseBatteryCondition(desktop); err == nil {
+		t.Error("expected an error without a battery")
+	}
+}
+
+func TestCounterDelta(t *testing.T) {
+	tests := []struct {
+		name    string
+		current uint64
+		last    uint64
+		want    uint64
+		wantOK  bool
+	}{
+		{name: "increase", current: 1500, last: 1000, want: 500, wantOK: true},
+		{name: "unchanged", current: 1000, last: 1000, want: 0, wantOK: true},
+		{name: "first sample", current: 1000, last: 0, want: 1000, wantOK: true},
+		{name: "reset after reboot", current: 200, last: 1_000_000, wantOK: false},
+		{name: "wrap", current: 10, last: ^uint64(0) - 5, wantOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := counterDelta(tt.current, tt.last)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("got %d, %v, want %d, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestGetCPUPercent(t *testing.T) {
+	last := sigar.Cpu{User: 4000, Sys: 2000, Idle: 14000}
+	tests := []struct {
+		name    string
+		current sigar.Cpu
+		last    sigar.Cpu
+		want    float64
+		wantOK  bool
+	}{
+		{
+			name:    "quarter busy",
+			current: sigar.Cpu{User: 4200, Sys: 2050, Idle: 14750},
+			last:    last,
+			want:    25,
+			wantOK:  true,
+		},
+		{
+			name:    "idle",
+			current: sigar.Cpu{User: 4000, Sys: 2000, Idle: 15000},
+			last:    last,
+			want:    0,
+			wantOK:  true,
+		},
+		{
+			name:    "busy",
+			current: sigar.Cpu{User: 5000, Sys: 2000, Idle: 14000},
+			last:    last,
+			want:    100,
+			wantOK:  true,
+		},
+		{
+			name:    "first sample",
+			current: last,
+		},
+		{
+			name:    "no time elapsed",
+			current: last,
+			last:    last,
+		},
+		{
+			name:    "reset after reboot",
+			current: sigar.Cpu{User: 40, Sys: 20, Idle: 140},
+			last:    last,
+		},
+		{
+			name:    "idle counter wrapped",
+			current: sigar.Cpu{User: 5000, Sys: 3000, Idle: 10},
+			last:    last,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := getCPUPercent(tt.current, tt.last)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("got %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestGetRate(t *testing.T) {
+	tests := []struct {
+		name    string
+		current uint64
+		last    uint64
+		elapsed time.Duration
+		want    float64
+	}{
+		{name: "rate", current: 3_000_000, last: 1_000_000, elapsed: 2 * time.Second, want: 1_000_000},
+		{name: "unchanged", current: 1000, last: 1000, elapsed: time.Minute, want: 0},
+		{name: "reset after reboot", current: 100, last: 1_000_000, elapsed: time.Minute, want: 0},
+		{name: "wrap", current: 10, last: ^uint64(0) - 5, elapsed: time.Minute, want: 0},
+		{name: "zero elapsed", current: 2000, last: 1000, elapsed: 0, want: 0},
+		{name: "clock went back", current: 2000, last: 1000, elapsed: -time.Second, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getRate(tt.current, tt.last, tt.elapsed); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseVMStat(t *testing.T) {
+	output := `Mach Virtual Memory Statistics: (page size of 16384 bytes)
+Pages free:                                5000.
+Pages active:                            250000.
+Pages inactive:                          240000.
+Pages speculative:                         4000.
+Pages throttled:                              0.
+Pages wired down:                        100000.
+Pages purgeable:                          10000.
+"Translation faults":                 123456789.
+Pages copy-on-write:                    9876543.
+Pages zero filled:                    456789012.
+Pages reactivated:                       123456.
+Pages purged:                             65432.
+File-backed pages:                       200000.
+Anonymous pages:                         300000.
+Pages stored in compressor:              150000.
+Pages occupied by compressor:             50000.
+Decompressions:                          111111.
+Compressions:                            222222.
+Pageins:                                3333333.
+Pageouts:                                  4444.
+Swapins:                                      0.
+Swapouts:                                     0.
+`
+	pressure, err := parseVMStat(output)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := MemoryPressure{App: 290000 * 16384, Wired: 100000 * 16384, Compressed: 50000 * 16384}
+	if *pressure != want {
+		t.Errorf("got %+v, want %+v", *pressure, want)
+	}
+
+	// Intel Macs use 4 KiB pages
+	intel := strings.Replace(output, "16384", "4096", 1)
+	if pressure, err = parseVMStat(intel); err != nil || pressure.Wired != 100000*4096 {
+		t.Errorf("got %+v, %v", pressure, err)
+	}
+
+	if _, err := parseVMStat(strings.Replace(output, "Anonymous pages", "Other pages", 1)); err == nil {
+		t.Error("expected an error without anonymous pages")
+	}
+	if _, err := parseVMStat("Pages free: 5000.\n"); err == nil {
+		t.Error("expected an error without a page size")
+	}
+}
+
+func TestParseSwapUsage(t *testing.T) {
+	tests := []struct {
+		output    string
+		wantTotal uint64
+		wantUsed  uint64
+		wantErr   bool
+	}{
+		{output: "total = 2048.00M  used = 1034.25M  free = 1013.75M  (encrypted)\n", wantTotal: 2048 << 20, wantUsed: 1034.25 * (1 << 20)},
+		{output: "total = 0.00M  used = 0.00M  free = 0.00M  (encrypted)\n"},
+		{output: "total = 3.00G  used = 512.00K  free = 3.00G  (encrypted)\n", wantTotal: 3 << 30, wantUsed: 512 << 10},
+		{output: "sysctl: unknown oid 'vm.swapusage'\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		total, used, err := parseSwapUsage(tt.output)
+		if (err != nil) != tt.wantErr || total != tt.wantTotal || used != tt.wantUsed {
+			t.Errorf("%q: got %d, %d, %v, want %d, %d", tt.output, total, used, err, tt.wantTotal, tt.wantUsed)
+		}
+	}
+}
+
+func TestParseMemoryPressureLevel(t *testing.T) {
+	tests := []struct {
+		output  string
+		want    string
+		wantErr bool
+	}{
+		{output: "1\n", want: "normal"},
+		{output: "2\n", want: "warning"},
+		{output: "4\n", want: "critical"},
+		{output: "3\n", wantErr: true},
+		{output: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseMemoryPressureLevel(tt.output)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("%q: got %q, %v, want %q", tt.output, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseCPUFrequency(t *testing.T) {
+	if mhz, ok := parseCPUFrequency("2600000000\n"); !ok || mhz != 2600 {
+		t.Errorf("got %v, %v, want 2600", mhz, ok)
+	}
+	// Apple silicon has no hw.cpufrequency, sysctl prints nothing
+	for _, output := range []string{"", "0\n", "unknown"} {
+		if _, ok := parseCPUFrequency(output); ok {
+			t.Errorf("%q: expected no frequency", output)
+		}
+	}
+}
+
+func TestParseThermalPressure(t *testing.T) {
+	tests := []struct {
+		output  string
+		want    string
+		wantErr bool
+	}{
+		{output: "com.apple.system.thermalpressurelevel 0\n", want: "nominal"},
+		{output: "com.apple.system.thermalpressurelevel 2\n", want: "heavy"},
+		{output: "com.apple.system.thermalpressurelevel 4\n", want: "sleeping"},
+		{output: "com.apple.system.thermalpressurelevel 7\n", wantErr: true},
+		{output: "com.apple.system.thermalpressurelevel -1\n", wantErr: true},
+		{output: "com.apple.system.thermalpressurelevel high\n", wantErr: true},
+		{output: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseThermalPressure(tt.output)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("%q: got %q, %v, want %q", tt.output, got, err, tt.want)
+		}
+	}
+}
+
+func TestGetTopProcesses(t *testing.T) {
+	processes := []ProcessInfo{
+		{Name: "Finder", PID: 410, CPUPercent: 0.5, Memory: 150 << 20},
+		{Name: "WindowServer", PID: 150, CPUPercent: 12.5, Memory: 600 << 20},
+		{Name: "Safari", PID: 800, CPUPercent: 0.5, Memory: 900 << 20},
+		{Name: "kernel_task", PID: 0, CPUPercent: 30, Memory: 2 << 30},
+	}
+
+	top := getTopProcesses(processes, 3)
+	var names []string
+	for _, proc := range top {
+		names = append(names, proc.Name)
+	}
+	// Equal CPU usage is ordered by memory
+	if want := []string{"kernel_task", "WindowServer", "Safari"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got %v, want %v", names, want)
+	}
+	if processes[0].Name != "Finder" {
+		t.Error("the processes were reordered")
+	}
+	if top := getTopProcesses(processes, 10); len(top) != 4 {
+		t.Errorf("got %d processes, want 4", len(top))
+	}
+}
+
+func TestGetWatchedProcess(t *testing.T) {
+	processes := []ProcessInfo{
+		{Name: "node", PID: 1200, CPUPercent: 5, Memory: 100 << 20},
+		{Name: "Safari", PID: 800, CPUPercent: 2, Memory: 900 << 20},
+		{Name: "Node", PID: 1300, CPUPercent: 1.5, Memory: 50 << 20},
+	}
+
+	got := getWatchedProcess(processes, "node")
+	want := WatchedProcess{Name: "node", Running: true, PIDs: []int32{1200, 1300}, CPUPercent: 6.5, Memory: 150 << 20}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	got = getWatchedProcess(processes, "docker")
+	if got.Running || got.PIDs != nil || got.Memory != 0 {
+		t.Errorf("got %+v for a process that isn't running", got)
+	}
+}
+
+func TestParseLsappinfo(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		want    FrontmostApp
+		wantErr bool
+	}{
+		{
+			name:   "app",
+			output: "\"LSDisplayName\"=\"Safari\"\n\"CFBundleIdentifier\"=\"com.apple.Safari\"\n\"pid\"=1234\n",
+			want:   FrontmostApp{Name: "Safari", BundleID: "com.apple.Safari", PID: 1234},
+		},
+		{
+			name:   "name with spaces and quotes",
+			output: "\"CFBundleIdentifier\"=\"com.microsoft.VSCode\"\n\"LSDisplayName\"=\"Visual Studio \"Code\"\"\n\"pid\"=88\n",
+			want:   FrontmostApp{Name: "Visual Studio \"Code\"", BundleID: "com.microsoft.VSCode", PID: 88},
+		},
+		{
+			name:   "without a bundle",
+			output: "\"LSDisplayName\"=\"java\"\n\"CFBundleIdentifier\"=[ NULL ]\n\"pid\"=4321\n",
+			want:   FrontmostApp{Name: "java", PID: 4321},
+		},
+		{
+			name:    "no front application",
+			output:  "",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLsappinfo(tt.output)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if *got != tt.want {
+				t.Errorf("got %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseWindowTitle(t *testing.T) {
+	long := strings.Repeat("ä", MaxStateLength+10)
+	tests := []struct {
+		output string
+		want   string
+	}{
+		{output: "Inbox – 3 messages\n", want: "Inbox – 3 messages"},
+		{output: "missing value\n", want: ""},
+		{output: "\n", want: ""},
+		{output: long + "\n", want: strings.Repeat("ä", MaxStateLength)},
+	}
+
+	for _, tt := range tests {
+		if got := parseWindowTitle(tt.output); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.output, got, tt.want)
+		}
+	}
+}
+
+func TestIsAccessDenied(t *testing.T) {
+	tests := []struct {
+		stderr string
+		want   bool
+	}{
+		{stderr: "36:125: execution error: System Events got an error: osascript is not allowed assistive access. (-25211)\n", want: true},
+		{stderr: "execution error: System Events got an error: osascript is not allowed assistive access. (-1719)\n", want: true},
+		{stderr: "execution error: Not authorized to send Apple events to System Events. (-1743)\n", want: true},
+		{stderr: "36:125: execution error: System Events got an error: Can’t get window 1 of application process \"Finder\". Invalid index. (-1719)\n"},
+		{stderr: ""},
+	}
+
+	for _, tt := range tests {
+		if got := isAccessDenied(tt.stderr); got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.stderr, got, tt.want)
+		}
+	}
+}
+
+// fakeIdleTimeProvider returns the idle times in order, the last one repeatedly
+type fakeIdleTimeProvider struct {
+	idleTimes []time.Duration
+}
+
+func (p *fakeIdleTimeProvider) IdleTime() (time.Duration, error) {
+	idleTime := p.idleTimes[0]
+	if len(p.idleTimes) > 1 {
+		p.idleTimes = p.idleTimes[1:]
+	}
+	return idleTime, nil
+}
+
+func TestCheckUserActivity(t *testing.T) {
+	app := newTestApplication()
+	app.idleProvider = &fakeIdleTimeProvider{idleTimes: []time.Duration{
+		2 * time.Second,  // typing
+		9 * time.Second,  // still active
+		10 * time.Second, // reached the threshold
+		25 * time.Second,
+		400 * time.Second, // away
+		time.Second,       // back
+	}}
+	client := newFakeMQTTClient()
+	threshold := 10 * time.Second
+
+	var changes []bool
+	for range 6 {
+		_, changed, err := app.checkUserActivity(client, threshold)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		changes = append(changes, changed)
+	}
+
+	if want := []bool{true, false, true, false, false, true}; !reflect.DeepEqual(changes, want) {
+		t.Errorf("changes = %v, want %v", changes, want)
+	}
+	if got, want := client.payloads("/status/user_activity"), []string{"active", "inactive", "active"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("user_activity = %v, want %v", got, want)
+	}
+	if got, want := client.payloads("/status/presence"), []string{PresenceActive, PresenceIdle, PresenceAway, PresenceActive}; !reflect.DeepEqual(got, want) {
+		t.Errorf("presence = %v, want %v", got, want)
+	}
+	if app.getUserActivityState() != "active" {
+		t.Errorf("state = %s, want active", app.getUserActivityState())
+	}
+}
+
+func TestParseScreenLocked(t *testing.T) {
+	session := func(user string, uid int, onConsole, locked bool) string {
+		yesNo := map[bool]string{true: "Yes", false: "No"}
+		s := fmt.Sprintf(`{"kCGSSessionOnConsoleKey"=%s,"kSCSecuritySessionID"=100024,"kCGSSessionGroupIDKey"=20,`+
+			`"kCGSessionLoginDoneKey"=Yes,"kCGSSessionSystemSafeBoot"=No,"kCGSSessionUserNameKey"="%s",`+
+			`"kCGSSessionAuditIDKey"=100024,"kCGSSessionUserIDKey"=%d,"kCGSSessionConsoleSetKey"=0,"kCGSessionIDKey"=257`,
+			yesNo[onConsole], user, uid)
+		if locked {
+			s += `,"CGSSessionScreenIsLocked"=Yes,"CGSSessionScreenLockedTime"=1714550400`
+		}
+		return s + "}"
+	}
+	ioreg := func(sessions ...string) string {
+		return `+-o Root  <class IORegistryEntry, id 0x100000100, retain 46>
+    {
+      "IOKitBuildVersion" = "Darwin Kernel Version 23.4.0"
+      "IOConsoleLocked" = No
+      "IOConsoleUsers" = (` + strings.Join(sessions, ",") + `)
+      "IORegistryPlanes" = {"IOService"="IOService","IOPower"="IOPower"}
+    }
+`
+	}
+
+	tests := []struct {
+		name    string
+		output  string
+		want    bool
+		wantErr bool
+	}{
+		{name: "unlocked", output: ioreg(session("jane", 501, true, false)), want: false},
+		{name: "locked", output: ioreg(session("jane", 501, true, true)), want: true},
+		{
+			name:   "other user locked in the background",
+			output: ioreg(session("john", 502, false, true), session("jane", 501, true, false)),
+			want:   false,
+		},
+		{
+			name:   "switched to another user",
+			output: ioreg(session("jane", 501, false, true), session("john", 502, true, false)),
+			want:   false,
+		},
+		{name: "login window", output: ioreg(session("jane", 501, false, false)), want: true},
+		{name: "no console users", output: "+-o Root  <class IORegistryEntry>\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseScreenLocked(tt.output)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("got %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePingOutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		want    ProbeResult
+		wantErr bool
+	}{
+		{
+			name: "all replies",
+			output: `PING 192.168.1.1 (192.168.1.1): 56 data bytes
+
+--- 192.168.1.1 ping statistics ---
+3 packets transmitted, 3 packets received, 0.0% packet loss
+round-trip min/avg/max/stddev = 11.203/12.524/14.007/1.150 ms
+`,
+			want: ProbeResult{Success: true, RTT: 12.524},
+		},
+		{
+			name: "partial loss",
+			output: `PING 1.1.1.1 (1.1.1.1): 56 data bytes
+
+--- 1.1.1.1 ping statistics ---
+4 packets transmitted, 3 packets received, 25.0% packet loss
+round-trip min/avg/max/stddev = 9.870/10.412/11.002/0.463 ms
+`,
+			want: ProbeResult{Success: true, RTT: 10.412, PacketLoss: 25},
+		},
+		{
+			name: "full loss",
+			output: `PING 10.0.0.99 (10.0.0.99): 56 data bytes
+
+--- 10.0.0.99 ping statistics ---
+3 packets transmitted, 0 packets received, 100.0% packet loss
+`,
+			want: ProbeResult{PacketLoss: 100, Error: "no reply"},
+		},
+		{
+			name: "single packet",
+			output: `--- 192.168.1.1 ping statistics ---
+1 packets transmitted, 1 packets received, 0.0% packet loss
+round-trip min/avg/max/stddev = 3.100/3.100/3.100/0.000 ms
+`,
+			want: ProbeResult{Success: true, RTT: 3.1},
+		},
+		{
+			name: "duplicates",
+			output: `--- 192.168.1.255 ping statistics ---
+2 packets transmitted, 2 packets received, +3 duplicates, 0.0% packet loss
+round-trip min/avg/max/stddev = 1.000/2.000/3.000/0.500 ms
+`,
+			want: ProbeResult{Success: true, RTT: 2},
+		},
+		{
+			name: "received without packets",
+			output: `--- example.com ping statistics ---
+2 packets transmitted, 1 received, 50% packet loss, time 1001ms
+rtt min/avg/max/mdev = 20.100/20.100/20.100/0.000 ms
+`,
+			want: ProbeResult{Success: true, RTT: 20.1, PacketLoss: 50},
+		},
+		{
+			name:    "unknown host",
+			output:  "ping: cannot resolve nohost.invalid: Unknown host\n",
+			wantErr: true,
+		},
+		{
+			name:    "nothing transmitted",
+			output:  "0 packets transmitted, 0 packets received, \n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePingOutput(tt.output)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunAttempts(t *testing.T) {
+	attempts := func(results ...time.Duration) func() (time.Duration, error) {
+		return func() (time.Duration, error) {
+			rtt := results[0]
+			results = results[1:]
+			if rtt < 0 {
+				return 0, fmt.Errorf("connection refused")
+			}
+			return rtt, nil
+		}
+	}
+	const failed = -1
+
+	tests := []struct {
+		name     string
+		attempts []time.Duration
+		want     ProbeResult
+	}{
+		{
+			name:     "all succeed",
+			attempts: []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 30 * time.Millisecond},
+			want:     ProbeResult{Success: true, RTT: 20},
+		},
+		{
+			name:     "some fail",
+			attempts: []time.Duration{failed, 1500 * time.Microsecond, 2500 * time.Microsecond, failed},
+			want:     ProbeResult{Success: true, RTT: 2, PacketLoss: 50, Error: "connection refused"},
+		},
+		{
+			name:     "all fail",
+			attempts: []time.Duration{failed, failed},
+			want:     ProbeResult{PacketLoss: 100, Error: "connection refused"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := runAttempts(len(tt.attempts), attempts(tt.attempts...))
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPublishProbe(t *testing.T) {
+	app := newTestApplication()
+	client := newFakeMQTTClient()
+	probe := probeConfig{Name: "Router", Type: "ping", Target: "192.168.1.1"}
+
+	app.publishProbe(client, probe, ProbeResult{Success: true, RTT: 12.524})
+	app.publishProbe(client, probe, ProbeResult{PacketLoss: 100, Error: "no reply"})
+
+	if got, want := client.payloads("/status/probe/router/rtt"), []string{"12.52", PayloadUnknown}; !reflect.DeepEqual(got, want) {
+		t.Errorf("rtt = %v, want %v", got, want)
+	}
+	if got, want := client.payloads("/status/probe/router/success"), []string{"ON", "OFF"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("success = %v, want %v", got, want)
+	}
+}
+
+func TestParsePmsetLog(t *testing.T) {
+	output := "Time stamp                Domain              \tMessage                                                                         \tDuration  \tDelay \n" +
+		"==========                ======              \t=======                                                                         \t========  \t===== \n" +
+		"2024-05-01 08:12:30 +0200 Assertions          \tPID 123(Safari) Released PreventUserIdleDisplaySleep \"Playing audio\" 00:10:00  id:0x0x0 [System: DeclUser kDisp]\t\n" +
+		"2024-05-01 08:12:31 +0200 Notification        \tDisplay is turned off                                                           \t          \t\n" +
+		"2024-05-01 08:12:33 +0200 Sleep               \tEntering Sleep state due to 'Clamshell Sleep':TCPKeepAlive=active Using AC (Charge:87%) 3 secs\t          \t\n" +
+		"2024-05-01 08:30:00 +0200 DarkWake            \tDarkWake from Deep Idle [CDN] : due to NUB.SPMI0.SW3/Maintenance Using AC (Charge:87%)\t45 secs   \t\n" +
+		"2024-05-01 08:40:02 +0200 Wake                \tDarkWake to FullWake from Deep Idle [CDNVA] : due to UserActivity Assertion Using AC (Charge:88%)\t          \t\n" +
+		"2024-05-01 08:40:03 +0200 Notification        \tDisplay is turned on                                                            \t          \t\n" +
+		"2024-05-01 08:40:04 +0200 Kernel Client Acks  \tDelays to Wake notifications: [AppleHDAController driver is slow(msg: WillChangeState to 2)(165 ms)]\t\n" +
+		"Total Sleep/Wakes since boot:12\n"
+
+	events := parsePmsetLog(output)
+	var types []string
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	if want := []string{"display_off", "will_sleep", "did_wake", "display_on"}; !reflect.DeepEqual(types, want) {
+		t.Fatalf("types = %v, want %v", types, want)
+	}
+
+	wake := events[2]
+	if want := time.Date(2024, 5, 1, 8, 40, 2, 0, time.FixedZone("", 2*60*60)); !wake.Time.Equal(want) {
+		t.Errorf("wake time = %s, want %s", wake.Time, want)
+	}
+	if !strings.HasPrefix(wake.Details, "DarkWake to FullWake from Deep Idle [CDNVA]") {
+		t.Errorf("wake details = %q", wake.Details)
+	}
+	if events[1].Details != "Entering Sleep state due to 'Clamshell Sleep':TCPKeepAlive=active Using AC (Charge:87%) 3 secs" {
+		t.Errorf("sleep details = %q", events[1].Details)
+	}
+
+	if events := parsePmsetLog(""); events != nil {
+		t.Errorf("got %v for an empty log", events)
+	}
+}
+
+func TestParseLogStreamPowerEvent(t *testing.T) {
+	line := func(message string) string {
+		return `{"traceID":1234,"eventMessage":"` + message + `","eventType":"logEvent","subsystem":"com.apple.powerd",` +
+			`"processImagePath":"\/System\/Library\/CoreServices\/powerd.bundle\/powerd","timestamp":"2024-05-01 08:40:02.123456+0200",` +
+			`"messageType":"Default","processID":123}`
+	}
+
+	tests := []struct {
+		name   string
+		line   string
+		want   string
+		wantOK bool
+	}{
+		{name: "sleep", line: line("Entering Sleep state due to 'Idle Sleep':TCPKeepAlive=active"), want: "will_sleep", wantOK: true},
+		{name: "wake", line: line("Wake from Deep Idle [CDNVA] : due to EC.LidOpen/Lid Open"), want: "did_wake", wantOK: true},
+		{name: "full wake", line: line("DarkWake to FullWake from Deep Idle [CDNVA] : due to UserActivity Assertion"), want: "did_wake", wantOK: true},
+		{name: "display off", line: line("Display is turned off"), want: "display_off", wantOK: true},
+		{name: "display on", line: line("Display is turned on"), want: "display_on", wantOK: true},
+		{name: "dark wake", line: line("DarkWake from Deep Idle [CDN] : due to NUB.SPMI0.SW3/Maintenance")},
+		{name: "header", line: "Filtering the log data using \"process == \\\"powerd\\\"\""},
+		{name: "bad timestamp", line: `{"eventMessage":"Display is turned on","timestamp":"yesterday"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, ok := parseLogStreamPowerEvent(tt.line)
+			if ok != tt.wantOK || event.Type != tt.want {
+				t.Fatalf("got %+v, %v, want %s", event, ok, tt.want)
+			}
+			if ok && !event.Time.Equal(time.Date(2024, 5, 1, 8, 40, 2, 123456000, time.FixedZone("", 2*60*60))) {
+				t.Errorf("time = %s", event.Time)
+			}
+		})
+	}
+}
+
+func TestApplyProfileConcurrentReads(t *testing.T) {
+	app := newTestApplication()
+	app.config.IP, app.config.Port = "10.0.0.2", "1883"
+	app.baseConfig = *app.config
+	office := &profileConfig{Name: "office", IP: "10.1.0.2", Topic: "office", Sensors: []string{"battery"}, Commands: []string{"volume"}}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 200 {
+			if i%2 == 0 {
+				app.applyProfile(office)
+			} else {
+				app.applyProfile(nil)
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			if broker := app.getBrokerConfig(); broker.IP != "10.0.0.2" || broker.Port != "1883" {
+				t.Errorf("got %+v after switching back to the default profile", broker)
+			}
+			return
+		default:
+			broker := app.getBrokerConfig()
+			if broker.IP != "10.0.0.2" && broker.IP != "10.1.0.2" {
+				t.Fatalf("unexpected broker %+v", broker)
+			}
+			app.isCommandAllowed(app.getTopicPrefix()+"/command/volume", "10")
+			app.getProfileName()
+		}
+	}
+}
+
+func TestApplyMediaFilter(t *testing.T) {
+	now := time.Now()
+	playing := func(bundleID, title string) MediaInfo {
+		return MediaInfo{State: "playing", AppBundleID: bundleID, Title: title, PositionUpdatedAt: now}
+	}
+	paused := func(bundleID, title string) MediaInfo {
+		return MediaInfo{State: "paused", AppBundleID: bundleID, Title: title, PositionUpdatedAt: now}
+	}
+
+	tests := []struct {
+		name          string
+		updates       []MediaInfo
+		wantTitle     string
+		wantPublished bool          // whether the last update has to be published
+		gap           time.Duration // time between the updates
+	}{
+		{"latest app wins without preferences", []MediaInfo{playing("com.apple.Music", "a"), playing("com.example.player", "b")}, "b", true, 0},
+		{"preferred app keeps playing", []MediaInfo{playing("com.spotify.client", "a"), playing("com.apple.Music", "b")}, "a", false, 0},
+		{"preferred app matched case-insensitively", []MediaInfo{playing("COM.SPOTIFY.CLIENT", "a"), playing("com.apple.Music", "b")}, "a", false, 0},
+		{"falls back when the preferred app pauses", []MediaInfo{playing("com.apple.Music", "b"), playing("com.spotify.client", "a"), paused("com.spotify.client", "a")}, "b", true, 0},
+		{"paused update shown when nothing plays", []MediaInfo{playing("com.apple.Music", "b"), paused("com.apple.Music", "b")}, "b", true, 0},
+		{"ignored app dropped", []MediaInfo{playing("com.apple.Music", "b"), playing("US.ZOOM.XOS", "c")}, "b", false, 0},
+		{"preferred stream kept while it reports", []MediaInfo{playing("com.spotify.client", "radio"), playing("com.apple.Music", "b")}, "radio", false, time.Minute},
+		{"preferred stream dropped after the timeout", []MediaInfo{playing("com.spotify.client", "radio"), playing("com.apple.Music", "b")}, "b", true, 3 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication()
+			app.config.MediaIgnoreApps = []string{"us.zoom.xos"}
+			app.config.MediaPreferApps = []string{"com.spotify.client"}
+			app.mediaAppStates = make(map[string]mediaAppState)
+
+			var current MediaInfo
+			var published bool
+			for i, update := range tt.updates {
+				current, published = app.applyMediaFilter(update, now.Add(time.Duration(i)*tt.gap))
+			}
+			if current.Title != tt.wantTitle || published != tt.wantPublished {
+				t.Errorf("got %q published %v, want %q published %v", current.Title, published, tt.wantTitle, tt.wantPublished)
+			}
+			if app.currentMediaState.Title != tt.wantTitle {
+				t.Errorf("current media state %q, want %q", app.currentMediaState.Title, tt.wantTitle)
+			}
+		})
+	}
+}
+
+func TestRecordTrackPlay(t *testing.T) {
+	start := time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC)
+	track := func(state, title string) MediaInfo {
+		return MediaInfo{State: state, Title: title, Artist: "Artist", AppBundleID: "com.apple.Music"}
+	}
+	type step struct {
+		at    time.Duration // since start
+		state MediaInfo     // zero to only check the threshold, as the progress loop does
+		want  []string      // the events as event_type:listened_seconds
+	}
+
+	tests := []struct {
+		name      string
+		threshold int
+		steps     []step
+	}{
+		{
+			"published when the threshold is reached while playing",
+			30,
+			[]step{
+				{0, track("playing", "a"), nil},
+				{20 * time.Second, MediaInfo{}, nil},
+				{31 * time.Second, MediaInfo{}, []string{"track_played:31"}},
+				{40 * time.Second, MediaInfo{}, nil},
+				{200 * time.Second, MediaInfo{State: "idle"}, []string{"track_finished:200"}},
+			},
+		},
+		{
+			"pause and resume count for the same listen",
+			30,
+			[]step{
+				{0, track("playing", "a"), nil},
+				{20 * time.Second, track("idle", "a"), nil},
+				{60 * time.Second, track("playing", "a"), nil},
+				{75 * time.Second, MediaInfo{}, []string{"track_played:35"}},
+				{80 * time.Second, track("playing", "b"), []string{"track_finished:40"}},
+			},
+		},
+		{
+			"both events when the track changes after the threshold",
+			30,
+			[]step{
+				{0, track("playing", "a"), nil},
+				{33 * time.Second, track("playing", "b"), []string{"track_played:33", "track_finished:33"}},
+			},
+		},
+		{
+			"short listen not published",
+			30,
+			[]step{
+				{0, track("playing", "a"), nil},
+				{10 * time.Second, track("playing", "b"), nil},
+				{20 * time.Second, MediaInfo{State: "idle"}, nil},
+			},
+		},
+		{
+			"zero threshold counts every track",
+			0,
+			[]step{
+				{0, track("playing", "a"), []string{"track_played:0"}},
+				{5 * time.Second, track("playing", "b"), []string{"track_finished:5", "track_played:0"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication()
+			app.config.ScrobbleThreshold = &tt.threshold
+			for i, s := range tt.steps {
+				now := start.Add(s.at)
+				var events []TrackPlayed
+				if s.state == (MediaInfo{}) {
+					if played := app.checkTrackPlayed(now); played != nil {
+						events = append(events, *played)
+					}
+				} else {
+					events = app.recordTrackPlay(s.state, now)
+				}
+
+				var got []string
+				for _, event := range events {
+					got = append(got, fmt.Sprintf("%s:%d", event.EventType, event.ListenedSeconds))
+				}
+				if !reflect.DeepEqual(got, s.want) {
+					t.Errorf("step %d: got events %v, want %v", i, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestUpdatePeriodicSensors(t *testing.T) {
+	app := newTestApplication()
+	app.powerPolicy = PowerPolicyBattery
+	app.config.PowerPolicy = powerPolicyConfig{BatteryMultiplier: 2, Sensors: map[string]float64{"battery": 1, "cpu": 5}}
+
+	start := time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC)
+	updates := make(map[string]int)
+	var sensors []*periodicSensor
+	for _, name := range []string{"battery", "battery_health", "cpu"} {
+		sensors = append(sensors, &periodicSensor{name: name, update: func(mqtt.Client) { updates[name]++ }, next: start})
+	}
+
+	for now := start; now.Before(start.Add(10 * time.Minute)); now = now.Add(SensorCheckInterval) {
+		app.updatePeriodicSensors(nil, sensors, now)
+	}
+
+	// battery every minute, battery_health every two minutes on battery, cpu every five minutes
+	want := map[string]int{"battery": 10, "battery_health": 5, "cpu": 2}
+	if !reflect.DeepEqual(updates, want) {
+		t.Errorf("got updates %v, want %v", updates, want)
+	}
+}
+
+func TestGetVolumeKey(t *testing.T) {
+	tests := []struct {
+		mountPoint string
+		want       string
+	}{
+		{"/Volumes/Time Machine", "volumes_time_machine"},
+		{"/Volumes/Backup", "volumes_backup"},
+		{"/container", "container_volume"},
+		{"/Container/", "container_volume"},
+		{"/containers", "containers"},
+	}
+
+	for _, tt := range tests {
+		if got := getVolumeKey(tt.mountPoint); got != tt.want {
+			t.Errorf("getVolumeKey(%q) = %q, want %q", tt.mountPoint, got, tt.want)
+		}
+	}
+}
+
+func TestParseVolumeCommand(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    VolumeCommand
+		wantErr bool
+	}{
+		{"30", VolumeCommand{Volume: 30}, false},
+		{" 100 ", VolumeCommand{Volume: 100}, false},
+		{"101", VolumeCommand{}, true},
+		{"+5", VolumeCommand{Volume: 5, Relative: true}, false},
+		{"-10", VolumeCommand{Volume: -10, Relative: true}, false},
+		{"+0", VolumeCommand{Volume: 0, Relative: true}, false},
+		{"+101", VolumeCommand{}, true},
+		{"-101", VolumeCommand{}, true},
+		{"+five", VolumeCommand{}, true},
+		{"fade to 20 over 30s", VolumeCommand{Volume: 20, Fade: 30 * time.Second}, false},
+		{"fade 20 in 5m", VolumeCommand{Volume: 20, Fade: 5 * time.Minute}, false},
+		{"Fade To 0 Over 90", VolumeCommand{Volume: 0, Fade: 90 * time.Second}, false},
+		{"fade to 120 over 30s", VolumeCommand{}, true},
+		{"fade to 20 over 3h", VolumeCommand{}, true},
+		{"fade to 20 over 0s", VolumeCommand{}, true},
+		{"fade to 20", VolumeCommand{}, true},
+		{"loud", VolumeCommand{}, true},
+	}
+
+	app := newTestApplication()
+	for _, tt := range tests {
+		got, err := app.parseVolumeCommand(tt.payload)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseVolumeCommand(%q) error = %v, wantErr %v", tt.payload, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseVolumeCommand(%q) = %+v, want %+v", tt.payload, got, tt.want)
+		}
+	}
+}
+
+func TestParseFadeDuration(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"30", 30 * time.Second, false},
+		{"30s", 30 * time.Second, false},
+		{"15m", 15 * time.Minute, false},
+		{"2h", 2 * time.Hour, false},
+		{"2h1s", 0, true},
+		{"0", 0, true},
+		{"-5s", 0, true},
+		{"soon", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseFadeDuration(tt.input)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseFadeDuration(%q) = %v, %v, want %v, wantErr %v", tt.input, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestGetFadeVolume(t *testing.T) {
+	tests := []struct {
+		from, to int
+		elapsed  time.Duration
+		want     int
+	}{
+		{60, 20, 0, 60},
+		{60, 20, 15 * time.Second, 40},
+		{60, 20, 30 * time.Second, 20},
+		{60, 20, time.Minute, 20},
+		{0, 100, 10 * time.Second, 33},
+		{20, 20, 10 * time.Second, 20},
+	}
+
+	for _, tt := range tests {
+		if got := getFadeVolume(tt.from, tt.to, tt.elapsed, 30*time.Second); got != tt.want {
+			t.Errorf("getFadeVolume(%d, %d, %s) = %d, want %d", tt.from, tt.to, tt.elapsed, got, tt.want)
+		}
+	}
+}
+
+func TestSwitchOutputDevice(t *testing.T) {
+	app := newTestApplication()
+
+	// The first device is only recorded
+	if _, _, changed := app.switchOutputDevice("Speakers"); changed {
+		t.Error("first device reported as a change")
+	}
+	app.rememberOutputVolume(60)
+
+	// Same device: nothing to restore, the caller remembers the current volume
+	if _, _, changed := app.switchOutputDevice("Speakers"); changed {
+		t.Error("same device reported as a change")
+	}
+
+	// A device without a remembered volume keeps its volume
+	if _, remembered, changed := app.switchOutputDevice("Headphones"); !changed || remembered {
+		t.Errorf("new device: changed %v remembered %v, want changed without a remembered volume", changed, remembered)
+	}
+	app.rememberOutputVolume(25)
+
+	// Switching back restores the volume of each device
+	if volume, remembered, changed := app.switchOutputDevice("Speakers"); !changed || !remembered || volume != 60 {
+		t.Errorf("back to speakers: volume %d remembered %v changed %v, want 60", volume, remembered, changed)
+	}
+	if volume, remembered, changed := app.switchOutputDevice("Headphones"); !changed || !remembered || volume != 25 {
+		t.Errorf("back to headphones: volume %d remembered %v changed %v, want 25", volume, remembered, changed)
+	}
+}
+
+func TestParseAudioDevices(t *testing.T) {
+	jsonOutput := `{"name": "MacBook Pro Speakers", "type": "output", "id": "73", "uid": "BuiltInSpeakerDevice"}
+{"name": "MacBook Pro Microphone", "type": "input", "id": "66", "uid": "BuiltInMicrophoneDevice"}
+{"name": "AirPods Pro (2)", "type": "output", "id": "91", "uid": "B0-3F-64-12-34-56:output"}
+`
+	legacyOutput := `MacBook Pro Speakers (output)
+AirPods Pro (2) (output)
+
+`
+
+	tests := []struct {
+		name       string
+		output     string
+		deviceType string
+		want       []AudioDevice
+	}{
+		{
+			"json output devices",
+			jsonOutput,
+			"output",
+			[]AudioDevice{
+				{Name: "MacBook Pro Speakers", Type: "output", ID: "73", UID: "BuiltInSpeakerDevice"},
+				{Name: "AirPods Pro (2)", Type: "output", ID: "91", UID: "B0-3F-64-12-34-56:output"},
+			},
+		},
+		{
+			"json input devices",
+			jsonOutput,
+			"input",
+			[]AudioDevice{{Name: "MacBook Pro Microphone", Type: "input", ID: "66", UID: "BuiltInMicrophoneDevice"}},
+		},
+		{
+			"legacy format",
+			legacyOutput,
+			"output",
+			[]AudioDevice{{Name: "MacBook Pro Speakers", Type: "output"}, {Name: "AirPods Pro (2)", Type: "output"}},
+		},
+		{"empty output", "", "output", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseAudioDevices(tt.output, tt.deviceType); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsCommandAllowed(t *testing.T) {
+	tests := []struct {
+		commands []string
+		topic    string
+		payload  string
+		want     bool
+	}{
+		{nil, "/command/set", "shutdown", true},
+		{[]string{"volume", "lock", "brightness"}, "/command/volume", "20", true},
+		{[]string{"volume", "lock", "brightness"}, "/command/mute", "true", false},
+		{[]string{"volume", "lock", "brightness"}, "/command/set", "lock", true},
+		{[]string{"volume", "lock", "brightness"}, "/command/set", "shutdown", false},
+		{[]string{"volume", "lock", "brightness"}, "/command/display_1_brightness", "50", true},
+		{[]string{"volume"}, "/command/display_1_brightness", "50", false},
+		{[]string{"set"}, "/command/set", "shutdown", true},
+		{[]string{"bluetooth"}, "/command/bluetooth/aa_bb_cc_dd_ee_ff", "on", true},
+		{[]string{"volume"}, "/command/volume_fade", "20", false},
+	}
+
+	for _, tt := range tests {
+		app := newTestApplication()
+		app.config.Commands = tt.commands
+		if got := app.isCommandAllowed(testTopicPrefix+tt.topic, tt.payload); got != tt.want {
+			t.Errorf("commands %v: isCommandAllowed(%s, %q) = %v, want %v", tt.commands, tt.topic, tt.payload, got, tt.want)
+		}
+	}
+}
+
+func TestSensorGroups(t *testing.T) {
+	groups := map[string][]string{
+		"volume":        {"/status/volume", "/status/mute", "/status/input_volume", "/status/input_mute", "/status/audio_output", "/status/audio_input"},
+		"battery":       {"/status/battery", "/status/battery/power_source", "/status/battery/health", "/status/battery/condition"},
+		"disk":          {"/status/disk/free", "/status/disk/container/total", "/status/disk/volumes_backup/full"},
+		"throughput":    {"/status/network/en0/rx_rate", "/status/network/en0/tx_rate", "/status/disk_io/disk0/read_rate"},
+		"cpu":           {"/status/cpu/used_percent", "/status/cpu/core/0", "/status/cpu/thermal_pressure"},
+		"memory":        {"/status/memory/used", "/status/memory/pressure"},
+		"processes":     {"/status/processes/top", "/status/processes/top_attr", "/events/process"},
+		"apps":          {"/status/apps/running", "/status/apps/running_attr"},
+		"bluetooth":     {"/status/bluetooth/connected", "/status/bluetooth/aa_bb_cc_dd_ee_ff/battery_main"},
+		"uptime":        {"/status/uptime/seconds", "/status/uptime/human"},
+		"public_ip":     {"/status/public_ip", "/status/public_ipv6", "/status/public_ip_attr"},
+		"network":       {"/status/network/gateway", "/status/network/vpn", "/status/wifi/ssid", "/events/network"},
+		"probes":        {"/status/probe/router/rtt"},
+		"media_devices": {"/status/microphone", "/status/camera"},
+		"media":         {"/status/now_playing", "/status/media_progress", "/status/media_stream", "/events/track_played"},
+		"presence":      {"/status/presence", "/status/presence_changed_at", "/status/user_activity", "/status/idle_time_seconds"},
+		"screen_lock":   {"/status/screen_locked"},
+		"frontmost_app": {"/status/frontmost_app", "/status/frontmost_window_title"},
+		"power_events":  {"/status/last_wake", "/events/power"},
+		"":              {"/status/alive", "/status/caffeinate", "/status/profile", "/status/power_policy"},
+	}
+
+	app := newTestApplication()
+	for want, topics := range groups {
+		for _, topic := range topics {
+			for _, group := range sensorGroups {
+				app.config.Sensors = []string{group.name}
+				enabled := app.isTopicEnabled(testTopicPrefix + topic)
+				if shouldBe := want == "" || group.name == want; enabled != shouldBe {
+					t.Errorf("%s with sensors [%s]: enabled %v, want %v", topic, group.name, enabled, shouldBe)
+				}
+			}
+		}
+	}
+
+	// Topics of other prefixes are never filtered
+	app.config.Sensors = []string{"volume"}
+	if !app.isTopicEnabled("homeassistant/device/test/config") {
+		t.Error("discovery topic filtered")
+	}
+}
+
+func TestSelectProfile(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	reachable := listener.Addr().(*net.TCPAddr)
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := closed.Addr().(*net.TCPAddr)
+	closed.Close()
+
+	tests := []struct {
+		name       string
+		brokerPort int
+		ssid       string
+		want       string
+	}{
+		{"reachable broker comes first", reachable.Port, "Home", "office"},
+		{"ssid after an unreachable broker", unreachable.Port, "Home", "home"},
+		{"catch-all without a match", unreachable.Port, "Cafe", "travel"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication()
+			app.baseConfig = config{IP: "127.0.0.1", Port: "1883", Profiles: []profileConfig{
+				{Name: "office", BrokerReachable: true, Port: strconv.Itoa(tt.brokerPort)},
+				{Name: "home", SSIDs: []string{"Home"}},
+				{Name: "travel"},
+				{Name: "never", SSIDs: []string{"Cafe"}},
+			}}
+
+			profile := app.selectProfile(&NetworkInfo{SSID: tt.ssid})
+			if profile == nil || profile.Name != tt.want {
+				t.Errorf("got profile %+v, want %s", profile, tt.want)
+			}
+		})
+	}
+}
+
+func TestProfileMatchesNetwork(t *testing.T) {
+	home := &profileConfig{Name: "home", SSIDs: []string{"Home"}, GatewayMACs: []string{"0:1B:2c:3D:4e:5F"}}
+
+	tests := []struct {
+		profile    *profileConfig
+		ssid       string
+		gatewayMAC string
+		want       bool
+	}{
+		{home, "Home", "", true},
+		{home, "home", "", false},
+		{home, "Cafe", "00:1b:2c:3d:4e:5f", true},
+		{home, "", "00:1b:2c:3d:4e:50", false},
+		{home, "", "", false},
+		{&profileConfig{Name: "any"}, "", "", true},
+		{&profileConfig{Name: "broker", BrokerReachable: true}, "Home", "", false},
+	}
+
+	for _, tt := range tests {
+		if got := profileMatchesNetwork(tt.profile, tt.ssid, tt.gatewayMAC); got != tt.want {
+			t.Errorf("profileMatchesNetwork(%s, %q, %q) = %v, want %v", tt.profile.Name, tt.ssid, tt.gatewayMAC, got, tt.want)
+		}
+	}
+}
+
+func TestParseArpMAC(t *testing.T) {
+	tests := []struct {
+		output string
+		want   string
+	}{
+		{"? (192.168.1.1) at 0:11:22:33:44:55 on en0 ifscope [ethernet]\n", "00:11:22:33:44:55"},
+		{"? (10.0.0.1) at a:b:c:d:e:f on en0 ifscope [ethernet]\n", "0a:0b:0c:0d:0e:0f"},
+		{"? (10.0.0.1) at AA:BB:CC:DD:EE:FF on en1 ifscope [ethernet]\n", "aa:bb:cc:dd:ee:ff"},
+		{"? (10.0.0.1) at (incomplete) on en0 ifscope [ethernet]\n", ""},
+		{"10.0.0.1 (10.0.0.1) -- no entry\n", ""},
+	}
+
+	for _, tt := range tests {
+		if got := parseArpMAC(tt.output); got != tt.want {
+			t.Errorf("parseArpMAC(%q) = %q, want %q", tt.output, got, tt.want)
+		}
+	}
+}
+
+func TestMediaPosition(t *testing.T) {
+	reported := time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name          string
+		media         MediaInfo
+		elapsed       time.Duration
+		wantPosition  int
+		wantProgress  float64
+		wantRemaining int
+	}{
+		{"playing", MediaInfo{State: "playing", Duration: 200, Position: 50, PositionUpdatedAt: reported}, 50 * time.Second, 100, 50, 100},
+		{"paused", MediaInfo{State: "paused", Duration: 200, Position: 50, PositionUpdatedAt: reported}, 50 * time.Second, 50, 25, 150},
+		{"capped at the duration", MediaInfo{State: "playing", Duration: 200, Position: 190, PositionUpdatedAt: reported}, time.Minute, 200, 100, 0},
+		{"stream without duration", MediaInfo{State: "playing", Position: 30, PositionUpdatedAt: reported}, time.Minute, 90, 0, 0},
+		{"position never reported", MediaInfo{State: "playing", Duration: 200, Position: 10}, time.Minute, 10, 5, 190},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := reported.Add(tt.elapsed)
+			if got := tt.media.livePosition(now); got != tt.wantPosition {
+				t.Errorf("livePosition = %d, want %d", got, tt.wantPosition)
+			}
+			if got := tt.media.progressPercent(now); got != tt.wantProgress {
+				t.Errorf("progressPercent = %v, want %v", got, tt.wantProgress)
+			}
+			if got := tt.media.timeRemaining(now); got != tt.wantRemaining {
+				t.Errorf("timeRemaining = %d, want %d", got, tt.wantRemaining)
+			}
+		})
+	}
+}
+
+func TestMediaStreamRestarts(t *testing.T) {
+	restarts := newMediaStreamRestarts()
+
+	// Quick failures back off exponentially until the stream is replaced by polling
+	var delays []time.Duration
+	for !restarts.shouldPoll() {
+		delays = append(delays, restarts.exited(time.Second))
+	}
+	want := []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 32 * time.Second}
+	if !reflect.DeepEqual(delays, want) {
+		t.Fatalf("got delays %v, want %v", delays, want)
+	}
+
+	// After polling the stream gets one more chance, another failure polls again
+	if restarts.shouldPoll() {
+		t.Fatal("polling again without another failure")
+	}
+	if delay := restarts.exited(time.Second); delay != 64*time.Second {
+		t.Errorf("got delay %v after polling, want 64s", delay)
+	}
+	if !restarts.shouldPoll() {
+		t.Error("failure after polling did not poll again")
+	}
+
+	// The backoff is capped
+	for range 10 {
+		restarts.exited(time.Second)
+	}
+	if delay := restarts.exited(time.Second); delay != MediaStreamMaxBackoff {
+		t.Errorf("got delay %v, want the maximum %v", delay, MediaStreamMaxBackoff)
+	}
+
+	// A stable run resets the backoff and the failures
+	if delay := restarts.exited(MediaStreamStableRun); delay != MediaStreamInitialBackoff || restarts.failures != 1 {
+		t.Errorf("after a stable run: delay %v failures %d, want %v and 1", delay, restarts.failures, MediaStreamInitialBackoff)
+	}
+	if restarts.shouldPoll() {
+		t.Error("polling after a stable run")
+	}
+}
+
+func TestHandlePowerEvent(t *testing.T) {
+	wokeAt := time.Date(2026, 10, 19, 7, 0, 5, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		event      PowerEvent
+		wantWake   bool
+		wantAsleep bool
+	}{
+		{"sleep delivered after the wake", PowerEvent{Type: "will_sleep", Time: wokeAt.Add(-8 * time.Hour)}, false, false},
+		{"sleep at the wake time", PowerEvent{Type: "will_sleep", Time: wokeAt}, false, false},
+		{"sleep after the wake", PowerEvent{Type: "will_sleep", Time: wokeAt.Add(time.Hour)}, false, true},
+		{"wake", PowerEvent{Type: "did_wake", Time: wokeAt.Add(time.Hour)}, true, false},
+		{"display off", PowerEvent{Type: "display_off", Time: wokeAt.Add(time.Hour)}, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication()
+			client := newFakeMQTTClient()
+
+			if woke := app.handlePowerEvent(client, tt.event, wokeAt); woke != tt.wantWake {
+				t.Errorf("got wake %v, want %v", woke, tt.wantWake)
+			}
+			if app.systemAsleep != tt.wantAsleep {
+				t.Errorf("got asleep %v, want %v", app.systemAsleep, tt.wantAsleep)
+			}
+			if len(client.payloads("/events/power")) != 1 {
+				t.Errorf("event published %d times, want once", len(client.payloads("/events/power")))
+			}
+		})
+	}
+}
+
+func TestGetVolumeKeys(t *testing.T) {
+	mountPoints := []string{"/Volumes/My_Disk", "/Volumes/Backup", "/Volumes/My Disk", "/Volumes/My-Disk", "/Volumes/Backup"}
+	volumes := getVolumeKeys(mountPoints)
+
+	if len(volumes) != 4 {
+		t.Fatalf("got %d volumes %v, want 4", len(volumes), volumes)
+	}
+	if volumes["volumes_backup"] != "/Volumes/Backup" {
+		t.Errorf("volumes_backup is %q", volumes["volumes_backup"])
+	}
+	if volumes["volumes_my_disk"] != "/Volumes/My Disk" {
+		t.Errorf("volumes_my_disk is %q, want the first mount point in sorted order", volumes["volumes_my_disk"])
+	}
+	for key, mountPoint := range volumes {
+		if mountPoint != "/Volumes/My-Disk" && mountPoint != "/Volumes/My_Disk" {
+			continue
+		}
+		if !strings.HasPrefix(key, "volumes_my_disk_") || len(key) != len("volumes_my_disk_")+8 {
+			t.Errorf("%s has key %q, want volumes_my_disk_ with a hash", mountPoint, key)
+		}
+	}
+
+	// The keys don't depend on the order of the mount points
+	reversed := slices.Clone(mountPoints)
+	slices.Reverse(reversed)
+	if got := getVolumeKeys(reversed); !reflect.DeepEqual(got, volumes) {
+		t.Errorf("got %v for the reversed order, want %v", got, volumes)
+	}
+
+	// Without a collision a mount point keeps its plain key
+	if got := getVolumeKeys([]string{"/Volumes/My_Disk"}); got["volumes_my_disk"] != "/Volumes/My_Disk" {
+		t.Errorf("got %v for a single mount point", got)
+	}
+}
+
+func TestParseAppTarget(t *testing.T) {
+	tests := []struct {
+		entry string
+		want  AppTarget
+	}{
+		{"Safari", AppTarget{Name: "Safari"}},
+		{"zoom.us", AppTarget{Name: "zoom.us"}},
+		{"Microsoft Teams", AppTarget{Name: "Microsoft Teams"}},
+		{"com.apple.Safari", AppTarget{BundleID: "com.apple.Safari"}},
+		{"us.zoom.xos", AppTarget{BundleID: "us.zoom.xos"}},
+		{"com.microsoft.teams2", AppTarget{BundleID: "com.microsoft.teams2"}},
+		{"com.apple. Safari", AppTarget{Name: "com.apple. Safari"}},
+	}
+
+	for _, tt := range tests {
+		if got := parseAppTarget(tt.entry); got != tt.want {
+			t.Errorf("parseAppTarget(%q) = %+v, want %+v", tt.entry, got, tt.want)
+		}
+	}
+}
+
+func TestParseRunningApps(t *testing.T) {
+	output := `{"names":["zoom.us","Finder","Safari","helper"],"bundle_ids":["us.zoom.xos","com.apple.finder","com.apple.Safari",null],"pids":[812,402,1201,999]}`
+	apps, err := parseRunningApps([]byte(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []RunningApp{
+		{Name: "Finder", BundleID: "com.apple.finder", PID: 402},
+		{Name: "helper", PID: 999},
+		{Name: "Safari", BundleID: "com.apple.Safari", PID: 1201},
+		{Name: "zoom.us", BundleID: "us.zoom.xos", PID: 812},
+	}
+	if !reflect.DeepEqual(apps, want) {
+		t.Errorf("got %+v, want %+v", apps, want)
+	}
+
+	for _, bad := range []string{`not json`, `{"names":["Finder"],"bundle_ids":[],"pids":[402]}`} {
+		if _, err := parseRunningApps([]byte(bad)); err == nil {
+			t.Errorf("parseRunningApps(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestIsAppAllowed(t *testing.T) {
+	app := newTestApplication()
+	app.config.AppAllowlist = []string{"Zoom.us", "com.apple.Safari"}
+	app.config.AppSwitches = []string{"Spotify"}
+
+	tests := []struct {
+		target AppTarget
+		want   bool
+	}{
+		{AppTarget{Name: "zoom.us"}, true},
+		{AppTarget{Name: "ZOOM.US"}, true},
+		{AppTarget{BundleID: "com.apple.safari"}, true},
+		{AppTarget{Name: "spotify"}, true},
+		{AppTarget{Name: "Safari"}, false}, // allowed by bundle ID only
+		{AppTarget{BundleID: "us.zoom.xos"}, false},
+		{AppTarget{Name: "Terminal"}, false},
+		{AppTarget{}, false},
+	}
+
+	for _, tt := range tests {
+		if got := app.isAppAllowed(tt.target); got != tt.want {
+			t.Errorf("isAppAllowed(%+v) = %v, want %v", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestValidateAppCommandInput(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    AppCommand
+		wantErr bool
+	}{
+		{`{"action": "quit", "app": "Zoom"}`, AppCommand{Action: "quit", AppTarget: AppTarget{Name: "Zoom"}}, false},
+		{`{"action": "open", "bundle_id": "com.apple.Safari"}`, AppCommand{Action: "open", AppTarget: AppTarget{BundleID: "com.apple.Safari"}}, false},
+		{`{"action": "force_quit", "app": "Safari", "bundle_id": "com.apple.Safari"}`, AppCommand{Action: "force_quit", AppTarget: AppTarget{BundleID: "com.apple.Safari"}}, false},
+		{`{"action": "activate", "app": "Notes"}`, AppCommand{Action: "activate", AppTarget: AppTarget{Name: "Notes"}}, false},
+		{`{"action": "delete", "app": "Zoom"}`, AppCommand{}, true},
+		{`{"action": "Quit", "app": "Zoom"}`, AppCommand{}, true},
+		{`{"action": "quit"}`, AppCommand{}, true},
+		{`{"action": "quit", "app": "Zoom\" to quit\ndo shell script \"id"}`, AppCommand{}, true},
+		{`{"action": "open", "bundle_id": "com.apple.Safari; rm"}`, AppCommand{}, true},
+		{`quit Zoom`, AppCommand{}, true},
+		{``, AppCommand{}, true},
+	}
+
+	app := newTestApplication()
+	for _, tt := range tests {
+		got, err := app.validateAppCommandInput(tt.payload)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validateAppCommandInput(%q) error = %v, wantErr %v", tt.payload, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("validateAppCommandInput(%q) = %+v, want %+v", tt.payload, got, tt.want)
+		}
+	}
+}